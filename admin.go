@@ -0,0 +1,311 @@
+package operator
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What the admin API shows of a link
+type LinkInfo struct {
+	ReceiverID     string    `json:"receiverId"`
+	RemoteAddr     string    `json:"remoteAddr"`
+	ConnectedSince time.Time `json:"connectedSince"`
+	LastHeartbeat  time.Time `json:"lastHeartbeat"`
+	Channels       int       `json:"channels"`
+
+	Metadata map[string]string `json:"metadata"`
+}
+
+// What the admin API shows of a channel of a link. The ratio is of the bytes
+// the channel carried to the bytes of data frames sent over the link for it.
+type ChannelInfo struct {
+	ChannelID   string  `json:"channelId"`
+	Compression string  `json:"compression,omitempty"`
+	Bytes       int64   `json:"bytes"`
+	LinkBytes   int64   `json:"linkBytes"`
+	Ratio       float64 `json:"ratio"`
+}
+
+func newChannelInfo(channelID string, stats *channelStats) *ChannelInfo {
+	info := &ChannelInfo{}
+	info.ChannelID = channelID
+	info.Compression = stats.compression
+	info.Bytes = stats.bytes.Load()
+	info.LinkBytes = stats.linkBytes.Load()
+	info.Ratio = 1
+	if info.LinkBytes > 0 {
+		info.Ratio = float64(info.Bytes) / float64(info.LinkBytes)
+	}
+	return info
+}
+
+// What the admin API shows of a registered service
+type ServiceInfo struct {
+	ServiceKey string `json:"serviceKey"`
+	Network    string `json:"network"`
+	Address    string `json:"address"`
+}
+
+func NewLinkInfo(l *Link) *LinkInfo {
+	info := &LinkInfo{}
+	info.ReceiverID = l.ReceiverID
+	info.RemoteAddr = l.RemoteAddr()
+	info.ConnectedSince = l.ConnectedSince
+	info.LastHeartbeat = l.LastHeartbeat()
+	info.Channels = l.ChannelCount()
+	info.Metadata = l.Metadata()
+	return info
+}
+
+// Returns the handler of the admin API of the operator:
+//
+//	GET    /links                        linked receivers, filtered by ?selector=
+//	GET    /links/{receiverID}           one linked receiver
+//	DELETE /links/{receiverID}           force-disconnects a link
+//	POST   /links/{receiverID}/ping      pings a receiver over its link
+//	GET    /links/{receiverID}/channels  channels of a link, with their compression ratio
+//	GET    /services                     registered services
+//	DELETE /services/{serviceKey}        deregisters a service
+//	POST   /drain                        refuses new links and disconnects the current ones
+//
+// Every request goes through AdminAuth first, if set. The requests that change
+// the operator must be sent as application/json, which browsers never do for
+// cross-site requests without asking first.
+func (o *Operator) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /links", o.adminListLinks)
+	mux.HandleFunc("GET /links/{receiverID}", o.adminGetLink)
+	mux.HandleFunc("DELETE /links/{receiverID}", o.adminDisconnect)
+	mux.HandleFunc("POST /links/{receiverID}/ping", o.adminPing)
+	mux.HandleFunc("GET /links/{receiverID}/channels", o.adminListChannels)
+	mux.HandleFunc("GET /services", o.adminListServices)
+	mux.HandleFunc("DELETE /services/{serviceKey}", o.adminDeregister)
+	mux.HandleFunc("POST /drain", o.adminDrain)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.AdminAuth != nil {
+			err := o.AdminAuth(r)
+			if err != nil {
+				o.Logger.Warn("Refused admin request", "method", r.Method, "path", r.URL.Path, LOG_REMOTE_ADDR, r.RemoteAddr, LOG_ERROR, err)
+				writeAdminError(w, http.StatusUnauthorized, err)
+				return
+			}
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !isJSONRequest(r) {
+			o.Logger.Warn("Refused admin request", "method", r.Method, "path", r.URL.Path, LOG_REMOTE_ADDR, r.RemoteAddr, "contentType", r.Header.Get("Content-Type"))
+			writeAdminError(w, http.StatusUnsupportedMediaType, fmt.Errorf("Admin requests that change the operator must be sent as %s", ADMIN_CONTENT_TYPE))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// The content type of the admin requests that change the operator
+const ADMIN_CONTENT_TYPE = "application/json"
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == ADMIN_CONTENT_TYPE
+}
+
+// Checks that admin requests carry that token as "Authorization: Bearer <token>"
+func AdminTokenAuth(token string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		given, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			return fmt.Errorf("Invalid admin token")
+		}
+		return nil
+	}
+}
+
+// Serves the admin API on that port. The API can disconnect links and drain
+// the operator, so it only listens on localhost unless AdminAuth is set.
+func (o *Operator) ServeAdmin(port int) error {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	if o.AdminAuth != nil {
+		addr = fmt.Sprintf(":%d", port)
+	}
+	o.Logger.Info("Serving operator admin", "addr", addr)
+	err := http.ListenAndServe(addr, o.AdminHandler())
+	if err != nil {
+		o.Logger.Error("Failed to serve operator admin", LOG_ERROR, err)
+	}
+	return err
+}
+
+// Refuses any new link, then disconnects the current links. Their devices
+// keep retrying to link to this operator, which keeps refusing them: they only
+// move to another operator if the host they link to resolves to one.
+func (o *Operator) Drain() error {
+	o.Logger.Info("Draining operator", LOG_RECEIVER_ID, o.GetID())
+	o.draining.Store(true)
+
+	links, err := o.listLinks()
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		err = o.disconnect(l, "Operator draining")
+		if err != nil {
+			l.Logger().Warn("Failed to disconnect", LOG_ERROR, err)
+		}
+	}
+	return nil
+}
+
+func (o *Operator) disconnect(l *Link, reason string) error {
+	l.Logger().Info("Disconnecting link", "reason", reason)
+	l.setDownReason(reason)
+	err := o.ConnectionManager.RemoveLink(l.ReceiverID)
+	if err != nil {
+		return err
+	}
+	return l.Close()
+}
+
+func (o *Operator) adminListLinks(w http.ResponseWriter, r *http.Request) {
+	selector, err := ParseSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	links, err := o.FindLinks(selector)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	infos := []*LinkInfo{}
+	for _, l := range links {
+		infos = append(infos, NewLinkInfo(l))
+	}
+	writeAdminJSON(w, infos)
+}
+
+func (o *Operator) adminGetLink(w http.ResponseWriter, r *http.Request) {
+	l, err := o.ConnectionManager.GetLink(r.PathValue("receiverID"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminJSON(w, NewLinkInfo(l))
+}
+
+func (o *Operator) adminDisconnect(w http.ResponseWriter, r *http.Request) {
+	l, err := o.ConnectionManager.GetLink(r.PathValue("receiverID"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	err = o.disconnect(l, "Disconnected through the admin API")
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeAdminJSON(w, NewLinkInfo(l))
+}
+
+func (o *Operator) adminListChannels(w http.ResponseWriter, r *http.Request) {
+	l, err := o.ConnectionManager.GetLink(r.PathValue("receiverID"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminJSON(w, l.Channels())
+}
+
+// The result of a ping through the admin API
+type PingInfo struct {
+	ReceiverID string        `json:"receiverId"`
+	RTT        time.Duration `json:"rtt"`
+}
+
+func (o *Operator) adminPing(w http.ResponseWriter, r *http.Request) {
+	l, err := o.ConnectionManager.GetLink(r.PathValue("receiverID"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+
+	rtt, err := l.Ping()
+	if err != nil {
+		writeAdminError(w, http.StatusGatewayTimeout, err)
+		return
+	}
+	o.Metrics.HeartbeatRTT(l.ReceiverID, rtt)
+	writeAdminJSON(w, &PingInfo{l.ReceiverID, rtt})
+}
+
+func (o *Operator) adminListServices(w http.ResponseWriter, r *http.Request) {
+	services, err := o.ServiceResolver.ListServices()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeAdminJSON(w, NewServiceInfos(services))
+}
+
+// Returns the services of a ServiceResolver listing, sorted by key
+func NewServiceInfos(services map[string]string) []*ServiceInfo {
+	infos := []*ServiceInfo{}
+	for serviceKey, serviceHost := range services {
+		network, address := SplitServiceAddress(serviceHost)
+		infos = append(infos, &ServiceInfo{serviceKey, network, address})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ServiceKey < infos[j].ServiceKey })
+	return infos
+}
+
+func (o *Operator) adminDeregister(w http.ResponseWriter, r *http.Request) {
+	serviceKey := r.PathValue("serviceKey")
+	_, found, err := o.ServiceResolver.GetService(serviceKey)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	} else if !found {
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("Service not found: %s", serviceKey))
+		return
+	}
+
+	err = o.ServiceResolver.RemoveService(serviceKey)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	o.Logger.Info("Deregistered service", LOG_SERVICE_KEY, serviceKey)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (o *Operator) adminDrain(w http.ResponseWriter, r *http.Request) {
+	err := o.Drain()
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		DefaultLogger.Warn("Failed to write admin response", LOG_ERROR, err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
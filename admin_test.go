@@ -0,0 +1,129 @@
+package operator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends a request to the admin API and decodes its JSON response into v
+func adminTestRequest(t *testing.T, handler http.Handler, method, path string, v interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Content-Type", ADMIN_CONTENT_TYPE)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if v != nil && rec.Code < 300 {
+		Fatalize(t, json.NewDecoder(rec.Body).Decode(v))
+	}
+	return rec.Code
+}
+
+func TestAdminLinks(t *testing.T) {
+	server, device, _ := newTestNetwork(t, "admin")
+	handler := server.AdminHandler()
+
+	infos := []*LinkInfo{}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/links", &infos))
+	if assert.Len(t, infos, 1) {
+		assert.Equal(t, device.ReceiverID, infos[0].ReceiverID)
+	}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/links?selector=site%3Dparis", &infos))
+	assert.Empty(t, infos)
+	assert.Equal(t, http.StatusBadRequest, adminTestRequest(t, handler, "GET", "/links?selector=%3Dparis", nil))
+
+	info := &LinkInfo{}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/links/"+device.ReceiverID, info))
+	assert.Equal(t, device.ReceiverID, info.ReceiverID)
+	assert.Equal(t, http.StatusNotFound, adminTestRequest(t, handler, "GET", "/links/nobody", nil))
+
+	channels := []*ChannelInfo{}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/links/"+device.ReceiverID+"/channels", &channels))
+	assert.Empty(t, channels)
+	assert.Equal(t, http.StatusNotFound, adminTestRequest(t, handler, "GET", "/links/nobody/channels", nil))
+
+	ping := &PingInfo{}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "POST", "/links/"+device.ReceiverID+"/ping", ping))
+	assert.Equal(t, device.ReceiverID, ping.ReceiverID)
+	assert.True(t, ping.RTT > 0)
+	assert.Equal(t, http.StatusNotFound, adminTestRequest(t, handler, "POST", "/links/nobody/ping", nil))
+
+	// The device links again after it got kicked
+	l := waitTestLink(t, server, device.ReceiverID)
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "DELETE", "/links/"+device.ReceiverID, info))
+	assert.Equal(t, "Disconnected through the admin API", l.getDownReason())
+	assert.Equal(t, http.StatusNotFound, adminTestRequest(t, handler, "DELETE", "/links/nobody", nil))
+	waitTestLink(t, server, device.ReceiverID)
+
+	// Draining disconnects the device and refuses it from then on
+	assert.Equal(t, http.StatusNoContent, adminTestRequest(t, handler, "POST", "/drain", nil))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/links", &infos))
+	assert.Empty(t, infos)
+}
+
+func TestAdminServices(t *testing.T) {
+	o := NewOperator("admin-services", "admin-services")
+	Fatalize(t, o.ServiceResolver.SetService("phone.ssh", "localhost:22"))
+	handler := o.AdminHandler()
+
+	infos := []*ServiceInfo{}
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/services", &infos))
+	assert.Equal(t, []*ServiceInfo{{"phone.ssh", NETWORK_TCP, "localhost:22"}}, infos)
+
+	assert.Equal(t, http.StatusNoContent, adminTestRequest(t, handler, "DELETE", "/services/phone.ssh", nil))
+	assert.Equal(t, http.StatusNotFound, adminTestRequest(t, handler, "DELETE", "/services/phone.ssh", nil))
+	assert.Equal(t, http.StatusOK, adminTestRequest(t, handler, "GET", "/services", &infos))
+	assert.Empty(t, infos)
+}
+
+func TestAdminAuth(t *testing.T) {
+	o := NewOperator("admin-auth", "admin-auth")
+	o.AdminAuth = AdminTokenAuth("secret")
+	handler := o.AdminHandler()
+
+	assert.Equal(t, http.StatusUnauthorized, adminTestRequest(t, handler, "POST", "/drain", nil))
+	assert.False(t, o.draining.Load())
+
+	for _, header := range []string{"", "secret", "Bearer wrong", "Bearer secret2"} {
+		req := httptest.NewRequest("GET", "/services", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, header)
+	}
+
+	req := httptest.NewRequest("POST", "/drain", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Content-Type", ADMIN_CONTENT_TYPE)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.True(t, o.draining.Load())
+}
+
+// Web pages cannot drain the operator with a cross-site form or fetch
+func TestAdminSimplePost(t *testing.T) {
+	o := NewOperator("admin-simple", "admin-simple")
+	handler := o.AdminHandler()
+
+	for _, contentType := range []string{"", "text/plain", "application/x-www-form-urlencoded", "multipart/form-data"} {
+		req := httptest.NewRequest("POST", "/drain", nil)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code, contentType)
+	}
+	assert.False(t, o.draining.Load())
+
+	req := httptest.NewRequest("GET", "/services", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, http.StatusNoContent, adminTestRequest(t, handler, "POST", "/drain", nil))
+	assert.True(t, o.draining.Load())
+}
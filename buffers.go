@@ -0,0 +1,51 @@
+package operator
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Capacity of the buffers of the data path, which fit a data frame of
+// MAX_DATAGRAM_SIZE bytes once escaped
+const DATA_BUFFER_SIZE = 96 * 1024
+
+var dataBuffers = sync.Pool{
+	New: func() any { return new([DATA_BUFFER_SIZE]byte) },
+}
+
+// Returns a buffer of that length, out of the pool when it fits
+func getBuffer(n int) []byte {
+	if n > DATA_BUFFER_SIZE {
+		return make([]byte, n)
+	}
+	return dataBuffers.Get().(*[DATA_BUFFER_SIZE]byte)[:n]
+}
+
+// Gives a buffer back to the pool, when it came from it. Nothing can use it
+// afterwards. Buffers that never get back to the pool are simply collected.
+func putBuffer(b []byte) {
+	if cap(b) != DATA_BUFFER_SIZE {
+		return
+	}
+	dataBuffers.Put((*[DATA_BUFFER_SIZE]byte)(b[:DATA_BUFFER_SIZE]))
+}
+
+// Writes the buffers with as few calls as the connection allows, which is a
+// single writev for the network connections under buffering and metering
+func writeBuffers(w io.Writer, bufs net.Buffers) (int64, error) {
+	switch conn := w.(type) {
+	case *coalescingConnection:
+		return conn.writeBuffers(bufs)
+	case *meteredConnection:
+		return writeBuffers(conn.FrameReadWriter, bufs)
+	case *bufferedConnection:
+		return writeBuffers(conn.ReadWriter, bufs)
+	case *meteredReadWriter:
+		n, err := writeBuffers(conn.ReadWriter, bufs)
+		conn.metrics.BytesSent(int(n))
+		return n, err
+	default:
+		return bufs.WriteTo(w)
+	}
+}
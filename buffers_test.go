@@ -0,0 +1,90 @@
+package operator
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+// The most PipeIn reads at once
+const benchmarkChunk = MAX_DATAGRAM_SIZE
+
+// Never ends, and costs nothing to read
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) { return len(p), nil }
+
+// Discards what gets written to it
+type readDiscarder struct{}
+
+func (readDiscarder) Read(p []byte) (int, error)  { return 0, io.EOF }
+func (readDiscarder) Write(p []byte) (int, error) { return len(p), nil }
+
+// Calls done once it got that many bytes
+type countingWriter struct {
+	left int
+	done chan struct{}
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.left -= len(p)
+	if w.left <= 0 && w.done != nil {
+		close(w.done)
+		w.done = nil
+	}
+	return len(p), nil
+}
+
+// Reports the allocations per MB of the benchmark, from the memory stats
+// before it started
+func reportAllocsPerMB(b *testing.B, before *runtime.MemStats, bytes int) {
+	after := runtime.MemStats{}
+	runtime.ReadMemStats(&after)
+	mb := float64(bytes) / (1024 * 1024)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/mb, "allocs/MB")
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/mb, "B/MB")
+}
+
+// Escapes chunks into data frames, as PipeIn does
+func BenchmarkLinkWriter(b *testing.B) {
+	writer := NewLinkWriter(NewBufferedConnection(readDiscarder{}), "receiver", "channel")
+	chunk := make([]byte, benchmarkChunk)
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	b.SetBytes(benchmarkChunk)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		writer.Write(chunk)
+	}
+	b.StopTimer()
+	reportAllocsPerMB(b, &before, b.N*benchmarkChunk)
+}
+
+// Streams a channel from one end of a link to the other: escaping, framing,
+// parsing, unescaping and writing out to the channel connection
+func BenchmarkDataPath(b *testing.B) {
+	local, remote := net.Pipe()
+	sender := NewLink(NewBufferedConnection(local), "receiver")
+	receiver := NewLink(NewBufferedConnection(remote), "sender")
+	o := NewOperator("receiver", "receiver")
+	o.Limits = Limits{} // The channel would fill up before it got scheduled
+	receiver.setOperator(o)
+	defer local.Close()
+	defer remote.Close()
+	go receiver.Maintain()
+
+	total := b.N * benchmarkChunk
+	sink := &countingWriter{total, make(chan struct{})}
+	done := sink.done
+	receiver.CreatePipe("channel", sink)
+
+	before := runtime.MemStats{}
+	runtime.ReadMemStats(&before)
+	b.SetBytes(benchmarkChunk)
+	b.ResetTimer()
+	sender.PipeIn("channel", io.LimitReader(zeroReader{}, int64(total)))
+	<-done
+	b.StopTimer()
+	reportAllocsPerMB(b, &before, total)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
+	"github.com/golang/glog"
+)
+
+var (
+	channels     = flag.Int("channels", 16, "Channels echoing messages at the same time")
+	size         = flag.Int("size", 64, "Bytes per message")
+	duration     = flag.Duration("duration", 10*time.Second, "How long to run for")
+	flushLatency = flag.Duration("flush-latency", operator.DefaultFlushLatency, "How long data frames can wait to be written out with the next ones")
+	compression  = flag.String("compression", operator.COMPRESSION_NONE, "Compression of the echo channels over the link: deflate, or none when empty")
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+// Runs a server and a device linked over loopback tcp, and echoes messages
+// through the device as fast as it can. Reports the throughput, the round
+// trip latencies and how many writes the device made to its link per message.
+func main() {
+	flag.Parse()
+	operator.DefaultLogger = glogger.New()
+
+	// The echo service of the device
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		glog.Fatal(err)
+	}
+	go serveEcho(echo)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		glog.Fatal(err)
+	}
+	server := operator.NewOperator("bench-server", lis.Addr().String())
+	server.FlushLatency = *flushLatency
+	go server.ServeListener(lis)
+
+	// The device, whose writes to its link get counted
+	writes := &atomic.Int64{}
+	device := operator.NewOperator("bench-device", "bench-device")
+	device.FlushLatency = *flushLatency
+	device.LinkTransport = operator.LinkDialer(func(operatorAddr string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", operatorAddr)
+		if err != nil {
+			return nil, err
+		}
+		return &countingConn{conn, writes}, nil
+	})
+	device.ServiceResolver.SetService("echo", echo.Addr().String())
+	if err := device.SetServiceCompression("echo", *compression); err != nil {
+		glog.Fatal(err)
+	}
+	device.Link(server.Address)
+	waitLink(server, device.ReceiverID)
+
+	dialer := operator.NewDialer(nil)
+	conns := make([]net.Conn, *channels)
+	for i := range conns {
+		conns[i], err = dialer.Dial(device.ReceiverID, "echo")
+		if err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	// Echo through every channel until the deadline
+	latencies := make([][]time.Duration, *channels)
+	writes.Store(0)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	wg := sync.WaitGroup{}
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+			defer conn.Close()
+			latencies[i] = echoUntil(conn, deadline)
+		}(i, conn)
+	}
+	wg.Wait()
+	report(latencies, time.Since(start), writes.Load())
+}
+
+// Returns the round trip of every message it echoed
+func echoUntil(conn net.Conn, deadline time.Time) []time.Duration {
+	msg := make([]byte, *size)
+	buf := make([]byte, *size)
+	latencies := []time.Duration{}
+	for time.Now().Before(deadline) {
+		sent := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			glog.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			glog.Fatal(err)
+		}
+		latencies = append(latencies, time.Since(sent))
+	}
+	return latencies
+}
+
+func report(perChannel [][]time.Duration, elapsed time.Duration, writes int64) {
+	latencies := []time.Duration{}
+	for _, l := range perChannel {
+		latencies = append(latencies, l...)
+	}
+	if len(latencies) == 0 {
+		glog.Fatal("No message got echoed")
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+
+	messages := len(latencies)
+	seconds := elapsed.Seconds()
+	fmt.Printf("channels=%d size=%dB flush-latency=%v compression=%q duration=%v\n", *channels, *size, *flushLatency, *compression, elapsed.Round(time.Millisecond))
+	fmt.Printf("messages:   %d (%.0f/s)\n", messages, float64(messages)/seconds)
+	fmt.Printf("throughput: %.2f MB/s each way\n", float64(messages*(*size))/seconds/(1024*1024))
+	fmt.Printf("latency:    p50=%v p90=%v p99=%v max=%v\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[messages-1])
+	fmt.Printf("link:       %d writes by the device (%.2f per message)\n", writes, float64(writes)/float64(messages))
+}
+
+func waitLink(server *operator.Operator, receiverID string) {
+	for i := 0; i < 100; i++ {
+		if _, err := server.ConnectionManager.GetLink(receiverID); err == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	glog.Fatalf("%s did not link", receiverID)
+}
+
+func serveEcho(lis net.Listener) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// Counts its writes
+type countingConn struct {
+	net.Conn
+	writes *atomic.Int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
+	"github.com/golang/glog"
+)
+
+// A list of -L flags, each of the form <local-port>:<receiverID>.<serviceKey>
+type mappings []string
+
+func (m *mappings) String() string     { return strings.Join(*m, ",") }
+func (m *mappings) Set(s string) error { *m = append(*m, s); return nil }
+
+var (
+	forwards     mappings
+	resolverFile = flag.String("resolver", "", "JSON file mapping receiverIDs to operator addresses")
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+	flag.Var(&forwards, "L", "Forwarding of the form <local-port>:<receiverID>.<serviceKey> (repeatable)")
+}
+
+func usage() {
+	fmt.Println("Usage: operator-forward -resolver <resolver.json> -L <local-port>:<receiverID>.<serviceKey> [-L ...]")
+}
+
+func main() {
+	flag.Parse()
+	operator.DefaultLogger = glogger.New()
+	if len(forwards) == 0 || *resolverFile == "" {
+		usage()
+		return
+	}
+
+	resolver, err := operator.LoadOperatorResolver(*resolverFile)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	dialer := operator.NewDialer(resolver)
+
+	wg := sync.WaitGroup{}
+	for _, mapping := range forwards {
+		split := strings.SplitN(mapping, ":", 2)
+		if len(split) != 2 {
+			glog.Fatalf("Wrong format for -L %s. Must be <local-port>:<receiverID>.<serviceKey>", mapping)
+		}
+		receiverID, serviceKey, err := operator.ParseAddress(split[1])
+		if err != nil {
+			glog.Fatal(err)
+		}
+
+		lis, err := net.Listen("tcp", "localhost:"+split[0])
+		if err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Forwarding %s to %s.%s", lis.Addr(), receiverID, serviceKey)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forward(lis, dialer, receiverID, serviceKey)
+		}()
+	}
+	wg.Wait()
+}
+
+func forward(lis net.Listener, dialer *operator.Dialer, receiverID, serviceKey string) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			glog.Errorf("Failed to accept connection on %s: %v", lis.Addr(), err)
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			glog.Infof("Connection from %s to %s.%s", conn.RemoteAddr(), receiverID, serviceKey)
+
+			remote, err := dialer.Dial(receiverID, serviceKey)
+			if err != nil {
+				glog.Warningf("Failed to dial %s.%s for %s: %v", receiverID, serviceKey, conn.RemoteAddr(), err)
+				return
+			}
+			defer remote.Close()
+
+			sent, received := pipe(conn, remote)
+			glog.Infof("Connection from %s to %s.%s closed (sent %d bytes, received %d bytes)",
+				conn.RemoteAddr(), receiverID, serviceKey, sent, received)
+		}()
+	}
+}
+
+// Copies both ways until one side is done and returns the bytes copied each way
+func pipe(local, remote net.Conn) (int64, int64) {
+	var sent, received int64
+	done := make(chan struct{})
+	go func() {
+		received, _ = io.Copy(local, remote)
+		local.Close()
+		close(done)
+	}()
+	sent, _ = io.Copy(remote, local)
+	remote.Close()
+	<-done
+	return sent, received
+}
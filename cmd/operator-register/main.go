@@ -5,26 +5,33 @@ import (
 	"fmt"
 
 	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
 	"github.com/golang/glog"
 )
 
+var (
+	network     = flag.String("network", operator.NETWORK_TCP, "Network of the service: tcp, unix or unixpacket")
+	compression = flag.String("compression", operator.COMPRESSION_NONE, "Compression of the channels to the service over the link: deflate, or none when empty")
+)
+
 func init() {
 	flag.Set("logtostderr", "true")
 }
 
 func usage() {
-	fmt.Println("Usage: operator-register <local-operator> <servicename> <service-addr>")
+	fmt.Println("Usage: operator-register [-network <network>] [-compression <compression>] <local-operator> <servicename> <service-addr>")
 }
 
 func main() {
 	flag.Parse()
+	operator.DefaultLogger = glogger.New()
 	if len(flag.Args()) < 3 {
 		usage()
 		return
 	}
 
 	// Register listener to local operator on localhost:10001
-	err := operator.RegisterService(flag.Args()[0], flag.Args()[1], flag.Args()[2])
+	err := operator.RegisterCompressedService(flag.Args()[0], flag.Args()[1], *network, flag.Args()[2], *compression)
 	if err != nil {
 		glog.Fatal(err)
 	}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
+	"github.com/golang/glog"
+)
+
+var (
+	adminURL     = flag.String("admin", "http://localhost:8081", "URL of the admin API of the operator")
+	adminToken   = flag.String("token", "", "Token of the admin API, if it checks one")
+	operatorAddr = flag.String("operator", "localhost:8080", "Address of the operator, for the commands that go over links")
+	resolverFile = flag.String("resolver", "", "JSON file mapping receiverIDs to operator addresses, instead of -operator")
+	jsonOutput   = flag.Bool("json", false, "Print JSON instead of tables")
+	timeout      = flag.Duration("timeout", 10*time.Second, "Timeout of the requests to the operator")
+)
+
+func init() {
+	flag.Set("logtostderr", "true")
+}
+
+func usage() {
+	fmt.Println("Usage: operatorctl [flags] <command> [args]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  links [selector]             list the linked receivers, like site=paris,model!=v1")
+	fmt.Println("  services [receiver]          list the services of the operator, or of a receiver")
+	fmt.Println("  channels <receiver>          list the channels of a link, with their compression ratio")
+	fmt.Println("  kick <receiver>              disconnect the link of a receiver")
+	fmt.Println("  dial <receiver>.<service>    pipe stdin and stdout to a service, until it is quiet")
+	fmt.Println("                               for the timeout once stdin ends")
+	fmt.Println("  ping <receiver>              measure the round-trip time over a link")
+	fmt.Println("  drain                        refuse new links and disconnect the current ones")
+	fmt.Println()
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	operator.DefaultLogger = glogger.New()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "links":
+		selector := ""
+		if len(args) > 1 {
+			selector = args[1]
+		}
+		err = links(selector)
+	case "services":
+		if len(args) > 1 {
+			err = receiverServices(args[1])
+		} else {
+			err = services()
+		}
+	case "channels":
+		err = withReceiver(args, channels)
+	case "kick":
+		err = withReceiver(args, kick)
+	case "dial":
+		err = withReceiver(args, func(address string) error {
+			return dial(address, os.Stdin, os.Stdout)
+		})
+	case "ping":
+		err = withReceiver(args, ping)
+	case "drain":
+		err = adminRequest("POST", "/drain", nil)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func withReceiver(args []string, command func(string) error) error {
+	if len(args) != 2 {
+		return fmt.Errorf("%s takes exactly one argument", args[0])
+	}
+	return command(args[1])
+}
+
+func links(selector string) error {
+	infos := []*operator.LinkInfo{}
+	err := adminRequest("GET", "/links?selector="+url.QueryEscape(selector), &infos)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RECEIVER\tREMOTE\tCONNECTED\tLAST HEARTBEAT\tCHANNELS\tMETADATA")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\n", info.ReceiverID, info.RemoteAddr,
+			since(info.ConnectedSince), since(info.LastHeartbeat), info.Channels, formatMetadata(info.Metadata))
+	}
+	return w.Flush()
+}
+
+func services() error {
+	infos := []*operator.ServiceInfo{}
+	err := adminRequest("GET", "/services", &infos)
+	if err != nil {
+		return err
+	}
+	return printServices(infos)
+}
+
+// Asks the receiver itself over its link, since its services are registered
+// on the device and not on the operator
+func receiverServices(receiverID string) error {
+	dialer, err := newDialer()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	payload, err := dialer.Call(ctx, receiverID, operator.CALL_LIST_SERVICES, nil)
+	if err != nil {
+		return err
+	}
+
+	infos := []*operator.ServiceInfo{}
+	err = json.Unmarshal(payload, &infos)
+	if err != nil {
+		return fmt.Errorf("Failed to parse services of %s: %v", receiverID, err)
+	}
+	return printServices(infos)
+}
+
+func printServices(infos []*operator.ServiceInfo) error {
+	if *jsonOutput {
+		return printJSON(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tNETWORK\tADDRESS")
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", info.ServiceKey, info.Network, info.Address)
+	}
+	return w.Flush()
+}
+
+func channels(receiverID string) error {
+	infos := []*operator.ChannelInfo{}
+	err := adminRequest("GET", "/links/"+url.PathEscape(receiverID)+"/channels", &infos)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tCOMPRESSION\tBYTES\tLINK BYTES\tRATIO")
+	for _, info := range infos {
+		compression := info.Compression
+		if compression == "" {
+			compression = "none"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.2f\n", info.ChannelID, compression, info.Bytes, info.LinkBytes, info.Ratio)
+	}
+	return w.Flush()
+}
+
+func kick(receiverID string) error {
+	info := &operator.LinkInfo{}
+	err := adminRequest("DELETE", "/links/"+url.PathEscape(receiverID), info)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(info)
+	}
+	fmt.Printf("Disconnected %s (%s)\n", info.ReceiverID, info.RemoteAddr)
+	return nil
+}
+
+func ping(receiverID string) error {
+	info := &operator.PingInfo{}
+	err := adminRequest("POST", "/links/"+url.PathEscape(receiverID)+"/ping", info)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		return printJSON(info)
+	}
+	fmt.Printf("%s: rtt=%v\n", info.ReceiverID, info.RTT)
+	return nil
+}
+
+// Pipes stdin and stdout to the service, like netcat
+func dial(address string, stdin io.Reader, stdout io.Writer) error {
+	receiverID, serviceKey, err := operator.ParseAddress(address)
+	if err != nil {
+		return err
+	}
+	dialer, err := newDialer()
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialer.Dial(receiverID, serviceKey)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// The end of stdin does not reach the service, and the service closing
+	// the channel does not reach us: once stdin is done, the replies are
+	// read until none come for the timeout
+	stdinDone := make(chan struct{})
+	go func() {
+		io.Copy(conn, stdin)
+		close(stdinDone)
+		conn.SetReadDeadline(time.Now().Add(*timeout))
+	}()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if _, err := stdout.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) || err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		select {
+		case <-stdinDone:
+			conn.SetReadDeadline(time.Now().Add(*timeout))
+		default:
+		}
+	}
+}
+
+func newDialer() (*operator.Dialer, error) {
+	if *resolverFile != "" {
+		resolver, err := operator.LoadOperatorResolver(*resolverFile)
+		if err != nil {
+			return nil, err
+		}
+		return operator.NewDialer(resolver), nil
+	}
+	return operator.NewDialer(operator.StaticOperatorResolver(*operatorAddr)), nil
+}
+
+// Sends a request to the admin API and decodes its JSON response into v
+func adminRequest(method, path string, v interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(*adminURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", operator.ADMIN_CONTENT_TYPE)
+	if *adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	glog.V(2).Infof("%s %s", method, req.URL)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body := map[string]string{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body["error"] != "" {
+			return fmt.Errorf("%s", body["error"])
+		}
+		return fmt.Errorf("Admin API returned %s", resp.Status)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func formatMetadata(metadata map[string]string) string {
+	pairs := []string{}
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
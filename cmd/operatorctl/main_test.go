@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/stretchr/testify/assert"
+)
+
+// Like `echo hello | operatorctl dial ctl-device.echo`
+func TestDialStdin(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	server := operator.NewOperator("ctl-server", lis.Addr().String())
+	go server.ServeListener(lis)
+
+	device := operator.NewOperator("ctl-device", "ctl-device")
+	device.Link(server.Address)
+	assert.Eventually(t, func() bool {
+		_, err := server.ConnectionManager.GetLink("ctl-device")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	device.ServiceResolver.SetService("echo", svc.Addr().String())
+
+	*operatorAddr = server.Address
+	*timeout = 200 * time.Millisecond
+	stdout := &bytes.Buffer{}
+	done := make(chan error)
+	go func() { done <- dial("ctl-device.echo", strings.NewReader("hello\n"), stdout) }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+		assert.Equal(t, "hello\n", stdout.String())
+	case <-time.After(5 * time.Second):
+		t.Fatal("Dial did not return")
+	}
+}
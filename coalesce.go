@@ -0,0 +1,160 @@
+package operator
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// How long data frames can wait to be written out along with the next ones,
+// by default. Zero writes them out as soon as the background write gets
+// scheduled, which batches the ones sent until then without adding latency.
+var DefaultFlushLatency time.Duration
+
+// Data frames stop waiting for others once that many bytes are waiting, and
+// senders wait for the write in progress past twice that
+const FLUSH_SIZE = 32 * 1024
+
+// coalescingConnection batches the frames sent through it into fewer writes.
+// Data frames get written out in the background, or after up to the flush
+// latency, along with every frame sent until then. Any other frame flushes
+// right away, and so do raw writes, which come after the frames sent before
+// them. Frames sent during a write go out with the next one.
+type coalescingConnection struct {
+	FrameReadWriter
+	latency time.Duration
+	lock    sync.Mutex
+	cond    *sync.Cond // Signaled when the pending frames get taken
+	pending []byte
+	writing bool // Whether a write is in progress, that takes the pending frames next
+	timer   *time.Timer
+	armed   bool
+	err     error // Of the last write, that the connection does not recover from
+}
+
+func newCoalescingConnection(conn FrameReadWriter, latency time.Duration) *coalescingConnection {
+	c := &coalescingConnection{}
+	c.FrameReadWriter = conn
+	c.latency = latency
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *coalescingConnection) SendFrame(frame Frame) (int, error) {
+	c.lock.Lock()
+	for c.writing && len(c.pending) >= 2*FLUSH_SIZE && c.err == nil {
+		c.cond.Wait()
+	}
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return 0, err
+	}
+
+	if c.pending == nil {
+		c.pending = getBuffer(0)
+	}
+	start := len(c.pending)
+	pending, err := appendFrame(c.pending, frame)
+	c.pending = pending
+	if err != nil {
+		c.lock.Unlock()
+		return 0, err
+	}
+	n := len(pending) - start
+
+	if frame.Header() != HEADER_DATA || len(pending) >= FLUSH_SIZE {
+		_, err = c.flushLocked(nil)
+		return n, err
+	}
+
+	// Data frames get written out in the background, along with the ones
+	// sent until then
+	if c.latency > 0 {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.latency, func() { c.Flush() })
+		} else if !c.armed {
+			c.timer.Reset(c.latency)
+		}
+		c.armed = true
+	} else if !c.writing {
+		c.writing = true
+		go func() {
+			c.lock.Lock()
+			c.writeLocked(nil)
+		}()
+	}
+	c.lock.Unlock()
+	return n, nil
+}
+
+// Writes out the frames waiting to be
+func (c *coalescingConnection) Flush() error {
+	c.lock.Lock()
+	_, err := c.flushLocked(nil)
+	return err
+}
+
+func (c *coalescingConnection) Write(p []byte) (int, error) {
+	n, err := c.writeBuffers(net.Buffers{p})
+	return int(n), err
+}
+
+// Same as Write, in a single vectored write along with the pending frames
+func (c *coalescingConnection) writeBuffers(bufs net.Buffers) (int64, error) {
+	c.lock.Lock()
+	return c.flushLocked(bufs)
+}
+
+// Writes out the pending frames followed by the buffers, then whatever got
+// pending meanwhile. When another write is in progress, the pending frames
+// are left to it and the buffers wait for it. Called with the lock held,
+// which it releases. Returns how much of the buffers got written.
+func (c *coalescingConnection) flushLocked(bufs net.Buffers) (int64, error) {
+	if c.writing && len(bufs) == 0 {
+		err := c.err
+		c.lock.Unlock()
+		return 0, err
+	}
+	for c.writing && c.err == nil {
+		c.cond.Wait()
+	}
+	c.writing = true
+	return c.writeLocked(bufs)
+}
+
+// Same as flushLocked, once the write in progress is this one
+func (c *coalescingConnection) writeLocked(bufs net.Buffers) (int64, error) {
+	written := int64(0)
+	for (len(c.pending) > 0 || len(bufs) > 0) && c.err == nil {
+		data := c.pending
+		c.pending = nil
+		if c.armed {
+			c.timer.Stop()
+			c.armed = false
+		}
+		c.cond.Broadcast()
+		c.lock.Unlock()
+
+		out := bufs
+		if len(data) > 0 {
+			out = append(net.Buffers{data}, bufs...)
+		}
+		n, err := writeBuffers(c.FrameReadWriter, out)
+		if len(bufs) > 0 && n > int64(len(data)) {
+			written = n - int64(len(data))
+		}
+		bufs = nil
+		putBuffer(data)
+
+		c.lock.Lock()
+		if err != nil {
+			c.err = err
+		}
+	}
+	c.writing = false
+	c.cond.Broadcast()
+	err := c.err
+	c.lock.Unlock()
+	return written, err
+}
@@ -0,0 +1,92 @@
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps every write apart
+type recordingWriter struct {
+	readDiscarder
+	lock   sync.Mutex
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes = append(w.writes, append([]byte{}, p...))
+	return len(p), nil
+}
+
+func (w *recordingWriter) get() [][]byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writes
+}
+
+// Reads back the frames of the writes
+func (w *recordingWriter) frames(t *testing.T) []Frame {
+	reader := bufio.NewReader(bytes.NewReader(bytes.Join(w.get(), nil)))
+	frames := []Frame{}
+	for {
+		f, err := getFrame(reader, MAX_FRAME_SIZE)
+		if err == io.EOF {
+			return frames
+		}
+		Fatalize(t, err)
+		frames = append(frames, f)
+	}
+}
+
+func TestCoalescingConnection(t *testing.T) {
+	w := &recordingWriter{}
+	c := newCoalescingConnection(NewBufferedConnection(w), time.Hour)
+
+	// Data frames wait for each other
+	for _, data := range []string{"a", "b", "c"} {
+		_, err := c.SendFrame(&DataFrame{"receiver", "channel", []byte(data)})
+		Fatalize(t, err)
+	}
+	assert.Len(t, w.get(), 0)
+
+	// Control frames take them along right away
+	_, err := c.SendFrame(&HeartbeatFrame{})
+	Fatalize(t, err)
+	assert.Len(t, w.get(), 1)
+	frames := w.frames(t)
+	assert.Len(t, frames, 4)
+	assert.Equal(t, []byte("c"), frames[2].(*DataFrame).data)
+	assert.Equal(t, byte(HEADER_HEARTBEAT), frames[3].Header())
+
+	// Raw writes come after the frames sent before them
+	c.SendFrame(&DataFrame{"receiver", "channel", []byte("d")})
+	c.Write([]byte("raw"))
+	assert.Len(t, w.get(), 3)
+	assert.Equal(t, "raw", string(w.get()[2]))
+}
+
+func TestFlushLatency(t *testing.T) {
+	// Without latency, data frames still get written out in the background
+	w := &recordingWriter{}
+	c := newCoalescingConnection(NewBufferedConnection(w), 0)
+	c.SendFrame(&DataFrame{"receiver", "channel", []byte("a")})
+	assert.Eventually(t, func() bool { return len(w.get()) == 1 }, time.Second, time.Millisecond)
+
+	w = &recordingWriter{}
+	c = newCoalescingConnection(NewBufferedConnection(w), 10*time.Millisecond)
+	c.SendFrame(&DataFrame{"receiver", "channel", []byte("a")})
+	c.SendFrame(&DataFrame{"receiver", "channel", []byte("b")})
+	assert.Eventually(t, func() bool { return len(w.get()) == 1 }, time.Second, time.Millisecond)
+	assert.Len(t, w.frames(t), 2)
+
+	// Past FLUSH_SIZE, data frames do not wait
+	c.SendFrame(&DataFrame{"receiver", "channel", make([]byte, FLUSH_SIZE)})
+	assert.Len(t, w.get(), 2)
+}
@@ -0,0 +1,213 @@
+package operator
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// Compressions a channel can use over its link. Channels are not compressed
+// unless their service was registered with a compression.
+const (
+	COMPRESSION_NONE    = ""
+	COMPRESSION_DEFLATE = "deflate"
+)
+
+// Separates the compressions offered in a tunnel request
+const COMPRESSION_SEPARATOR = "+"
+
+// The compressions this operator handles, offered in its tunnel requests
+var supportedCompressions = []string{COMPRESSION_DEFLATE}
+
+func compressionOffer() string {
+	return strings.Join(supportedCompressions, COMPRESSION_SEPARATOR)
+}
+
+// The capability with the compressions a device handles
+const CAPABILITY_COMPRESSIONS = "compressions"
+
+// What this operator sends in its capabilities frame once linked
+func capabilities() string {
+	return encodeMetadata(map[string]string{CAPABILITY_COMPRESSIONS: compressionOffer()})
+}
+
+// Keeps the compressions that the other end handles, from its capabilities
+func (link *Link) handleCapabilities(f *CapabilitiesFrame) error {
+	capabilities, err := decodeMetadata(f.capabilities)
+	if err != nil {
+		return err
+	}
+	link.Logger().Debug("Got capabilities", "capabilities", f.capabilities)
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	link.compressions = capabilities[CAPABILITY_COMPRESSIONS]
+	return nil
+}
+
+// Returns the compressions that the other end of the link handles. Older
+// versions send no capabilities and handle none.
+func (link *Link) Compressions() []string {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	compressions := []string{}
+	for _, compression := range supportedCompressions {
+		if offersCompression(link.compressions, compression) {
+			compressions = append(compressions, compression)
+		}
+	}
+	return compressions
+}
+
+// The compressions offered in the tunnel requests of the link, which are
+// only those the other end handles: older versions fail to parse the offer
+func (link *Link) compressionOffer() string {
+	return strings.Join(link.Compressions(), COMPRESSION_SEPARATOR)
+}
+
+func checkCompression(compression string) error {
+	if compression == COMPRESSION_NONE || offersCompression(compressionOffer(), compression) {
+		return nil
+	}
+	return fmt.Errorf("Unsupported compression: %s", compression)
+}
+
+// Whether the compression is in the offer of a tunnel request
+func offersCompression(offer, compression string) bool {
+	for _, offered := range strings.Split(offer, COMPRESSION_SEPARATOR) {
+		if offered != "" && offered == compression {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the compression of the channels to that service, which is only used
+// when the other end of the link offers it. COMPRESSION_NONE stops
+// compressing them.
+func (o *Operator) SetServiceCompression(serviceKey, compression string) error {
+	err := checkCompression(compression)
+	if err != nil {
+		return err
+	}
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	if compression == COMPRESSION_NONE {
+		delete(o.compressions, serviceKey)
+		return nil
+	}
+	if o.compressions == nil {
+		o.compressions = map[string]string{}
+	}
+	o.compressions[serviceKey] = compression
+	return nil
+}
+
+func (o *Operator) getServiceCompression(serviceKey string) string {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	return o.compressions[serviceKey]
+}
+
+// Bytes a channel carried, and how many of them went over its link
+type channelStats struct {
+	compression string
+	bytes       atomic.Int64 // Read from and written to the channel connection
+	linkBytes   atomic.Int64 // Of the data frames sent and received for it
+}
+
+func (s *channelStats) add(bytes, linkBytes int) {
+	s.bytes.Add(int64(bytes))
+	s.linkBytes.Add(int64(linkBytes))
+}
+
+// channelEncoder compresses what a channel sends, if it uses compression,
+// into the data frames of its link. Every write gets flushed into its own
+// frame, which the other end decompresses as soon as it gets it.
+type channelEncoder struct {
+	link  io.Writer
+	stats *channelStats
+	flate *flate.Writer
+	buf   bytes.Buffer
+}
+
+func newChannelEncoder(link io.Writer, stats *channelStats) *channelEncoder {
+	e := &channelEncoder{}
+	e.link = link
+	e.stats = stats
+	if stats.compression == COMPRESSION_DEFLATE {
+		// Channels can be many: the fastest level is also the lightest
+		e.flate, _ = flate.NewWriter(&e.buf, flate.BestSpeed)
+	}
+	return e
+}
+
+func (e *channelEncoder) Write(p []byte) (int, error) {
+	if e.flate == nil {
+		n, err := e.link.Write(p)
+		e.stats.add(n, n)
+		return n, err
+	}
+
+	e.buf.Reset()
+	_, err := e.flate.Write(p)
+	if err == nil {
+		err = e.flate.Flush()
+	}
+	if err != nil {
+		return 0, err
+	}
+	_, err = e.link.Write(e.buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	e.stats.add(len(p), e.buf.Len())
+	return len(p), nil
+}
+
+// channelDecoder decompresses the data of a channel into its connection.
+// The decompressor reads past the data it got while waiting for more, so it
+// runs in its own goroutine and gets the data through a pipe.
+type channelDecoder struct {
+	pipe  *io.PipeWriter
+	stats *channelStats
+	done  chan struct{}
+}
+
+func newChannelDecoder(conn io.Writer, stats *channelStats) *channelDecoder {
+	reader, writer := io.Pipe()
+	d := &channelDecoder{writer, stats, make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		_, err := io.Copy(&statsWriter{conn, stats}, flate.NewReader(reader))
+		reader.CloseWithError(err)
+	}()
+	return d
+}
+
+// Returns once the decompressor took the data, or with why it stopped
+func (d *channelDecoder) Write(p []byte) (int, error) {
+	n, err := d.pipe.Write(p)
+	d.stats.add(0, n)
+	return n, err
+}
+
+// Lets the decompressor write out what it has left and stop
+func (d *channelDecoder) finish() {
+	d.pipe.Close()
+	<-d.done
+}
+
+// Counts the decompressed bytes of a channel
+type statsWriter struct {
+	conn  io.Writer
+	stats *channelStats
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.conn.Write(p)
+	w.stats.add(n, 0)
+	return n, err
+}
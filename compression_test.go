@@ -0,0 +1,94 @@
+package operator
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionOfferNeedsCapabilities(t *testing.T) {
+	l, conn := newLimitedLink(Limits{})
+	assert.Empty(t, l.Compressions())
+	l.Tunnel("api", CHANNEL_STREAM)
+
+	Fatalize(t, l.handleFrame(&CapabilitiesFrame{capabilities()}))
+	assert.Equal(t, []string{COMPRESSION_DEFLATE}, l.Compressions())
+	l.Tunnel("api", CHANNEL_STREAM)
+	l.Tunnel("dns", CHANNEL_DATAGRAM)
+
+	// Compressions this operator does not handle are never offered
+	Fatalize(t, l.handleFrame(&CapabilitiesFrame{encodeMetadata(map[string]string{CAPABILITY_COMPRESSIONS: "lz4"})}))
+	assert.Empty(t, l.Compressions())
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if assert.Len(t, conn.sent, 3) {
+		_, _, err := parseLegacyDial(string(conn.sent[0].Content()))
+		assert.NoError(t, err, "sent %s", conn.sent[0].Content())
+		assert.Equal(t, compressionOffer(), conn.sent[1].(*TunnelRequest).compressions)
+		assert.Empty(t, conn.sent[2].(*TunnelRequest).compressions)
+	}
+}
+
+// A device of an older version, which links with the bare link request and
+// only takes tunnel requests of a channelID and a service key
+func TestOldDeviceGetsNoOffer(t *testing.T) {
+	lis := NewPipeListener("old-server")
+	defer lis.Close()
+	server := NewOperator("old-server", "old-server")
+	Fatalize(t, server.SetServiceCompression("api", COMPRESSION_DEFLATE))
+	go server.ServeListener(lis)
+
+	raw, err := lis.Dial(server.Address)
+	Fatalize(t, err)
+	defer raw.Close()
+	device := NewBufferedConnection(raw)
+	_, err = device.SendFrame(&LinkRequest{"old-device", ""})
+	Fatalize(t, err)
+	resp, err := device.GetFrame()
+	Fatalize(t, err)
+	assert.Equal(t, byte(HEADER_LINK_RES), resp.Header())
+
+	dialer := NewDialer(StaticOperatorResolver(server.Address))
+	dialer.Transport = lis
+	go dialer.Dial("old-device", "api")
+
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		f, err := device.GetFrame()
+		Fatalize(t, err)
+		if f.Header() != HEADER_TUNNEL_REQ {
+			continue
+		}
+		channelID, serviceKey, err := parseLegacyDial(string(f.Content()))
+		Fatalize(t, err)
+		assert.NotEmpty(t, channelID)
+		assert.Equal(t, "api", serviceKey)
+		return
+	}
+}
+
+// Fails every write
+type brokenWriter struct{}
+
+func (w brokenWriter) Write(p []byte) (int, error) { return 0, errors.New("Broken") }
+
+func TestChannelEncoderErrors(t *testing.T) {
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_DEFLATE} {
+		stats := &channelStats{compression: compression}
+		e := newChannelEncoder(brokenWriter{}, stats)
+		_, err := e.Write([]byte("hello"))
+		assert.Error(t, err, compression)
+	}
+
+	// A closed compressor fails instead of sending nothing
+	stats := &channelStats{compression: COMPRESSION_DEFLATE}
+	e := newChannelEncoder(brokenWriter{}, stats)
+	e.flate.Close()
+	n, err := e.Write([]byte("hello"))
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, int64(0), stats.linkBytes.Load())
+}
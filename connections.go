@@ -2,45 +2,185 @@ package operator
 
 import (
 	"fmt"
+	"hash/fnv"
 	"sync"
 )
 
+// ConnectionManager stores the links of an operator by receiverID
 type ConnectionManager interface {
+	// Makes the link of that connection, replacing the previous one, and
+	// maintains it until the connection closes
 	SetLink(receiverID string, conn FrameReadWriter) error
 	GetLink(receiverID string) (*Link, error)
 	RemoveLink(receiverID string) error
 }
 
-var DefaultConnectionManager ConnectionManager = newConnectionManager()
+// LinkManager is a ConnectionManager that also takes the links that operators
+// make and maintain themselves, lists them and reports their lifecycle events.
+// Operators use it when their ConnectionManager implements it, like the one
+// of NewConnectionManager does.
+type LinkManager interface {
+	ConnectionManager
+
+	// Stores the link of l.ReceiverID as is, replacing the previous one.
+	// Unlike SetLink, the caller maintains the link.
+	AddLink(l *Link) error
+	ListLinks() ([]*Link, error)
+
+	// The bus of the lifecycle events of the links
+	Events() *EventBus
+}
+
+// Deprecated: NewOperator gives every operator its own connection manager, and
+// operators do not use this one anymore. Assign it to Operator.ConnectionManager
+// to share it between operators like they used to.
+var DefaultConnectionManager ConnectionManager = NewConnectionManager()
+
+// Number of shards of the links, each with its own lock, so that links
+// coming and going do not contend on one lock
+const CONNECTION_SHARDS = 64
 
 type connectionManager struct {
-	Links map[string]*Link
-	lock  sync.Mutex
+	shards [CONNECTION_SHARDS]*linkShard
+	events *EventBus
+}
+
+type linkShard struct {
+	links map[string]*Link
+	lock  sync.RWMutex
+}
+
+func NewConnectionManager() LinkManager {
+	c := &connectionManager{}
+	for i := range c.shards {
+		c.shards[i] = &linkShard{links: map[string]*Link{}}
+	}
+	c.events = NewEventBus()
+	return c
 }
 
-func newConnectionManager() ConnectionManager {
-	return &connectionManager{map[string]*Link{}, sync.Mutex{}}
+func (c *connectionManager) shard(receiverID string) *linkShard {
+	h := fnv.New32a()
+	h.Write([]byte(receiverID))
+	return c.shards[h.Sum32()%CONNECTION_SHARDS]
 }
 
 func (c *connectionManager) SetLink(receiverID string, conn FrameReadWriter) error {
 	l := NewLink(conn, receiverID)
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	c.Links[receiverID] = l
+	err := c.AddLink(l)
+	if err != nil {
+		return err
+	}
 	go l.Maintain()
 	return nil
 }
 
+func (c *connectionManager) AddLink(l *Link) error {
+	shard := c.shard(l.ReceiverID)
+	shard.lock.Lock()
+	replaced, found := shard.links[l.ReceiverID]
+	shard.links[l.ReceiverID] = l
+	shard.lock.Unlock()
+
+	if found {
+		replaced.setDownReason("Replaced by a new link")
+		c.events.Emit(newLinkEvent(EVENT_LINK_DOWN, replaced))
+	}
+	c.events.Emit(newLinkEvent(EVENT_LINK_UP, l))
+	return nil
+}
+
 func (c *connectionManager) GetLink(receiverID string) (*Link, error) {
-	if l, found := c.Links[receiverID]; found {
-		return l, nil
+	shard := c.shard(receiverID)
+	shard.lock.RLock()
+	l, found := shard.links[receiverID]
+	shard.lock.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("Link not found")
 	}
-	return nil, fmt.Errorf("Link not found")
+	return l, nil
 }
 
 func (c *connectionManager) RemoveLink(receiverID string) error {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	delete(c.Links, receiverID)
+	shard := c.shard(receiverID)
+	shard.lock.Lock()
+	l, found := shard.links[receiverID]
+	delete(shard.links, receiverID)
+	shard.lock.Unlock()
+
+	if found {
+		c.events.Emit(newLinkEvent(EVENT_LINK_DOWN, l))
+	}
 	return nil
 }
+
+// Removes the link only if it is still the link of its receiver, and not
+// one that replaced it since
+func (c *connectionManager) removeLinkIfCurrent(l *Link) bool {
+	shard := c.shard(l.ReceiverID)
+	shard.lock.Lock()
+	current, found := shard.links[l.ReceiverID]
+	if found && current == l {
+		delete(shard.links, l.ReceiverID)
+	}
+	shard.lock.Unlock()
+
+	if !found || current != l {
+		return false
+	}
+	c.events.Emit(newLinkEvent(EVENT_LINK_DOWN, l))
+	return true
+}
+
+// Locks one shard at a time, so the list is not a snapshot of all the
+// links at one instant
+func (c *connectionManager) ListLinks() ([]*Link, error) {
+	links := []*Link{}
+	for _, shard := range c.shards {
+		shard.lock.RLock()
+		for _, l := range shard.links {
+			links = append(links, l)
+		}
+		shard.lock.RUnlock()
+	}
+	return links, nil
+}
+
+func (c *connectionManager) Events() *EventBus {
+	return c.events
+}
+
+func newLinkEvent(eventType string, l *Link) *Event {
+	e := &Event{}
+	e.Type = eventType
+	e.ReceiverID = l.ReceiverID
+	e.RemoteAddr = l.RemoteAddr()
+	if eventType == EVENT_LINK_DOWN {
+		e.Reason = l.getDownReason()
+	}
+	return e
+}
+
+// Holds the frames of a link back until its operator bound it, for the
+// connection managers that make and maintain links themselves
+type heldConnection struct {
+	FrameReadWriter
+	bound chan struct{}
+}
+
+func (conn *heldConnection) GetFrame() (Frame, error) {
+	<-conn.bound
+	return conn.FrameReadWriter.GetFrame()
+}
+
+// Removes the link from the connection manager unless another link of the
+// same receiver replaced it
+func removeLink(connections ConnectionManager, l *Link) {
+	if c, ok := connections.(*connectionManager); ok {
+		c.removeLinkIfCurrent(l)
+		return
+	}
+	if current, err := connections.GetLink(l.ReceiverID); err == nil && current == l {
+		connections.RemoveLink(l.ReceiverID)
+	}
+}
@@ -0,0 +1,233 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Never carries frames. The link that maintains it goes away right away.
+type closedConnection struct{}
+
+func (c closedConnection) GetFrame() (Frame, error)       { return nil, io.EOF }
+func (c closedConnection) SendFrame(f Frame) (int, error) { return 0, io.ErrClosedPipe }
+func (c closedConnection) Read(p []byte) (int, error)     { return 0, io.EOF }
+func (c closedConnection) Write(p []byte) (int, error)    { return 0, io.ErrClosedPipe }
+
+// Discards the logs of the default logger. Swaps the default of slog rather
+// than DefaultLogger, which the links of other tests may still be reading.
+func quietLogs(t testing.TB) {
+	logger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(func() { slog.SetDefault(logger) })
+}
+
+func TestConnectionManagerConcurrent(t *testing.T) {
+	quietLogs(t)
+	c := NewConnectionManager()
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				receiverID := "receiver" + strconv.Itoa(i%50)
+				switch (g + i) % 4 {
+				case 0:
+					c.AddLink(NewLink(closedConnection{}, receiverID))
+				case 1:
+					if l, err := c.GetLink(receiverID); err == nil {
+						l.LastHeartbeat()
+					}
+				case 2:
+					c.RemoveLink(receiverID)
+				case 3:
+					c.ListLinks()
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for i := 0; i < 50; i++ {
+		c.AddLink(NewLink(closedConnection{}, "receiver"+strconv.Itoa(i)))
+	}
+	links, err := c.ListLinks()
+	Fatalize(t, err)
+	assert.Len(t, links, 50)
+
+	l, err := c.GetLink("receiver7")
+	Fatalize(t, err)
+	assert.Equal(t, "receiver7", l.ReceiverID)
+
+	// A stale link does not remove the link that replaced it
+	c.AddLink(NewLink(closedConnection{}, "receiver7"))
+	removeLink(c, l)
+	current, err := c.GetLink("receiver7")
+	Fatalize(t, err)
+	assert.NotEqual(t, l, current)
+	removeLink(c, current)
+	_, err = c.GetLink("receiver7")
+	assert.Error(t, err)
+}
+
+// The connection manager before sharding: one lock for all the links
+type mutexConnectionManager struct {
+	links  map[string]*Link
+	lock   sync.RWMutex
+	events *EventBus
+}
+
+func newMutexConnectionManager() *mutexConnectionManager {
+	return &mutexConnectionManager{links: map[string]*Link{}, events: NewEventBus()}
+}
+
+func (c *mutexConnectionManager) SetLink(receiverID string, conn FrameReadWriter) error {
+	l := NewLink(conn, receiverID)
+	c.AddLink(l)
+	go l.Maintain()
+	return nil
+}
+
+func (c *mutexConnectionManager) AddLink(l *Link) error {
+	c.lock.Lock()
+	replaced, found := c.links[l.ReceiverID]
+	c.links[l.ReceiverID] = l
+	c.lock.Unlock()
+	if found {
+		c.events.Emit(newLinkEvent(EVENT_LINK_DOWN, replaced))
+	}
+	c.events.Emit(newLinkEvent(EVENT_LINK_UP, l))
+	return nil
+}
+
+func (c *mutexConnectionManager) GetLink(receiverID string) (*Link, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	l, found := c.links[receiverID]
+	if !found {
+		return nil, fmt.Errorf("Link not found")
+	}
+	return l, nil
+}
+
+func (c *mutexConnectionManager) RemoveLink(receiverID string) error {
+	c.lock.Lock()
+	l, found := c.links[receiverID]
+	delete(c.links, receiverID)
+	c.lock.Unlock()
+	if found {
+		c.events.Emit(newLinkEvent(EVENT_LINK_DOWN, l))
+	}
+	return nil
+}
+
+func (c *mutexConnectionManager) ListLinks() ([]*Link, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	links := []*Link{}
+	for _, l := range c.links {
+		links = append(links, l)
+	}
+	return links, nil
+}
+
+func (c *mutexConnectionManager) Events() *EventBus {
+	return c.events
+}
+
+// A connection manager written against the original interface, which makes
+// and maintains its links itself
+type legacyConnectionManager struct {
+	links *mutexConnectionManager
+}
+
+func (c legacyConnectionManager) SetLink(receiverID string, conn FrameReadWriter) error {
+	return c.links.SetLink(receiverID, conn)
+}
+
+func (c legacyConnectionManager) GetLink(receiverID string) (*Link, error) {
+	return c.links.GetLink(receiverID)
+}
+
+func (c legacyConnectionManager) RemoveLink(receiverID string) error {
+	return c.links.RemoveLink(receiverID)
+}
+
+// Operators still work with connection managers that only implement SetLink
+func TestLegacyConnectionManager(t *testing.T) {
+	lis := NewPipeListener("legacy-server")
+	defer lis.Close()
+	server := NewOperator("legacy-server", "legacy-server")
+	server.ConnectionManager = legacyConnectionManager{newMutexConnectionManager()}
+	go server.ServeListener(lis)
+
+	device := NewOperator("legacy-device", "legacy-device")
+	device.ConnectionManager = legacyConnectionManager{newMutexConnectionManager()}
+	device.LinkTransport = lis
+	device.SetMetadata(map[string]string{"site": "paris"})
+	device.Link(server.Address)
+	l := waitTestLink(t, server, device.ReceiverID)
+	assert.Equal(t, "paris", l.Metadata()["site"])
+	serveTestService(t, device, "echo", echoHandler)
+
+	dialer := NewDialer(StaticOperatorResolver(server.Address))
+	dialer.Transport = lis
+	conn, err := dialer.Dial(device.ReceiverID, "echo")
+	Fatalize(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	Fatalize(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Only a LinkManager lists its links
+	_, err = server.FindLinks(nil)
+	assert.Error(t, err)
+}
+
+// Lookups of a fleet of links while links come and go, with the occasional
+// listing of all of them
+func benchmarkConnectionManagerChurn(b *testing.B, c LinkManager) {
+	quietLogs(b)
+	const fleet = 10000
+	for i := 0; i < fleet; i++ {
+		c.AddLink(NewLink(closedConnection{}, "receiver"+strconv.Itoa(i)))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			receiverID := "receiver" + strconv.Itoa(r.Intn(fleet))
+			switch n := r.Intn(1000); {
+			case n < 1:
+				c.ListLinks()
+			case n < 50:
+				c.AddLink(NewLink(closedConnection{}, receiverID))
+			case n < 100:
+				c.RemoveLink(receiverID)
+			default:
+				c.GetLink(receiverID)
+			}
+		}
+	})
+}
+
+func BenchmarkConnectionManagerChurn(b *testing.B) {
+	benchmarkConnectionManagerChurn(b, NewConnectionManager())
+}
+
+// The same churn on a single lock, to compare the shards with
+func BenchmarkConnectionManagerChurnMutex(b *testing.B) {
+	benchmarkConnectionManagerChurn(b, newMutexConnectionManager())
+}
@@ -0,0 +1,189 @@
+package operator
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Big enough for any udp datagram
+const MAX_DATAGRAM_SIZE = 64 * 1024
+
+// How long a datagram channel can stay unused before it gets closed
+var DatagramIdleTimeout = 2 * time.Minute
+
+// datagramStream carries one message per DataFrame over a frame stream,
+// so that message boundaries survive the tcp connection between the
+// dialer and the operator.
+type datagramStream struct {
+	stream     FrameReadWriter
+	receiverID string
+	channelID  string
+}
+
+func newDatagramStream(stream FrameReadWriter, receiverID, channelID string) *datagramStream {
+	return &datagramStream{stream, receiverID, channelID}
+}
+
+// Reads exactly one message. Like udp, the message is truncated
+// if p is too small to hold it.
+func (s *datagramStream) Read(p []byte) (int, error) {
+	f, err := s.stream.GetFrame()
+	if err != nil {
+		return 0, err
+	}
+	data, ok := f.(*DataFrame)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected frame on datagram channel: %s", f.String())
+	}
+	n := copy(p, data.data)
+	putBuffer(data.data)
+	return n, nil
+}
+
+// Writes p as a single message
+func (s *datagramStream) Write(p []byte) (int, error) {
+	frame := &DataFrame{s.receiverID, s.channelID, p}
+	_, err := s.stream.SendFrame(frame)
+	return len(p), err
+}
+
+// A connection to a datagram channel as returned by Dialer.DialDatagram
+type datagramConn struct {
+	net.Conn
+	datagrams *datagramStream
+}
+
+func (c *datagramConn) Read(p []byte) (int, error)  { return c.datagrams.Read(p) }
+func (c *datagramConn) Write(p []byte) (int, error) { return c.datagrams.Write(p) }
+
+// idleConn closes the underlying connection once it has been
+// idle for longer than the timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{conn, timeout, nil}
+	c.timer = time.AfterFunc(timeout, func() {
+		DefaultLogger.Debug("Closing idle datagram channel", LOG_REMOTE_ADDR, conn.RemoteAddr().String())
+		conn.Close()
+	})
+	return c
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.timer.Reset(c.timeout)
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// How many datagrams of a client get queued while its channel is being dialed
+const UDP_SESSION_QUEUE_SIZE = 64
+
+// Listens for udp datagrams on that port and forwards them to the datagram service
+// serviceKey of receiverID. Every client address gets its own channel, which is closed
+// after idleTimeout without traffic.
+func (d *Dialer) ServeUDP(port int, receiverID, serviceKey string, idleTimeout time.Duration) error {
+	logger := d.logger().With(LOG_RECEIVER_ID, receiverID, LOG_SERVICE_KEY, serviceKey)
+	logger.Info("Serving udp", "port", port)
+	lis, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		logger.Error("Failed to serve udp", LOG_ERROR, err)
+		return err
+	}
+	defer lis.Close()
+	return d.serveUDP(lis, receiverID, serviceKey, idleTimeout)
+}
+
+func (d *Dialer) serveUDP(lis *net.UDPConn, receiverID, serviceKey string, idleTimeout time.Duration) error {
+	logger := d.logger().With(LOG_RECEIVER_ID, receiverID, LOG_SERVICE_KEY, serviceKey)
+	sessions := map[string]chan []byte{}
+	lock := sync.Mutex{}
+	buf := make([]byte, MAX_DATAGRAM_SIZE)
+	for {
+		n, addr, err := lis.ReadFromUDP(buf)
+		if err != nil {
+			logger.Error("Failed to read udp datagram", LOG_ERROR, err)
+			return err
+		}
+
+		// Channels get dialed in the background so that a slow dial
+		// does not hold up the datagrams of the other clients
+		key := addr.String()
+		lock.Lock()
+		session, found := sessions[key]
+		if !found {
+			session = make(chan []byte, UDP_SESSION_QUEUE_SIZE)
+			sessions[key] = session
+		}
+		lock.Unlock()
+
+		if !found {
+			go func(session chan []byte, addr *net.UDPAddr) {
+				d.serveUDPSession(lis, addr, session, receiverID, serviceKey, idleTimeout, logger)
+				lock.Lock()
+				delete(sessions, addr.String())
+				lock.Unlock()
+				logger.Debug("Udp session closed", LOG_REMOTE_ADDR, addr.String())
+			}(session, addr)
+		}
+
+		select {
+		case session <- append([]byte(nil), buf[:n]...):
+		default:
+			logger.Warn("Dropping datagram", LOG_REMOTE_ADDR, key, LOG_ERROR, "udp session queue full")
+		}
+	}
+}
+
+// Dials the channel of one udp client, then forwards its queued datagrams
+// and sends the replies back to it until the channel closes
+func (d *Dialer) serveUDPSession(lis *net.UDPConn, addr *net.UDPAddr, datagrams chan []byte, receiverID, serviceKey string, idleTimeout time.Duration, logger Logger) {
+	conn, err := d.DialDatagram(receiverID, serviceKey)
+	if err != nil {
+		logger.Warn("Dropping datagrams", LOG_REMOTE_ADDR, addr.String(), LOG_ERROR, err)
+		return
+	}
+	session := newIdleConn(conn, idleTimeout)
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		reply := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, err := session.Read(reply)
+			if err != nil {
+				break
+			}
+			lis.WriteToUDP(reply[:n], addr)
+		}
+		session.Close()
+	}()
+
+	for {
+		select {
+		case datagram := <-datagrams:
+			_, err = session.Write(datagram)
+			if err != nil {
+				logger.Warn("Failed to forward datagram", LOG_REMOTE_ADDR, addr.String(), LOG_ERROR, err)
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package operator
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sends one datagram to the udp server and returns its reply
+func udpTestRoundTrip(t *testing.T, client net.Conn, message string) string {
+	_, err := client.Write([]byte(message))
+	Fatalize(t, err)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, MAX_DATAGRAM_SIZE)
+	n, err := client.Read(reply)
+	Fatalize(t, err)
+	return string(reply[:n])
+}
+
+// A client whose channel takes long to dial does not hold up the others
+func TestServeUDPSlowDial(t *testing.T) {
+	_, device, dialer := newTestNetwork(t, "udp")
+
+	svc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer svc.Close()
+	go func() {
+		buf := make([]byte, MAX_DATAGRAM_SIZE)
+		for {
+			n, addr, err := svc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			svc.WriteTo(buf[:n], addr)
+		}
+	}()
+	device.ServiceResolver.SetService("udp-echo", svc.LocalAddr().String())
+
+	// The first dial hangs until released
+	transport := dialer.Transport
+	blocked, release := make(chan struct{}), make(chan struct{})
+	once := sync.Once{}
+	dialer.Transport = LinkDialer(func(addr string) (net.Conn, error) {
+		first := false
+		once.Do(func() { first = true })
+		if first {
+			close(blocked)
+			<-release
+		}
+		return transport.Dial(addr)
+	})
+
+	lis, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	Fatalize(t, err)
+	defer lis.Close()
+	go dialer.serveUDP(lis, device.ReceiverID, "udp-echo", time.Minute)
+
+	slow, err := net.Dial("udp", lis.LocalAddr().String())
+	Fatalize(t, err)
+	defer slow.Close()
+	_, err = slow.Write([]byte("slow"))
+	Fatalize(t, err)
+	<-blocked
+
+	fast, err := net.Dial("udp", lis.LocalAddr().String())
+	Fatalize(t, err)
+	defer fast.Close()
+	assert.Equal(t, "fast", udpTestRoundTrip(t, fast, "fast"))
+
+	// The datagram queued during the dial goes through once it is done
+	close(release)
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, MAX_DATAGRAM_SIZE)
+	n, err := slow.Read(reply)
+	Fatalize(t, err)
+	assert.Equal(t, "slow", string(reply[:n]))
+}
@@ -5,8 +5,6 @@ import (
 	"net"
 	"strings"
 
-	"github.com/golang/glog"
-
 	"context"
 )
 
@@ -24,80 +22,155 @@ type DialerInterface interface {
 
 type Dialer struct {
 	OperatorResolver OperatorResolver
+
+	// Creates the connections to the operators
+	Transport LinkTransport
+
+	Logger Logger
+	Tracer Tracer
 }
 
 func NewDialer(resolver OperatorResolver) *Dialer {
 	if resolver == nil {
 		resolver = DefaultOperatorResolver
 	}
-	d := &Dialer{resolver}
+	d := &Dialer{resolver, DefaultLinkTransport, DefaultLogger, DefaultTracer}
 	return d
 }
 
 func (d *Dialer) Dial(receiverID string, serviceKey string) (net.Conn, error) {
-	glog.V(3).Infof("Operator Dialing: %s.%s", receiverID, serviceKey)
+	conn, _, _, err := d.dial(context.Background(), receiverID, serviceKey, CHANNEL_STREAM)
+	return conn, err
+}
+
+// Dials a datagram service on the receiver. Every Write on the returned connection
+// is delivered as a single udp datagram, and every Read returns a single datagram.
+func (d *Dialer) DialDatagram(receiverID string, serviceKey string) (net.Conn, error) {
+	return d.dialDatagram(context.Background(), receiverID, serviceKey)
+}
+
+func (d *Dialer) dialDatagram(ctx context.Context, receiverID string, serviceKey string) (net.Conn, error) {
+	conn, bufConn, channelID, err := d.dial(ctx, receiverID, serviceKey, CHANNEL_DATAGRAM)
+	if err != nil {
+		return nil, err
+	}
+	return &datagramConn{conn, newDatagramStream(bufConn, receiverID, channelID)}, nil
+}
+
+// Dials the service, tracing each phase of the dial as a child of the span in ctx
+func (d *Dialer) dial(ctx context.Context, receiverID, serviceKey, channelType string) (net.Conn, FrameReadWriter, string, error) {
+	logger := d.logger().With(LOG_RECEIVER_ID, receiverID, LOG_SERVICE_KEY, serviceKey)
+	logger.Debug("Operator dialing", "channelType", channelType)
+	tracer := d.tracer()
+	ctx, dialSpan := tracer.Start(ctx, SPAN_DIAL, LOG_RECEIVER_ID, receiverID, LOG_SERVICE_KEY, serviceKey, "channelType", channelType)
 
 	// Use the OperatorResolver to find the right operator
+	_, span := tracer.Start(ctx, SPAN_RESOLVE)
 	host, err := d.OperatorResolver.ResolveOperator(receiverID)
+	span.End(err)
 	if err != nil {
-		glog.Errorf("OperatorResolver error: %v", err)
-		return nil, err
+		logger.Error("OperatorResolver error", LOG_ERROR, err)
+		dialSpan.End(err)
+		return nil, nil, "", err
 	}
-	glog.V(1).Infof("Resolved receiverID to operator at: %s", host)
+	logger.Debug("Resolved receiverID to operator", "operator", host)
 
 	// Dial the operator
-	conn, err := net.Dial("tcp", host)
+	_, span = tracer.Start(ctx, SPAN_CONNECT, "operator", host)
+	conn, err := d.Transport.Dial(host)
+	span.End(err)
 	if err != nil {
-		glog.Errorf("Failed to dial operator: %v", err)
-		return nil, err
+		logger.Error("Failed to dial operator", LOG_ERROR, err)
+		dialSpan.End(err)
+		return nil, nil, "", err
 	}
 
 	// Upgrade to buffered connection reader
 	bufConn := NewBufferedConnection(conn)
 
-	// Send the request
-	req := &DialRequest{receiverID, serviceKey}
-	_, err = bufConn.SendFrame(req)
+	// Send the request and wait for the tunnel to be set up
+	reqCtx, span := tracer.Start(ctx, SPAN_DIAL_REQUEST)
+	channelID, err := sendDialRequest(bufConn, &DialRequest{receiverID, serviceKey, channelType, tracer.Inject(reqCtx)})
+	span.End(err)
+	dialSpan.End(err)
 	if err != nil {
-		glog.Errorf("Failed to dial operator: %v", err)
-		return nil, err
+		logger.Error("Failed to dial operator", LOG_ERROR, err)
+		conn.Close()
+		return nil, nil, "", err
+	}
+
+	// Done!
+	logger.Debug("Operator dialed", LOG_CHANNEL_ID, channelID)
+	return conn, bufConn, channelID, nil
+}
+
+// Sends the dial request and returns the channelID of the response
+func sendDialRequest(bufConn FrameReadWriter, req *DialRequest) (string, error) {
+	_, err := bufConn.SendFrame(req)
+	if err != nil {
+		return "", err
 	}
 
 	// Read the response frame
 	resp, err := bufConn.GetFrame()
 	if err != nil {
-		glog.Errorf("Failed to dial operator: %v", err)
-		return nil, err
+		return "", err
 	} else if resp.IsError() {
-		glog.Errorf("Failed to dial operator: %s", string(resp.Content()))
-		return nil, fmt.Errorf(string(resp.Content()))
+		return "", fmt.Errorf("%s", string(resp.Content()))
 	}
 
 	// Make sure it gets a good response
 	cast, ok := resp.(*DialResponse)
 	if !ok {
-		return nil, ImpossibleError()
+		return "", ImpossibleError()
 	}
+	return cast.channelID, nil
+}
 
-	// Done!
-	glog.V(3).Infof("Operator dialed. Channel ID: %s", cast.channelID)
-	return conn, nil
+// Returns the tracer of the dialer, which may have been created without NewDialer
+func (d *Dialer) tracer() Tracer {
+	if d.Tracer == nil {
+		return DefaultTracer
+	}
+	return d.Tracer
+}
+
+// Returns the logger of the dialer, which may have been created without NewDialer
+func (d *Dialer) logger() Logger {
+	if d.Logger == nil {
+		return DefaultLogger
+	}
+	return d.Logger
 }
 
 func (dialer *Dialer) DialContext() func(context.Context, string, string) (net.Conn, error) {
-	return func(ctx context.Context, _, address string) (net.Conn, error) {
-		// Remove port number, its meaningless for this dialer
-		portSplit := strings.SplitN(address, ":", 2)
-		if len(portSplit) < 1 {
-			return nil, fmt.Errorf("Address poorly formatted")
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		receiverID, serviceKey, err := ParseAddress(address)
+		if err != nil {
+			return nil, err
 		}
-		address = portSplit[0]
-
-		// Split on the period. Format is <receiverID>.<serviceKey>
-		split := strings.SplitN(address, ".", 2)
-		if len(split) != 2 {
-			return nil, fmt.Errorf("Wrong format for operator dialer. Must be <receiverID>.<serviceKey>")
+		if strings.HasPrefix(network, "udp") {
+			return dialer.dialDatagram(ctx, receiverID, serviceKey)
 		}
-		return dialer.Dial(split[0], split[1])
+		conn, _, _, err := dialer.dial(ctx, receiverID, serviceKey, CHANNEL_STREAM)
+		return conn, err
+	}
+}
+
+// Splits an address of the form <receiverID>.<serviceKey>[:port]
+// into its receiverID and serviceKey
+func ParseAddress(address string) (string, string, error) {
+	// Remove port number, its meaningless for this dialer
+	portSplit := strings.SplitN(address, ":", 2)
+	if len(portSplit) < 1 {
+		return "", "", fmt.Errorf("Address poorly formatted")
+	}
+	address = portSplit[0]
+
+	// Split on the period. Format is <receiverID>.<serviceKey>
+	split := strings.SplitN(address, ".", 2)
+	if len(split) != 2 {
+		return "", "", fmt.Errorf("Wrong format for operator dialer. Must be <receiverID>.<serviceKey>")
 	}
+	return split[0], split[1], nil
 }
@@ -0,0 +1,196 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The types of lifecycle events
+const (
+	EVENT_LINK_UP            = "link_up"
+	EVENT_LINK_DOWN          = "link_down"
+	EVENT_CHANNEL_OPENED     = "channel_opened"
+	EVENT_CHANNEL_CLOSED     = "channel_closed"
+	EVENT_SERVICE_REGISTERED = "service_registered"
+	EVENT_HEARTBEAT_MISSED   = "heartbeat_missed" // No heartbeat for MISSED_HEARTBEATS intervals, or a failed ping
+)
+
+// Something that happened to the links of an operator
+type Event struct {
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	ReceiverID string    `json:"receiverId,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	ChannelID  string    `json:"channelId,omitempty"`
+	ServiceKey string    `json:"serviceKey,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+// Called for every event. Handlers run on the goroutine that emits the
+// event, so they must not block.
+type EventHandlerFunc func(e *Event)
+
+// EventBus hands every event emitted on it to the subscribed handlers, in the
+// order they subscribed. The events emitted by one goroutine reach each handler
+// in the order they were emitted.
+type EventBus struct {
+	handlers []*eventSubscription
+	nextID   int
+	lock     sync.Mutex
+}
+
+type eventSubscription struct {
+	id      int
+	handler EventHandlerFunc
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribes the handler to the events. Returns the function that unsubscribes it.
+func (b *EventBus) Subscribe(handler EventHandlerFunc) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.handlers = append(b.handlers, &eventSubscription{id, handler})
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		for i, sub := range b.handlers {
+			if sub.id == id {
+				b.handlers = append(b.handlers[:i:i], b.handlers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (b *EventBus) Emit(e *Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.lock.Lock()
+	handlers := make([]EventHandlerFunc, 0, len(b.handlers))
+	for _, sub := range b.handlers {
+		handlers = append(handlers, sub.handler)
+	}
+	b.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(e)
+	}
+}
+
+// WebhookSink POSTs the events it handles as JSON to a URL, retrying
+// the failed deliveries. Events are queued so that HandleEvent never blocks,
+// and dropped when the queue is full.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+
+	// Number of deliveries of an event before it is dropped
+	MaxAttempts int
+
+	// Time to wait after the first failed delivery, doubled on every retry
+	RetryInterval time.Duration
+
+	Logger Logger
+
+	queue  chan *Event
+	done   chan struct{}
+	closed bool
+	lock   sync.Mutex
+}
+
+// Creates the sink and starts delivering events in the background, until Close
+func NewWebhookSink(url string) *WebhookSink {
+	s := &WebhookSink{}
+	s.URL = url
+	s.Client = &http.Client{Timeout: 10 * time.Second}
+	s.MaxAttempts = 5
+	s.RetryInterval = time.Second
+	s.Logger = DefaultLogger
+	s.queue = make(chan *Event, 1000)
+	s.done = make(chan struct{})
+	go s.deliverForever()
+	return s
+}
+
+// Queues the event for delivery. Subscribe it with bus.Subscribe(sink.HandleEvent).
+// Events handled after Close are dropped.
+func (s *WebhookSink) HandleEvent(e *Event) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		s.Logger.Debug("Webhook sink closed, dropping event", "type", e.Type, LOG_RECEIVER_ID, e.ReceiverID)
+		return
+	}
+
+	select {
+	case s.queue <- e:
+	default:
+		s.Logger.Warn("Webhook queue full, dropping event", "type", e.Type, LOG_RECEIVER_ID, e.ReceiverID)
+	}
+}
+
+// Stops delivering events once the queued ones are delivered or dropped
+func (s *WebhookSink) Close() {
+	s.lock.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.lock.Unlock()
+	<-s.done
+}
+
+func (s *WebhookSink) deliverForever() {
+	defer close(s.done)
+	for e := range s.queue {
+		s.deliver(e)
+	}
+}
+
+func (s *WebhookSink) deliver(e *Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		s.Logger.Error("Failed to encode event", "type", e.Type, LOG_ERROR, err)
+		return
+	}
+
+	wait := s.RetryInterval
+	for attempt := 1; ; attempt++ {
+		err = s.post(body)
+		if err == nil {
+			return
+		} else if attempt >= s.MaxAttempts {
+			s.Logger.Error("Dropping event after failed deliveries", "type", e.Type, "attempts", attempt, LOG_ERROR, err)
+			return
+		}
+		s.Logger.Warn("Failed to deliver event, retrying", "type", e.Type, "attempt", attempt, LOG_ERROR, err)
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func (s *WebhookSink) post(body []byte) error {
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %s", resp.Status)
+	}
+	return nil
+}
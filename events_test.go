@@ -0,0 +1,141 @@
+package operator
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkEvents(t *testing.T) {
+	lis := NewPipeListener("events-server")
+	defer lis.Close()
+
+	server := NewOperator("events-server", "events-server")
+	events := make(chan *Event, 100)
+	unsubscribe := server.Events().Subscribe(func(e *Event) {
+		if e.ReceiverID == "events-device" {
+			events <- e
+		}
+	})
+	defer unsubscribe()
+	go server.ServeListener(lis)
+
+	device := NewOperator("events-device", "events-device")
+	device.LinkTransport = lis
+	device.Link("events-server")
+
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	device.ServiceResolver.SetService("events-echo", svc.Addr().String())
+
+	next := func() *Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event")
+			return nil
+		}
+	}
+	assert.Equal(t, EVENT_LINK_UP, next().Type)
+
+	dialer := NewDialer(nil)
+	dialer.Transport = lis
+	conn, err := dialer.Dial("events-device", "events-echo")
+	Fatalize(t, err)
+	opened := next()
+	assert.Equal(t, EVENT_CHANNEL_OPENED, opened.Type)
+
+	conn.Close()
+	closed := next()
+	assert.Equal(t, EVENT_CHANNEL_CLOSED, closed.Type)
+	assert.Equal(t, opened.ChannelID, closed.ChannelID)
+
+	l, err := server.ConnectionManager.GetLink("events-device")
+	Fatalize(t, err)
+	Fatalize(t, server.disconnect(l, "Kicked"))
+	down := next()
+	assert.Equal(t, EVENT_LINK_DOWN, down.Type)
+	assert.Equal(t, "Kicked", down.Reason)
+}
+
+func TestWebhookSinkRetries(t *testing.T) {
+	calls := int32(0)
+	received := make(chan *Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		e := &Event{}
+		json.NewDecoder(r.Body).Decode(e)
+		received <- e
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL)
+	sink.RetryInterval = time.Millisecond
+	bus := NewEventBus()
+	bus.Subscribe(sink.HandleEvent)
+	bus.Emit(&Event{Type: EVENT_SERVICE_REGISTERED, ServiceKey: "ssh"})
+	sink.Close()
+
+	e := <-received
+	assert.Equal(t, EVENT_SERVICE_REGISTERED, e.Type)
+	assert.Equal(t, "ssh", e.ServiceKey)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestWebhookSinkEmitAfterClose(t *testing.T) {
+	calls := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer srv.Close()
+
+	sink := NewWebhookSink(srv.URL)
+	bus := NewEventBus()
+	bus.Subscribe(sink.HandleEvent)
+	bus.Emit(&Event{Type: EVENT_LINK_UP})
+	sink.Close()
+	sink.Close()
+
+	// Still subscribed, but the events are dropped
+	bus.Emit(&Event{Type: EVENT_LINK_DOWN})
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestEventBusOrder(t *testing.T) {
+	bus := NewEventBus()
+	calls := []string{}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		unsubscribe := bus.Subscribe(func(e *Event) {
+			calls = append(calls, name+":"+e.Type)
+		})
+		if name == "c" {
+			unsubscribe()
+		}
+	}
+
+	bus.Emit(&Event{Type: EVENT_LINK_UP})
+	bus.Emit(&Event{Type: EVENT_LINK_DOWN})
+	assert.Equal(t, []string{"a:link_up", "b:link_up", "d:link_up", "a:link_down", "b:link_down", "d:link_down"}, calls)
+}
@@ -5,6 +5,7 @@ import (
 	"strconv"
 
 	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
 	"github.com/golang/glog"
 )
 
@@ -14,6 +15,7 @@ func init() {
 
 func main() {
 	flag.Parse()
+	operator.DefaultLogger = glogger.New()
 
 	single()
 }
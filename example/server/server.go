@@ -4,6 +4,7 @@ import (
 	"flag"
 
 	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
 	"github.com/golang/glog"
 )
 
@@ -13,6 +14,7 @@ func init() {
 
 func main() {
 	flag.Parse()
+	operator.DefaultLogger = glogger.New()
 	err := operator.NewOperator("server1", "localhost:10000").Serve(10000)
 	if err != nil {
 		glog.Fatal(err)
@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/apourchet/operator"
+	"github.com/apourchet/operator/glogger"
 	"github.com/golang/glog"
 )
 
@@ -15,6 +16,7 @@ func init() {
 
 func main() {
 	flag.Parse()
+	operator.DefaultLogger = glogger.New()
 	// simple()
 	// single()
 	// many()
@@ -2,11 +2,16 @@ package operator
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/url"
+	"strconv"
 	"strings"
-
-	"github.com/golang/glog"
+	"time"
 )
 
 // The header type will be contained in the first byte
@@ -15,16 +20,39 @@ const (
 	HEADER_ERROR        = 0
 	HEADER_TUNNEL_ERROR = 1
 
-	HEADER_DATA         = '0'
-	HEADER_LINK_REQ     = '1'
-	HEADER_LINK_RES     = '2'
-	HEADER_REGISTER_REQ = '3'
-	HEADER_REGISTER_RES = '4'
-	HEADER_DIAL_REQ     = '5'
-	HEADER_DIAL_RES     = '6'
-	HEADER_TUNNEL_REQ   = '7'
-	HEADER_TUNNEL_RES   = '8'
-	HEADER_HEARTBEAT    = '9'
+	HEADER_DATA          = '0'
+	HEADER_LINK_REQ      = '1'
+	HEADER_LINK_RES      = '2'
+	HEADER_REGISTER_REQ  = '3'
+	HEADER_REGISTER_RES  = '4'
+	HEADER_DIAL_REQ      = '5'
+	HEADER_DIAL_RES      = '6'
+	HEADER_TUNNEL_REQ    = '7'
+	HEADER_TUNNEL_RES    = '8'
+	HEADER_HEARTBEAT     = '9'
+	HEADER_PUBLISH_REQ   = 'a'
+	HEADER_PUBLISH_RES   = 'b'
+	HEADER_MESSAGE       = 'c'
+	HEADER_MESSAGE_ACK   = 'd'
+	HEADER_SUBSCRIBE     = 'e'
+	HEADER_UNSUBSCRIBE   = 'f'
+	HEADER_BROADCAST_REQ = 'g'
+	HEADER_BROADCAST_RES = 'h'
+	HEADER_CALL_REQ      = 'i'
+	HEADER_CALL_RES      = 'j'
+	HEADER_PING          = 'k'
+	HEADER_PONG          = 'l'
+	HEADER_METADATA      = 'm'
+	HEADER_FIND_REQ      = 'n'
+	HEADER_FIND_RES      = 'o'
+	HEADER_CAPABILITIES  = 'p'
+)
+
+// The kind of channel requested by a DialRequest. Stream channels carry
+// a tcp bytestream, datagram channels preserve message boundaries.
+const (
+	CHANNEL_STREAM   = "stream"
+	CHANNEL_DATAGRAM = "datagram"
 )
 
 // Frame interface
@@ -36,6 +64,65 @@ type Frame interface {
 	Parse(string) error
 }
 
+// The longest frame, without its delimiter, that operators send or accept.
+// It fits a DataFrame of MAX_DATAGRAM_SIZE bytes with room to spare.
+const MAX_FRAME_SIZE = 1024 * 1024
+
+// The reasons a frame gets rejected. Parsing errors are one of them or a
+// FrameError that wraps one of them, so check them with errors.Is.
+var (
+	ErrEmptyFrame     = errors.New("Empty frame")
+	ErrFrameTooLong   = errors.New("Frame too long")
+	ErrUnknownHeader  = errors.New("Unknown header")
+	ErrMalformedFrame = errors.New("Malformed frame")
+	ErrBadEscape      = errors.New("Bad escaped content")
+)
+
+// FrameError is the error of a frame that cannot be parsed or sent
+type FrameError struct {
+	Header  byte
+	Content string // Truncated
+	Err     error
+}
+
+func newFrameError(header byte, content string, err error) *FrameError {
+	if len(content) > 64 {
+		content = content[:64] + "..."
+	}
+	return &FrameError{header, content, err}
+}
+
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("%s frame: %v: '%s'", HeaderName(e.Header), e.Err, e.Content)
+}
+
+func (e *FrameError) Unwrap() error { return e.Err }
+
+// The error of a frame whose content does not have the expected fields
+func malformed(f Frame, content string) error {
+	return newFrameError(f.Header(), content, ErrMalformedFrame)
+}
+
+// Checks that every field is escaped content
+func checkEscaped(f Frame, fields ...string) error {
+	for _, field := range fields {
+		_, err := UnescapeContent(field)
+		if err != nil {
+			return newFrameError(f.Header(), field, ErrBadEscape)
+		}
+	}
+	return nil
+}
+
+// Parses a duration in milliseconds, that has to fit a time.Duration
+func parseMillis(field string) (time.Duration, bool) {
+	ms, err := strconv.ParseInt(field, 10, 64)
+	if err != nil || ms < 0 || ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
 type ErrorFrame struct {
 	message string
 }
@@ -48,40 +135,125 @@ type TunnelErrorFrame struct {
 type DataFrame struct {
 	receiverID string
 	channelID  string
-	content    string
+	data       []byte // Unescaped
 }
 
 type LinkRequest struct {
 	receiverID string
+	metadata   string // url-encoded
 }
 type LinkResponse struct {
 	receiverID string
 }
 
 type RegisterRequest struct {
-	serviceHost string
-	serviceKey  string
+	serviceHost    string
+	serviceKey     string
+	serviceNetwork string
+	compression    string
 }
 type RegisterResponse struct{}
 
 type DialRequest struct {
-	receiverID string
-	serviceKey string
+	receiverID   string
+	serviceKey   string
+	channelType  string
+	traceContext string
 }
 type DialResponse struct {
-	channelID string
+	channelID   string
+	compression string // Negotiated over the link, not sent to the dialer
 }
 
 type TunnelRequest struct {
-	channelID  string
-	serviceKey string
+	channelID    string
+	serviceKey   string
+	channelType  string
+	traceContext string
+	compressions string // Offered, separated by COMPRESSION_SEPARATOR
 }
 type TunnelResponse struct {
-	channelID string
+	channelID   string
+	compression string // Picked from the offer
 }
 
 type HeartbeatFrame struct{}
 
+type PublishRequest struct {
+	receiverID string
+	topic      string
+	ttl        time.Duration
+	payload    string
+}
+type PublishResponse struct {
+	messageID string
+}
+
+type MessageFrame struct {
+	messageID string
+	topic     string
+	payload   string
+}
+type MessageAckFrame struct {
+	messageID string
+}
+
+type SubscribeFrame struct {
+	topic string
+}
+type UnsubscribeFrame struct {
+	topic string
+}
+
+type BroadcastRequest struct {
+	messageID string
+	topic     string
+	forward   bool
+	payload   string
+}
+type BroadcastResponse struct {
+	operators int
+	delivered int
+	failed    int
+}
+
+type PingFrame struct {
+	pingID string
+}
+type PongFrame struct {
+	pingID string
+}
+
+type MetadataFrame struct {
+	metadata string // url-encoded
+}
+
+// Sent by devices once linked, with what they handle beyond the frames of
+// older versions, which log it as an unknown frame and carry on
+type CapabilitiesFrame struct {
+	capabilities string // url-encoded
+}
+
+type FindRequest struct {
+	selector string
+}
+type FindResponse struct {
+	receiverIDs []string
+}
+
+type CallRequest struct {
+	receiverID string
+	callID     string
+	method     string
+	timeout    time.Duration
+	payload    string
+}
+type CallResponse struct {
+	callID  string
+	message string // Escaped error message, empty on success
+	payload string
+}
+
 // ErrorFrame
 func (f *ErrorFrame) Header() byte { return HEADER_ERROR }
 func (f *ErrorFrame) Content() []byte {
@@ -104,9 +276,9 @@ func (f *TunnelErrorFrame) String() string { return fmt.Sprintf("%#v", f) }
 func (f *TunnelErrorFrame) IsError() bool  { return true }
 
 func (f *TunnelErrorFrame) Parse(content string) error {
-	split := strings.Split(content, ",")
+	split := strings.SplitN(content, ",", 2)
 	if len(split) != 2 {
-		return fmt.Errorf("TunnelErrorFrame parse error: '%s'", content)
+		return malformed(f, content)
 	}
 	f.channelID = split[0]
 	f.message = split[1]
@@ -116,32 +288,67 @@ func (f *TunnelErrorFrame) Parse(content string) error {
 // DataFrame
 func (f *DataFrame) Header() byte { return HEADER_DATA }
 func (f *DataFrame) Content() []byte {
-	return []byte(f.receiverID + "," + f.channelID + "," + f.content)
+	return f.appendContent(nil)
 }
 func (f *DataFrame) String() string { return fmt.Sprintf("%#v", f) }
 func (f *DataFrame) IsError() bool  { return false }
 
 func (f *DataFrame) Parse(content string) error {
-	split := strings.Split(content, ",")
-	if len(split) != 3 {
-		return fmt.Errorf("DataFrame parse error: '%s'", content)
+	return f.parse([]byte(content))
+}
+
+// Escapes the data straight into the buffer
+func (f *DataFrame) appendContent(dst []byte) []byte {
+	dst = append(dst, f.receiverID...)
+	dst = append(dst, ',')
+	dst = append(dst, f.channelID...)
+	dst = append(dst, ',')
+	return base64.StdEncoding.AppendEncode(dst, f.data)
+}
+
+// Unescapes the data straight into a pooled buffer, see putBuffer
+func (f *DataFrame) parse(content []byte) error {
+	first := bytes.IndexByte(content, ',')
+	last := bytes.LastIndexByte(content, ',')
+	if first < 0 || first == last || bytes.IndexByte(content[first+1:last], ',') >= 0 {
+		return malformed(f, string(content))
 	}
-	f.receiverID = split[0]
-	f.channelID = split[1]
-	f.content = split[2]
+	escaped := content[last+1:]
+	data := getBuffer(base64.StdEncoding.DecodedLen(len(escaped)))
+	n, err := base64.StdEncoding.Decode(data, escaped)
+	if err != nil {
+		putBuffer(data)
+		return newFrameError(f.Header(), string(escaped), ErrBadEscape)
+	}
+	f.receiverID = string(content[:first])
+	f.channelID = string(content[first+1 : last])
+	f.data = data[:n]
 	return nil
 }
 
 // LinkRequest
 func (f *LinkRequest) Header() byte { return HEADER_LINK_REQ }
 func (f *LinkRequest) Content() []byte {
-	return []byte(f.receiverID)
+	if f.metadata == "" {
+		return []byte(f.receiverID)
+	}
+	return []byte(f.receiverID + "," + f.metadata)
 }
 func (f *LinkRequest) String() string { return fmt.Sprintf("%#v", f) }
 func (f *LinkRequest) IsError() bool  { return false }
 
 func (f *LinkRequest) Parse(content string) error {
-	f.receiverID = content
+	split := strings.SplitN(content, ",", 2)
+	if split[0] == "" {
+		return malformed(f, content)
+	}
+	f.receiverID = split[0]
+	if len(split) == 2 {
+		if _, err := url.ParseQuery(split[1]); err != nil {
+			return malformed(f, content)
+		}
+		f.metadata = split[1]
+	}
 	return nil
 }
 
@@ -154,6 +361,9 @@ func (f *LinkResponse) String() string { return fmt.Sprintf("%#v", f) }
 func (f *LinkResponse) IsError() bool  { return false }
 
 func (f *LinkResponse) Parse(content string) error {
+	if content == "" {
+		return malformed(f, content)
+	}
 	f.receiverID = content
 	return nil
 }
@@ -161,18 +371,37 @@ func (f *LinkResponse) Parse(content string) error {
 // RegisterRequest
 func (f *RegisterRequest) Header() byte { return HEADER_REGISTER_REQ }
 func (f *RegisterRequest) Content() []byte {
-	return []byte(f.serviceHost + "," + f.serviceKey)
+	// The host is escaped since socket paths can contain commas
+	content := EscapeContent([]byte(f.serviceHost)) + "," + f.serviceKey + "," + f.serviceNetwork
+	if f.compression != "" {
+		content += "," + f.compression
+	}
+	return []byte(content)
 }
 func (f *RegisterRequest) String() string { return fmt.Sprintf("%#v", f) }
 func (f *RegisterRequest) IsError() bool  { return false }
 
 func (f *RegisterRequest) Parse(content string) error {
 	split := strings.Split(content, ",")
-	if len(split) != 2 {
-		return fmt.Errorf("RegisterRequest parse error: '%s'", content)
+	if len(split) == 2 {
+		// Older registrations only carry a tcp host
+		f.serviceHost = split[0]
+		f.serviceKey = split[1]
+		f.serviceNetwork = NETWORK_TCP
+		return nil
+	} else if len(split) != 3 && len(split) != 4 {
+		return malformed(f, content)
+	}
+	host, err := UnescapeContent(split[0])
+	if err != nil {
+		return newFrameError(f.Header(), content, ErrBadEscape)
 	}
-	f.serviceHost = split[0]
+	f.serviceHost = string(host)
 	f.serviceKey = split[1]
+	f.serviceNetwork = split[2]
+	if len(split) == 4 {
+		f.compression = split[3]
+	}
 	return nil
 }
 
@@ -184,7 +413,7 @@ func (f *RegisterResponse) IsError() bool   { return false }
 
 func (f *RegisterResponse) Parse(content string) error {
 	if content != "" {
-		return fmt.Errorf("RegisterResponse should be empty")
+		return malformed(f, content)
 	}
 	return nil
 }
@@ -192,18 +421,29 @@ func (f *RegisterResponse) Parse(content string) error {
 // DialRequest
 func (f *DialRequest) Header() byte { return HEADER_DIAL_REQ }
 func (f *DialRequest) Content() []byte {
-	return []byte(f.receiverID + "," + f.serviceKey)
+	return []byte(f.receiverID + "," + f.serviceKey + channelFields(f.channelType, f.traceContext))
 }
 func (f *DialRequest) String() string { return fmt.Sprintf("%#v", f) }
 func (f *DialRequest) IsError() bool  { return false }
 
 func (f *DialRequest) Parse(content string) error {
 	split := strings.Split(content, ",")
-	if len(split) != 2 {
-		return fmt.Errorf("DialRequest parse error: '%s'", content)
+	if len(split) < 2 || len(split) > 4 {
+		return malformed(f, content)
 	}
 	f.receiverID = split[0]
 	f.serviceKey = split[1]
+	f.channelType = CHANNEL_STREAM
+	if len(split) >= 3 {
+		f.channelType = split[2]
+	}
+	if len(split) == 4 {
+		traceContext, err := UnescapeContent(split[3])
+		if err != nil {
+			return newFrameError(f.Header(), content, ErrBadEscape)
+		}
+		f.traceContext = string(traceContext)
+	}
 	return nil
 }
 
@@ -223,31 +463,81 @@ func (f *DialResponse) Parse(content string) error {
 // TunnelRequest
 func (f *TunnelRequest) Header() byte { return HEADER_TUNNEL_REQ }
 func (f *TunnelRequest) Content() []byte {
-	return []byte(f.channelID + "," + f.serviceKey)
+	content := f.channelID + "," + f.serviceKey
+	if f.compressions == "" {
+		return []byte(content + channelFields(f.channelType, f.traceContext))
+	}
+	// The trace context field is there, even empty, before the offer
+	return []byte(content + "," + f.channelType + "," + EscapeContent([]byte(f.traceContext)) + "," + f.compressions)
 }
 func (f *TunnelRequest) String() string { return fmt.Sprintf("%#v", f) }
 func (f *TunnelRequest) IsError() bool  { return false }
 
 func (f *TunnelRequest) Parse(content string) error {
 	split := strings.Split(content, ",")
-	if len(split) != 2 {
-		return fmt.Errorf("TunnelRequest parse error: '%s'", content)
+	if len(split) < 2 || len(split) > 5 {
+		return malformed(f, content)
 	}
 	f.channelID = split[0]
 	f.serviceKey = split[1]
+	f.channelType = CHANNEL_STREAM
+	if len(split) >= 3 {
+		f.channelType = split[2]
+	}
+	if len(split) >= 4 {
+		traceContext, err := UnescapeContent(split[3])
+		if err != nil {
+			return newFrameError(f.Header(), content, ErrBadEscape)
+		}
+		f.traceContext = string(traceContext)
+	}
+	if len(split) == 5 {
+		f.compressions = split[4]
+	}
 	return nil
 }
 
+// The channel type is only sent for datagram channels, or before a trace
+// context, so that stream channels keep working with older versions that
+// only take a receiver and a service key
+func channelFields(channelType, traceContext string) string {
+	if traceContext != "" {
+		return "," + channelType + traceField(traceContext)
+	} else if channelType == CHANNEL_STREAM {
+		return ""
+	}
+	return "," + channelType
+}
+
+// The trace context is only sent when there is one, so that operators
+// that do not trace keep talking to older versions
+func traceField(traceContext string) string {
+	if traceContext == "" {
+		return ""
+	}
+	return "," + EscapeContent([]byte(traceContext))
+}
+
 // TunnelResponse
 func (f *TunnelResponse) Header() byte { return HEADER_TUNNEL_RES }
 func (f *TunnelResponse) Content() []byte {
-	return []byte(f.channelID)
+	if f.compression == "" {
+		return []byte(f.channelID)
+	}
+	return []byte(f.channelID + "," + f.compression)
 }
 func (f *TunnelResponse) String() string { return fmt.Sprintf("%#v", f) }
 func (f *TunnelResponse) IsError() bool  { return false }
 
 func (f *TunnelResponse) Parse(content string) error {
-	f.channelID = content
+	split := strings.Split(content, ",")
+	if len(split) > 2 {
+		return malformed(f, content)
+	}
+	f.channelID = split[0]
+	if len(split) == 2 {
+		f.compression = split[1]
+	}
 	return nil
 }
 
@@ -259,7 +549,298 @@ func (f *HeartbeatFrame) IsError() bool   { return false }
 
 func (f *HeartbeatFrame) Parse(content string) error {
 	if content != "" {
-		return fmt.Errorf("Heartbeat should be empty. Instead: '%s'", content)
+		return malformed(f, content)
+	}
+	return nil
+}
+
+// PublishRequest
+func (f *PublishRequest) Header() byte { return HEADER_PUBLISH_REQ }
+func (f *PublishRequest) Content() []byte {
+	ttl := strconv.FormatInt(int64(f.ttl/time.Millisecond), 10)
+	return []byte(f.receiverID + "," + f.topic + "," + ttl + "," + f.payload)
+}
+func (f *PublishRequest) String() string { return fmt.Sprintf("%#v", f) }
+func (f *PublishRequest) IsError() bool  { return false }
+
+func (f *PublishRequest) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 4 {
+		return malformed(f, content)
+	}
+	ttl, ok := parseMillis(split[2])
+	if !ok {
+		return malformed(f, content)
+	} else if err := checkEscaped(f, split[3]); err != nil {
+		return err
+	}
+	f.receiverID = split[0]
+	f.topic = split[1]
+	f.ttl = ttl
+	f.payload = split[3]
+	return nil
+}
+
+// PublishResponse
+func (f *PublishResponse) Header() byte { return HEADER_PUBLISH_RES }
+func (f *PublishResponse) Content() []byte {
+	return []byte(f.messageID)
+}
+func (f *PublishResponse) String() string { return fmt.Sprintf("%#v", f) }
+func (f *PublishResponse) IsError() bool  { return false }
+
+func (f *PublishResponse) Parse(content string) error {
+	f.messageID = content
+	return nil
+}
+
+// MessageFrame
+func (f *MessageFrame) Header() byte { return HEADER_MESSAGE }
+func (f *MessageFrame) Content() []byte {
+	return []byte(f.messageID + "," + f.topic + "," + f.payload)
+}
+func (f *MessageFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *MessageFrame) IsError() bool  { return false }
+
+func (f *MessageFrame) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 3 {
+		return malformed(f, content)
+	} else if err := checkEscaped(f, split[2]); err != nil {
+		return err
+	}
+	f.messageID = split[0]
+	f.topic = split[1]
+	f.payload = split[2]
+	return nil
+}
+
+// MessageAckFrame
+func (f *MessageAckFrame) Header() byte { return HEADER_MESSAGE_ACK }
+func (f *MessageAckFrame) Content() []byte {
+	return []byte(f.messageID)
+}
+func (f *MessageAckFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *MessageAckFrame) IsError() bool  { return false }
+
+func (f *MessageAckFrame) Parse(content string) error {
+	f.messageID = content
+	return nil
+}
+
+// SubscribeFrame
+func (f *SubscribeFrame) Header() byte { return HEADER_SUBSCRIBE }
+func (f *SubscribeFrame) Content() []byte {
+	return []byte(f.topic)
+}
+func (f *SubscribeFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *SubscribeFrame) IsError() bool  { return false }
+
+func (f *SubscribeFrame) Parse(content string) error {
+	f.topic = content
+	return nil
+}
+
+// UnsubscribeFrame
+func (f *UnsubscribeFrame) Header() byte { return HEADER_UNSUBSCRIBE }
+func (f *UnsubscribeFrame) Content() []byte {
+	return []byte(f.topic)
+}
+func (f *UnsubscribeFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *UnsubscribeFrame) IsError() bool  { return false }
+
+func (f *UnsubscribeFrame) Parse(content string) error {
+	f.topic = content
+	return nil
+}
+
+// BroadcastRequest
+func (f *BroadcastRequest) Header() byte { return HEADER_BROADCAST_REQ }
+func (f *BroadcastRequest) Content() []byte {
+	forward := "0"
+	if f.forward {
+		forward = "1"
+	}
+	return []byte(f.messageID + "," + f.topic + "," + forward + "," + f.payload)
+}
+func (f *BroadcastRequest) String() string { return fmt.Sprintf("%#v", f) }
+func (f *BroadcastRequest) IsError() bool  { return false }
+
+func (f *BroadcastRequest) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 4 || (split[2] != "0" && split[2] != "1") {
+		return malformed(f, content)
+	} else if err := checkEscaped(f, split[3]); err != nil {
+		return err
+	}
+	f.messageID = split[0]
+	f.topic = split[1]
+	f.forward = split[2] == "1"
+	f.payload = split[3]
+	return nil
+}
+
+// BroadcastResponse
+func (f *BroadcastResponse) Header() byte { return HEADER_BROADCAST_RES }
+func (f *BroadcastResponse) Content() []byte {
+	return []byte(fmt.Sprintf("%d,%d,%d", f.operators, f.delivered, f.failed))
+}
+func (f *BroadcastResponse) String() string { return fmt.Sprintf("%#v", f) }
+func (f *BroadcastResponse) IsError() bool  { return false }
+
+func (f *BroadcastResponse) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 3 {
+		return malformed(f, content)
+	}
+	counts := make([]int, 3)
+	for i, field := range split {
+		count, err := strconv.Atoi(field)
+		if err != nil {
+			return malformed(f, content)
+		}
+		counts[i] = count
+	}
+	f.operators, f.delivered, f.failed = counts[0], counts[1], counts[2]
+	return nil
+}
+
+// CallRequest
+func (f *CallRequest) Header() byte { return HEADER_CALL_REQ }
+func (f *CallRequest) Content() []byte {
+	timeout := strconv.FormatInt(int64(f.timeout/time.Millisecond), 10)
+	return []byte(f.receiverID + "," + f.callID + "," + f.method + "," + timeout + "," + f.payload)
+}
+func (f *CallRequest) String() string { return fmt.Sprintf("%#v", f) }
+func (f *CallRequest) IsError() bool  { return false }
+
+func (f *CallRequest) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 5 {
+		return malformed(f, content)
+	}
+	timeout, ok := parseMillis(split[3])
+	if !ok {
+		return malformed(f, content)
+	} else if err := checkEscaped(f, split[4]); err != nil {
+		return err
+	}
+	f.receiverID = split[0]
+	f.callID = split[1]
+	f.method = split[2]
+	f.timeout = timeout
+	f.payload = split[4]
+	return nil
+}
+
+// CallResponse
+func (f *CallResponse) Header() byte { return HEADER_CALL_RES }
+func (f *CallResponse) Content() []byte {
+	return []byte(f.callID + "," + f.message + "," + f.payload)
+}
+func (f *CallResponse) String() string { return fmt.Sprintf("%#v", f) }
+func (f *CallResponse) IsError() bool  { return false }
+
+func (f *CallResponse) Parse(content string) error {
+	split := strings.Split(content, ",")
+	if len(split) != 3 {
+		return malformed(f, content)
+	} else if err := checkEscaped(f, split[1], split[2]); err != nil {
+		return err
+	}
+	f.callID = split[0]
+	f.message = split[1]
+	f.payload = split[2]
+	return nil
+}
+
+// PingFrame
+func (f *PingFrame) Header() byte { return HEADER_PING }
+func (f *PingFrame) Content() []byte {
+	return []byte(f.pingID)
+}
+func (f *PingFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *PingFrame) IsError() bool  { return false }
+
+func (f *PingFrame) Parse(content string) error {
+	f.pingID = content
+	return nil
+}
+
+// PongFrame
+func (f *PongFrame) Header() byte { return HEADER_PONG }
+func (f *PongFrame) Content() []byte {
+	return []byte(f.pingID)
+}
+func (f *PongFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *PongFrame) IsError() bool  { return false }
+
+func (f *PongFrame) Parse(content string) error {
+	f.pingID = content
+	return nil
+}
+
+// MetadataFrame
+func (f *MetadataFrame) Header() byte { return HEADER_METADATA }
+func (f *MetadataFrame) Content() []byte {
+	return []byte(f.metadata)
+}
+func (f *MetadataFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *MetadataFrame) IsError() bool  { return false }
+
+func (f *MetadataFrame) Parse(content string) error {
+	if _, err := url.ParseQuery(content); err != nil {
+		return malformed(f, content)
+	}
+	f.metadata = content
+	return nil
+}
+
+// CapabilitiesFrame
+func (f *CapabilitiesFrame) Header() byte { return HEADER_CAPABILITIES }
+func (f *CapabilitiesFrame) Content() []byte {
+	return []byte(f.capabilities)
+}
+func (f *CapabilitiesFrame) String() string { return fmt.Sprintf("%#v", f) }
+func (f *CapabilitiesFrame) IsError() bool  { return false }
+
+func (f *CapabilitiesFrame) Parse(content string) error {
+	if _, err := url.ParseQuery(content); err != nil {
+		return malformed(f, content)
+	}
+	f.capabilities = content
+	return nil
+}
+
+// FindRequest
+func (f *FindRequest) Header() byte { return HEADER_FIND_REQ }
+func (f *FindRequest) Content() []byte {
+	return []byte(EscapeContent([]byte(f.selector)))
+}
+func (f *FindRequest) String() string { return fmt.Sprintf("%#v", f) }
+func (f *FindRequest) IsError() bool  { return false }
+
+func (f *FindRequest) Parse(content string) error {
+	selector, err := UnescapeContent(content)
+	if err != nil {
+		return newFrameError(f.Header(), content, ErrBadEscape)
+	}
+	f.selector = string(selector)
+	return nil
+}
+
+// FindResponse
+func (f *FindResponse) Header() byte { return HEADER_FIND_RES }
+func (f *FindResponse) Content() []byte {
+	return []byte(strings.Join(f.receiverIDs, ","))
+}
+func (f *FindResponse) String() string { return fmt.Sprintf("%#v", f) }
+func (f *FindResponse) IsError() bool  { return false }
+
+func (f *FindResponse) Parse(content string) error {
+	f.receiverIDs = []string{}
+	if content != "" {
+		f.receiverIDs = strings.Split(content, ",")
 	}
 	return nil
 }
@@ -268,62 +849,167 @@ const (
 	FRAME_DELIMITER = '\n'
 )
 
+// Frames that append their content to a buffer instead of allocating it
+type contentAppender interface {
+	appendContent(dst []byte) []byte
+}
+
 func sendFrame(conn io.Writer, frame Frame) (int, error) {
 	// glog.V(3).Infof("Sending frame: %s", frame.String())
-	data := append([]byte{frame.Header()}, frame.Content()...)
-	data = append(data, FRAME_DELIMITER)
+	data, err := appendFrame(getBuffer(0), frame)
+	defer putBuffer(data)
+	if err != nil {
+		return 0, err
+	}
 	// glog.V(3).Infof("Sending through conn: %v", data)
 	return conn.Write(data)
 }
 
-func getFrame(reader *bufio.Reader) (Frame, error) {
-	// Read the content that ends with a newline character
-	content, err := reader.ReadString(FRAME_DELIMITER)
+// Appends the frame and its delimiter to the buffer. The buffer is left as
+// it was when the frame cannot be sent.
+func appendFrame(dst []byte, frame Frame) ([]byte, error) {
+	start := len(dst)
+	dst = append(dst, frame.Header())
+	if appender, ok := frame.(contentAppender); ok {
+		dst = appender.appendContent(dst)
+	} else {
+		dst = append(dst, frame.Content()...)
+	}
+
+	content := dst[start+1:]
+	if len(content) > MAX_FRAME_SIZE {
+		return dst[:start], newFrameError(frame.Header(), string(content), ErrFrameTooLong)
+	} else if bytes.IndexByte(content, FRAME_DELIMITER) >= 0 {
+		return dst[:start], newFrameError(frame.Header(), string(content), ErrMalformedFrame)
+	}
+	return append(dst, FRAME_DELIMITER), nil
+}
+
+// Reads the next frame. Malformed frames return a FrameError, after which
+// the next frame can still be read.
+func getFrame(reader *bufio.Reader, maxFrameSize int) (Frame, error) {
+	line, pooled, err := readFrameLine(reader, maxFrameSize)
+	if pooled {
+		defer putBuffer(line)
+	}
 	if err != nil {
 		return nil, err
+	} else if len(line) == 0 {
+		return nil, ErrEmptyFrame
+	}
+	h := line[0]
+	if h == HEADER_DATA {
+		// Data frames never get copied to a string
+		f := &DataFrame{}
+		return f, f.parse(line[1:])
+	}
+	content := string(line[1:])
+
+	f := newFrame(h)
+	if f == nil {
+		return nil, newFrameError(h, content, ErrUnknownHeader)
 	}
-	h := content[0]
-	content = content[1 : len(content)-1]
+	return f, f.Parse(content)
+}
+
+// Reads the line of a frame, without its delimiter. A line longer than
+// maxFrameSize is skipped entirely, and returns ErrFrameTooLong. The line is
+// only valid until the next read. When pooled, it is a buffer of the pool,
+// which the caller gives back once done with it.
+func readFrameLine(reader *bufio.Reader, maxFrameSize int) ([]byte, bool, error) {
+	chunk, err := reader.ReadSlice(FRAME_DELIMITER)
+	if err == nil && len(chunk) <= maxFrameSize+2 {
+		// The whole line was in the reader already
+		return chunk[:len(chunk)-1], false, nil
+	} else if err != nil && err != bufio.ErrBufferFull {
+		return nil, false, err
+	}
+
+	header := chunk[0]
+	line := getBuffer(0)
+	tooLong := false
+	for {
+		// The line holds the header and the delimiter on top of the content
+		if !tooLong && len(line)+len(chunk) > maxFrameSize+2 {
+			tooLong = true
+		} else if !tooLong {
+			line = append(line, chunk...)
+		}
+
+		if err == bufio.ErrBufferFull {
+			chunk, err = reader.ReadSlice(FRAME_DELIMITER)
+			continue
+		}
+		if err != nil {
+			putBuffer(line)
+			return nil, false, err
+		} else if tooLong {
+			putBuffer(line)
+			return nil, false, newFrameError(header, "", ErrFrameTooLong)
+		}
+		return line[:len(line)-1], true, nil
+	}
+}
 
+// Returns an empty frame of that header, or nil when the header is unknown
+func newFrame(h byte) Frame {
 	switch h {
 	case HEADER_ERROR:
-		f := &ErrorFrame{}
-		return f, f.Parse(content)
+		return &ErrorFrame{}
 	case HEADER_TUNNEL_ERROR:
-		f := &TunnelErrorFrame{}
-		return f, f.Parse(content)
+		return &TunnelErrorFrame{}
 	case HEADER_DATA:
-		f := &DataFrame{}
-		return f, f.Parse(content)
+		return &DataFrame{}
 	case HEADER_LINK_REQ:
-		f := &LinkRequest{}
-		return f, f.Parse(content)
+		return &LinkRequest{}
 	case HEADER_LINK_RES:
-		f := &LinkResponse{}
-		return f, f.Parse(content)
+		return &LinkResponse{}
 	case HEADER_REGISTER_REQ:
-		f := &RegisterRequest{}
-		return f, f.Parse(content)
+		return &RegisterRequest{}
 	case HEADER_REGISTER_RES:
-		f := &RegisterResponse{}
-		return f, f.Parse(content)
+		return &RegisterResponse{}
 	case HEADER_DIAL_REQ:
-		f := &DialRequest{}
-		return f, f.Parse(content)
+		return &DialRequest{}
 	case HEADER_DIAL_RES:
-		f := &DialResponse{}
-		return f, f.Parse(content)
+		return &DialResponse{}
 	case HEADER_TUNNEL_REQ:
-		f := &TunnelRequest{}
-		return f, f.Parse(content)
+		return &TunnelRequest{}
 	case HEADER_TUNNEL_RES:
-		f := &TunnelResponse{}
-		return f, f.Parse(content)
+		return &TunnelResponse{}
 	case HEADER_HEARTBEAT:
-		f := &HeartbeatFrame{}
-		return f, f.Parse(content)
+		return &HeartbeatFrame{}
+	case HEADER_PUBLISH_REQ:
+		return &PublishRequest{}
+	case HEADER_PUBLISH_RES:
+		return &PublishResponse{}
+	case HEADER_MESSAGE:
+		return &MessageFrame{}
+	case HEADER_MESSAGE_ACK:
+		return &MessageAckFrame{}
+	case HEADER_SUBSCRIBE:
+		return &SubscribeFrame{}
+	case HEADER_UNSUBSCRIBE:
+		return &UnsubscribeFrame{}
+	case HEADER_BROADCAST_REQ:
+		return &BroadcastRequest{}
+	case HEADER_BROADCAST_RES:
+		return &BroadcastResponse{}
+	case HEADER_CALL_REQ:
+		return &CallRequest{}
+	case HEADER_CALL_RES:
+		return &CallResponse{}
+	case HEADER_PING:
+		return &PingFrame{}
+	case HEADER_PONG:
+		return &PongFrame{}
+	case HEADER_METADATA:
+		return &MetadataFrame{}
+	case HEADER_FIND_REQ:
+		return &FindRequest{}
+	case HEADER_FIND_RES:
+		return &FindResponse{}
+	case HEADER_CAPABILITIES:
+		return &CapabilitiesFrame{}
 	}
-
-	glog.Errorf("Unrecognized header: %x => %s", h, content)
-	return nil, fmt.Errorf("Unrecognized header: %x", h)
+	return nil
 }
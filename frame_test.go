@@ -3,8 +3,13 @@ package operator
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"runtime/debug"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,7 +29,7 @@ func TestOne(t *testing.T) {
 	Fatalize(t, err)
 	assert.NotEqual(t, 0, n)
 
-	frame1, err := getFrame(bufio.NewReader(buf))
+	frame1, err := getFrame(bufio.NewReader(buf), MAX_FRAME_SIZE)
 	Fatalize(t, err)
 	assert.Equal(t, frame, frame1)
 }
@@ -46,12 +51,251 @@ func TestTwo(t *testing.T) {
 	assert.NotEqual(t, 0, n)
 
 	// Get 1st frame
-	frame1, err := getFrame(reader)
+	frame1, err := getFrame(reader, MAX_FRAME_SIZE)
 	Fatalize(t, err)
 	assert.Equal(t, frame, frame1)
 
 	// Get 2nd frame
-	frame1, err = getFrame(reader)
+	frame1, err = getFrame(reader, MAX_FRAME_SIZE)
 	Fatalize(t, err)
 	assert.Equal(t, frame, frame1)
 }
+
+func TestMalformedFrames(t *testing.T) {
+	cases := map[string]error{
+		"\n":                         ErrEmptyFrame,
+		"z\n":                        ErrUnknownHeader,
+		"0r,c\n":                     ErrMalformedFrame,
+		"0r,c,%%%\n":                 ErrBadEscape,
+		"9beat\n":                    ErrMalformedFrame,
+		"ar,topic,-1,\n":             ErrMalformedFrame,
+		"ar,topic,99999999999999,\n": ErrMalformedFrame,
+		"h1,2\n":                     ErrMalformedFrame,
+		"1\n":                        ErrMalformedFrame,
+		"1r,%zz\n":                   ErrMalformedFrame,
+	}
+	for line, expected := range cases {
+		_, err := getFrame(bufio.NewReader(strings.NewReader(line)), MAX_FRAME_SIZE)
+		assert.True(t, errors.Is(err, expected), "%q: %v", line, err)
+	}
+}
+
+// Parses the content the way operators did before channel types and traces,
+// which only took a receiver or channel and a service key
+func parseLegacyDial(content string) (string, string, error) {
+	split := strings.Split(content, ",")
+	if len(split) != 2 {
+		return "", "", fmt.Errorf("Legacy parse error: '%s'", content)
+	}
+	return split[0], split[1], nil
+}
+
+func TestStreamFramesCompatible(t *testing.T) {
+	// Older peers take stream dials and tunnels as they are sent now
+	for _, frame := range []Frame{
+		&DialRequest{"phone", "ssh", CHANNEL_STREAM, ""},
+		&TunnelRequest{"chan", "ssh", CHANNEL_STREAM, "", ""},
+	} {
+		id, key, err := parseLegacyDial(string(frame.Content()))
+		Fatalize(t, err)
+		assert.NotEmpty(t, id)
+		assert.Equal(t, "ssh", key)
+	}
+
+	// And they are parsed as stream channels from older peers
+	dial := &DialRequest{}
+	Fatalize(t, dial.Parse("phone,ssh"))
+	assert.Equal(t, &DialRequest{"phone", "ssh", CHANNEL_STREAM, ""}, dial)
+	tunnel := &TunnelRequest{}
+	Fatalize(t, tunnel.Parse("chan,ssh"))
+	assert.Equal(t, &TunnelRequest{"chan", "ssh", CHANNEL_STREAM, "", ""}, tunnel)
+
+	// Datagrams and traces need the channel type
+	assert.Equal(t, "phone,dns,datagram", string((&DialRequest{"phone", "dns", CHANNEL_DATAGRAM, ""}).Content()))
+	assert.Equal(t, "phone,ssh,stream,dA==", string((&DialRequest{"phone", "ssh", CHANNEL_STREAM, "t"}).Content()))
+}
+
+func TestFrameTooLong(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	buf.WriteString("0r,c,")
+	buf.Write(bytes.Repeat([]byte("A"), MAX_FRAME_SIZE))
+	buf.WriteByte(FRAME_DELIMITER)
+	sendFrame(buf, &HeartbeatFrame{})
+
+	// The long frame gets skipped, the next one still gets read
+	reader := bufio.NewReader(buf)
+	_, err := getFrame(reader, MAX_FRAME_SIZE)
+	assert.True(t, errors.Is(err, ErrFrameTooLong), "%v", err)
+	f, err := getFrame(reader, MAX_FRAME_SIZE)
+	Fatalize(t, err)
+	assert.Equal(t, &HeartbeatFrame{}, f)
+
+	_, err = sendFrame(buf, &ErrorFrame{strings.Repeat("A", MAX_FRAME_SIZE+1)})
+	assert.True(t, errors.Is(err, ErrFrameTooLong), "%v", err)
+	_, err = sendFrame(buf, &ErrorFrame{"two\nlines"})
+	assert.True(t, errors.Is(err, ErrMalformedFrame), "%v", err)
+}
+
+// The header of a frame that gets too long is the one of its first chunk
+func TestFrameTooLongHeader(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	buf.WriteByte(HEADER_ERROR)
+	buf.Write(bytes.Repeat([]byte("A"), 4*4096))
+	buf.WriteByte(FRAME_DELIMITER)
+
+	_, err := getFrame(bufio.NewReaderSize(buf, 4096), 3*4096)
+	frameErr := &FrameError{}
+	if assert.True(t, errors.As(err, &frameErr), "%v", err) {
+		assert.Equal(t, byte(HEADER_ERROR), frameErr.Header)
+		assert.True(t, errors.Is(err, ErrFrameTooLong), "%v", err)
+	}
+}
+
+// Checks that the error is one of the parsing errors
+func checkFrameError(t *testing.T, err error) {
+	for _, expected := range []error{ErrEmptyFrame, ErrFrameTooLong, ErrUnknownHeader, ErrMalformedFrame, ErrBadEscape} {
+		if errors.Is(err, expected) {
+			return
+		}
+	}
+	t.Fatalf("Unexpected error: %v", err)
+}
+
+// Parses the content as a frame of that header. Whatever it parses has to
+// give the same frame once sent again.
+func fuzzParse(f *testing.F, header byte, seeds ...string) {
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, content string) {
+		if strings.IndexByte(content, FRAME_DELIMITER) >= 0 {
+			return
+		}
+		frame := newFrame(header)
+		err := frame.Parse(content)
+		if err != nil {
+			checkFrameError(t, err)
+			return
+		}
+
+		again := newFrame(header)
+		Fatalize(t, again.Parse(string(frame.Content())))
+		assert.Equal(t, frame, again)
+	})
+}
+
+func FuzzErrorFrame(f *testing.F)       { fuzzParse(f, HEADER_ERROR, "Link not found") }
+func FuzzTunnelErrorFrame(f *testing.F) { fuzzParse(f, HEADER_TUNNEL_ERROR, "chan,Service not found") }
+func FuzzDataFrame(f *testing.F)        { fuzzParse(f, HEADER_DATA, "phone,chan,aGVsbG8=") }
+func FuzzLinkRequest(f *testing.F)      { fuzzParse(f, HEADER_LINK_REQ, "phone", "phone,site=paris") }
+func FuzzLinkResponse(f *testing.F)     { fuzzParse(f, HEADER_LINK_RES, "server") }
+func FuzzRegisterRequest(f *testing.F) {
+	fuzzParse(f, HEADER_REGISTER_REQ, "localhost:22,ssh", "L3J1bi9zc2guc29jaw==,ssh,unix", "localhost:80,web,tcp,deflate")
+}
+func FuzzRegisterResponse(f *testing.F) { fuzzParse(f, HEADER_REGISTER_RES, "") }
+func FuzzDialRequest(f *testing.F) {
+	fuzzParse(f, HEADER_DIAL_REQ, "phone,ssh", "phone,ssh,datagram", "phone,ssh,stream,MDAtYWJj")
+}
+func FuzzDialResponse(f *testing.F) { fuzzParse(f, HEADER_DIAL_RES, "chan") }
+func FuzzTunnelRequest(f *testing.F) {
+	fuzzParse(f, HEADER_TUNNEL_REQ, "chan,ssh", "chan,ssh,stream,MDAtYWJj", "chan,web,stream,,deflate")
+}
+func FuzzTunnelResponse(f *testing.F) { fuzzParse(f, HEADER_TUNNEL_RES, "chan", "chan,deflate") }
+func FuzzHeartbeatFrame(f *testing.F) { fuzzParse(f, HEADER_HEARTBEAT, "") }
+func FuzzPublishRequest(f *testing.F) {
+	fuzzParse(f, HEADER_PUBLISH_REQ, "phone,updates,60000,aGVsbG8=")
+}
+func FuzzPublishResponse(f *testing.F) { fuzzParse(f, HEADER_PUBLISH_RES, "msg") }
+func FuzzMessageFrame(f *testing.F)    { fuzzParse(f, HEADER_MESSAGE, "msg,updates,aGVsbG8=") }
+func FuzzMessageAckFrame(f *testing.F) { fuzzParse(f, HEADER_MESSAGE_ACK, "msg") }
+func FuzzSubscribeFrame(f *testing.F)  { fuzzParse(f, HEADER_SUBSCRIBE, "updates") }
+func FuzzUnsubscribeFrame(f *testing.F) {
+	fuzzParse(f, HEADER_UNSUBSCRIBE, "updates")
+}
+func FuzzBroadcastRequest(f *testing.F)  { fuzzParse(f, HEADER_BROADCAST_REQ, "msg,updates,1,aGVsbG8=") }
+func FuzzBroadcastResponse(f *testing.F) { fuzzParse(f, HEADER_BROADCAST_RES, "3,10,1") }
+func FuzzCallRequest(f *testing.F)       { fuzzParse(f, HEADER_CALL_REQ, "phone,call,reboot,30000,aGVsbG8=") }
+func FuzzCallResponse(f *testing.F)      { fuzzParse(f, HEADER_CALL_RES, "call,,aGVsbG8=", "call,ZXJy,") }
+func FuzzPingFrame(f *testing.F)         { fuzzParse(f, HEADER_PING, "ping") }
+func FuzzPongFrame(f *testing.F)         { fuzzParse(f, HEADER_PONG, "ping") }
+func FuzzMetadataFrame(f *testing.F)     { fuzzParse(f, HEADER_METADATA, "model=v2&site=paris") }
+func FuzzFindRequest(f *testing.F)       { fuzzParse(f, HEADER_FIND_REQ, "c2l0ZT1wYXJpcw==") }
+func FuzzFindResponse(f *testing.F)      { fuzzParse(f, HEADER_FIND_RES, "", "phone1,phone2") }
+func FuzzCapabilitiesFrame(f *testing.F) {
+	fuzzParse(f, HEADER_CAPABILITIES, "", "compressions=deflate")
+}
+
+// Reads frames out of any bytes, which must never panic
+func FuzzGetFrame(f *testing.F) {
+	f.Add([]byte("0phone,chan,aGVsbG8=\n9\n"))
+	f.Add([]byte("\n\x00\n1phone,site=paris\nz\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			_, err := getFrame(reader, MAX_FRAME_SIZE)
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				checkFrameError(t, err)
+			}
+		}
+	})
+}
+
+// Sends every frame type built out of the inputs, and reads them back
+func FuzzRoundTrip(f *testing.F) {
+	f.Add("phone", "ssh", []byte("hello"), int64(60000), true)
+	f.Add("", "", []byte{}, int64(0), false)
+	f.Fuzz(func(t *testing.T, id, key string, payload []byte, n int64, flag bool) {
+		// Only payloads get escaped, IDs and keys cannot hold the separators
+		strip := strings.NewReplacer(",", "", "\n", "")
+		id, key = strip.Replace(id), strip.Replace(key)
+		text := strings.ReplaceAll(string(payload), "\n", "")
+		escaped := EscapeContent(payload)
+		millis := time.Duration(uint64(n)%1e12) * time.Millisecond
+		metadata := encodeMetadata(map[string]string{key: string(payload)})
+
+		frames := []Frame{
+			&ErrorFrame{text},
+			&TunnelErrorFrame{id, text},
+			&DataFrame{id, key, payload},
+			&LinkRequest{"r" + id, metadata},
+			&LinkResponse{"r" + id},
+			&RegisterRequest{string(payload), key, NETWORK_UNIX, COMPRESSION_DEFLATE},
+			&RegisterResponse{},
+			&DialRequest{id, key, CHANNEL_DATAGRAM, string(payload)},
+			&DialResponse{channelID: id},
+			&TunnelRequest{id, key, CHANNEL_STREAM, string(payload), compressionOffer()},
+			&TunnelResponse{id, COMPRESSION_DEFLATE},
+			&HeartbeatFrame{},
+			&PublishRequest{id, key, millis, escaped},
+			&PublishResponse{id},
+			&MessageFrame{id, key, escaped},
+			&MessageAckFrame{id},
+			&SubscribeFrame{key},
+			&UnsubscribeFrame{key},
+			&BroadcastRequest{id, key, flag, escaped},
+			&BroadcastResponse{int(n), int(n / 2), int(n / 3)},
+			&CallRequest{id, key, id, millis, escaped},
+			&CallResponse{id, EscapeContent([]byte(text)), escaped},
+			&PingFrame{id},
+			&PongFrame{id},
+			&MetadataFrame{metadata},
+			&CapabilitiesFrame{metadata},
+			&FindRequest{string(payload)},
+			&FindResponse{[]string{id, key}},
+		}
+
+		buf := bytes.NewBuffer([]byte{})
+		for _, frame := range frames {
+			_, err := sendFrame(buf, frame)
+			Fatalize(t, err)
+		}
+		reader := bufio.NewReader(buf)
+		for _, frame := range frames {
+			received, err := getFrame(reader, MAX_FRAME_SIZE)
+			Fatalize(t, err)
+			assert.Equal(t, frame, received)
+		}
+	})
+}
@@ -3,6 +3,7 @@ package operator
 import (
 	"bufio"
 	"io"
+	"net"
 )
 
 type FrameReader interface {
@@ -22,18 +23,53 @@ type FrameReadWriter interface {
 type bufferedConnection struct {
 	buffer *bufio.Reader
 	io.ReadWriter
+	maxFrameSize int
 }
 
 func NewBufferedConnection(rw io.ReadWriter) FrameReadWriter {
+	return newBufferedConnection(rw, MAX_FRAME_SIZE)
+}
+
+// Same as NewBufferedConnection, reading frames up to that size
+func newBufferedConnection(rw io.ReadWriter, maxFrameSize int) *bufferedConnection {
 	reader := bufio.NewReader(rw)
-	conn := &bufferedConnection{reader, rw}
+	conn := &bufferedConnection{reader, rw, maxFrameSize}
 	return conn
 }
 
 func (conn *bufferedConnection) GetFrame() (Frame, error) {
-	return getFrame(conn.buffer)
+	return getFrame(conn.buffer, conn.maxFrameSize)
 }
 
 func (conn *bufferedConnection) SendFrame(frame Frame) (int, error) {
 	return sendFrame(conn, frame)
 }
+
+// Returns the connection under the layers of buffering and metering
+func unwrapConnection(rw io.ReadWriter) io.ReadWriter {
+	for {
+		switch conn := rw.(type) {
+		case *meteredConnection:
+			rw = conn.FrameReadWriter
+		case *coalescingConnection:
+			rw = conn.FrameReadWriter
+		case *bufferedConnection:
+			rw = conn.ReadWriter
+		case *meteredReadWriter:
+			rw = conn.ReadWriter
+		case *heldConnection:
+			rw = conn.FrameReadWriter
+		default:
+			return rw
+		}
+	}
+}
+
+// Returns the address of the other end of a connection, if known
+func remoteAddr(rw io.ReadWriter) string {
+	conn, ok := unwrapConnection(rw).(net.Conn)
+	if !ok || conn.RemoteAddr() == nil {
+		return ""
+	}
+	return conn.RemoteAddr().String()
+}
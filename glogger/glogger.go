@@ -0,0 +1,61 @@
+// Package glogger logs operators through glog, like they used to.
+package glogger
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apourchet/operator"
+	"github.com/golang/glog"
+)
+
+// The glog verbosity at which debug logs show up
+var DebugLevel glog.Level = 2
+
+// Logger implements operator.Logger with glog. Fields are appended to
+// the message as key=value pairs.
+type Logger struct {
+	fields []interface{}
+}
+
+func New() *Logger {
+	return &Logger{}
+}
+
+func (l *Logger) Debug(msg string, fields ...interface{}) {
+	if glog.V(DebugLevel) {
+		glog.InfoDepth(1, l.format(msg, fields))
+	}
+}
+
+func (l *Logger) Info(msg string, fields ...interface{}) {
+	glog.InfoDepth(1, l.format(msg, fields))
+}
+
+func (l *Logger) Warn(msg string, fields ...interface{}) {
+	glog.WarningDepth(1, l.format(msg, fields))
+}
+
+func (l *Logger) Error(msg string, fields ...interface{}) {
+	glog.ErrorDepth(1, l.format(msg, fields))
+}
+
+func (l *Logger) With(fields ...interface{}) operator.Logger {
+	joined := make([]interface{}, 0, len(l.fields)+len(fields))
+	joined = append(joined, l.fields...)
+	return &Logger{append(joined, fields...)}
+}
+
+func (l *Logger) format(msg string, fields []interface{}) string {
+	b := strings.Builder{}
+	b.WriteString(msg)
+	all := append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	for i := 0; i < len(all); i += 2 {
+		if i+1 < len(all) {
+			fmt.Fprintf(&b, " %v=%v", all[i], all[i+1])
+		} else {
+			fmt.Fprintf(&b, " %v", all[i])
+		}
+	}
+	return b.String()
+}
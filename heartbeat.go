@@ -1,9 +1,8 @@
 package operator
 
 import (
+	"fmt"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 type HeartbeatManager interface {
@@ -22,7 +21,7 @@ func SendHeartbeats(conn FrameWriter) error {
 	for {
 		_, err := conn.SendFrame(hb)
 		if err != nil {
-			glog.Warningf("Failed to heartbeat: %v", err)
+			DefaultLogger.Warn("Failed to heartbeat", LOG_ERROR, err)
 			return err
 		}
 		time.Sleep(DefaultHeartbeatManager.GetInterval())
@@ -32,3 +31,84 @@ func SendHeartbeats(conn FrameWriter) error {
 func (hm *heartbeatManager) GetInterval() time.Duration {
 	return 2 * time.Second
 }
+
+// Heartbeat intervals without a heartbeat after which a link is reported as missing them
+const MISSED_HEARTBEATS = 3
+
+// Checks that the heartbeats of the link keep coming at that interval, and reports
+// it once they stopped for MISSED_HEARTBEATS intervals, until it gets replaced or removed
+func (o *Operator) watchHeartbeats(l *Link, interval time.Duration) {
+	missed := false
+	for {
+		time.Sleep(interval)
+		current, err := o.ConnectionManager.GetLink(l.ReceiverID)
+		if err != nil || current != l {
+			return
+		}
+
+		since := time.Since(l.LastHeartbeat())
+		if since <= MISSED_HEARTBEATS*interval {
+			missed = false
+			continue
+		} else if missed {
+			continue
+		}
+		missed = true
+		l.Logger().Warn("Missed heartbeats", "since", since)
+		reason := fmt.Sprintf("No heartbeat for %v", since.Round(time.Millisecond))
+		o.Events().Emit(&Event{Type: EVENT_HEARTBEAT_MISSED, ReceiverID: l.ReceiverID, RemoteAddr: l.RemoteAddr(), Reason: reason})
+	}
+}
+
+// How often operators ping their links to measure the round-trip time
+var PingInterval = 30 * time.Second
+
+// How long a ping waits for its pong
+var PingTimeout = 10 * time.Second
+
+// Sends a ping down the link and returns the time it took to get the pong back
+func (link *Link) Ping() (time.Duration, error) {
+	ID := NewID()
+	channel, stop := link.waitReply(ID)
+	defer stop()
+
+	start := time.Now()
+	_, err := link.stream.SendFrame(&PingFrame{ID})
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case <-channel:
+		return time.Since(start), nil
+	case <-time.After(PingTimeout):
+		return 0, fmt.Errorf("Ping timed out after %v", PingTimeout)
+	}
+}
+
+func (link *Link) handlePong(pong *PongFrame) error {
+	if !link.deliverReply(pong.pingID, pong) {
+		link.Logger().Debug("Pong was found no associated ping", "pingID", pong.pingID)
+	}
+	return nil
+}
+
+// Pings the link of that receiver at that interval and reports the round-trip
+// times, until the link gets replaced or removed
+func (o *Operator) pingLink(l *Link, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		current, err := o.ConnectionManager.GetLink(l.ReceiverID)
+		if err != nil || current != l {
+			return
+		}
+
+		rtt, err := l.Ping()
+		if err != nil {
+			l.Logger().Warn("Failed to ping", LOG_ERROR, err)
+			o.Events().Emit(&Event{Type: EVENT_HEARTBEAT_MISSED, ReceiverID: l.ReceiverID, RemoteAddr: l.RemoteAddr(), Reason: err.Error()})
+			continue
+		}
+		o.Metrics.HeartbeatRTT(l.ReceiverID, rtt)
+	}
+}
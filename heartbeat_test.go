@@ -0,0 +1,158 @@
+package operator
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Keeps the measurements reported by an operator
+type recordingMetrics struct {
+	nopMetrics
+	framesSent int
+	bytesSent  int
+	rtts       map[string][]time.Duration
+	lock       sync.Mutex
+}
+
+func newRecordingMetrics() *recordingMetrics {
+	return &recordingMetrics{rtts: map[string][]time.Duration{}}
+}
+
+func (m *recordingMetrics) FrameSent(header byte) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.framesSent++
+}
+
+func (m *recordingMetrics) BytesSent(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytesSent += n
+}
+
+func (m *recordingMetrics) HeartbeatRTT(receiverID string, d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.rtts[receiverID] = append(m.rtts[receiverID], d)
+}
+
+func (m *recordingMetrics) rttCount(receiverID string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.rtts[receiverID])
+}
+
+func TestPing(t *testing.T) {
+	server, device, _ := newTestNetwork(t, "ping")
+	l := waitTestLink(t, server, device.ReceiverID)
+	rtt, err := l.Ping()
+	Fatalize(t, err)
+	assert.True(t, rtt > 0)
+
+	// Late and duplicate pongs do not block the link
+	Fatalize(t, l.handlePong(&PongFrame{"unknown"}))
+	_, err = l.Ping()
+	Fatalize(t, err)
+	l.tunnelLock.Lock()
+	defer l.tunnelLock.Unlock()
+	assert.Empty(t, l.replies)
+	assert.Equal(t, 0, l.pendingTunnels)
+}
+
+func TestPingLink(t *testing.T) {
+	lis := NewPipeListener("pinglink-server")
+	defer lis.Close()
+	metrics := newRecordingMetrics()
+	server := NewOperator("pinglink-server", "pinglink-server")
+	server.Metrics = metrics
+	go server.ServeListener(lis)
+
+	device := NewOperator("pinglink-device", "pinglink-device")
+	device.LinkTransport = lis
+	device.Link(server.Address)
+	l := waitTestLink(t, server, device.ReceiverID)
+
+	done := make(chan bool)
+	go func() {
+		server.pingLink(l, 10*time.Millisecond)
+		close(done)
+	}()
+	for i := 0; i < 500 && metrics.rttCount(device.ReceiverID) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.GreaterOrEqual(t, metrics.rttCount(device.ReceiverID), 2)
+	metrics.lock.Lock()
+	assert.Greater(t, metrics.framesSent, 0)
+	assert.Greater(t, metrics.bytesSent, 0)
+	metrics.lock.Unlock()
+
+	// Stops once the link is gone
+	Fatalize(t, server.ConnectionManager.RemoveLink(device.ReceiverID))
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pingLink did not stop")
+	}
+}
+
+func TestPingLinkMissed(t *testing.T) {
+	server := NewOperator("pingmissed-server", "pingmissed-server")
+	events := make(chan *Event, 10)
+	unsubscribe := server.Events().Subscribe(func(e *Event) {
+		if e.Type == EVENT_HEARTBEAT_MISSED {
+			events <- e
+		}
+	})
+	defer unsubscribe()
+
+	l := NewLink(closedConnection{}, "mute")
+	server.ConnectionManager.(LinkManager).AddLink(l)
+	go server.pingLink(l, 10*time.Millisecond)
+	defer server.ConnectionManager.RemoveLink("mute")
+
+	select {
+	case e := <-events:
+		assert.Equal(t, "mute", e.ReceiverID)
+		assert.NotEmpty(t, e.Reason)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Missed heartbeat not reported")
+	}
+}
+
+func TestWatchHeartbeats(t *testing.T) {
+	server := NewOperator("watch-server", "watch-server")
+	events := make(chan *Event, 10)
+	unsubscribe := server.Events().Subscribe(func(e *Event) {
+		if e.Type == EVENT_HEARTBEAT_MISSED {
+			events <- e
+		}
+	})
+	defer unsubscribe()
+
+	l := NewLink(closedConnection{}, "silent")
+	server.ConnectionManager.(LinkManager).AddLink(l)
+	defer server.ConnectionManager.RemoveLink("silent")
+	go server.watchHeartbeats(l, 20*time.Millisecond)
+
+	// Nothing to report while the heartbeats keep coming
+	for i := 0; i < 20; i++ {
+		l.lastHeartbeat.Store(time.Now().UnixNano())
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Empty(t, events)
+
+	select {
+	case e := <-events:
+		assert.Equal(t, "silent", e.ReceiverID)
+		assert.Contains(t, e.Reason, "No heartbeat")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Missed heartbeats not reported")
+	}
+
+	// Reported once until the heartbeats come back
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, events)
+}
@@ -0,0 +1,274 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a full buffer holds up a link by default, before the channel or
+// link at fault gets closed
+const MAX_BUFFER_WAIT = 10 * time.Second
+
+// Limits bound the memory that the peers of an operator can make it use.
+// Full buffers pause the link until its channels catch up, for up to
+// MaxBufferWait. Past that, or when hitting any other limit, the link, channel
+// or dial at fault fails with an error that says which limit it hit. Zero
+// means no limit.
+type Limits struct {
+	// Longest frame read, without its delimiter. Zero means MAX_FRAME_SIZE.
+	// Data frames take up to 4/3 of MAX_DATAGRAM_SIZE, plus their IDs.
+	MaxFrameSize int
+
+	// Bytes received through a link that wait to be written out to its
+	// channels. The link stops reading until they get written out.
+	MaxLinkBuffer int
+
+	// Same as MaxLinkBuffer, for a single channel
+	MaxChannelBuffer int
+
+	// How long a full buffer may stop the link from reading, before the
+	// channel or link gets closed. Zero means MAX_BUFFER_WAIT.
+	MaxBufferWait time.Duration
+
+	// Tunnel requests sent down a link that wait for their response
+	MaxPendingTunnels int
+}
+
+var DefaultLimits = Limits{
+	MaxFrameSize:      MAX_FRAME_SIZE,
+	MaxLinkBuffer:     64 * 1024 * 1024,
+	MaxChannelBuffer:  4 * 1024 * 1024,
+	MaxBufferWait:     MAX_BUFFER_WAIT,
+	MaxPendingTunnels: 1024,
+}
+
+// The errors of the limits
+var (
+	ErrLinkBufferFull    = errors.New("Link buffer full")
+	ErrChannelBufferFull = errors.New("Channel buffer full")
+	ErrTooManyTunnels    = errors.New("Too many pending tunnels")
+)
+
+func (l Limits) maxFrameSize() int {
+	if l.MaxFrameSize <= 0 {
+		return MAX_FRAME_SIZE
+	}
+	return l.MaxFrameSize
+}
+
+func (l Limits) maxBufferWait() time.Duration {
+	if l.MaxBufferWait <= 0 {
+		return MAX_BUFFER_WAIT
+	}
+	return l.MaxBufferWait
+}
+
+// Waits on cond, whose lock is held, while full returns true. Gives up once
+// the wait is over and returns false if there still is no room.
+func waitForRoom(lock sync.Locker, cond *sync.Cond, wait time.Duration, full func() bool) bool {
+	if !full() {
+		return true
+	}
+	deadline := time.Now().Add(wait)
+	timer := time.AfterFunc(wait, func() {
+		lock.Lock()
+		cond.Broadcast()
+		lock.Unlock()
+	})
+	defer timer.Stop()
+	for full() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		cond.Wait()
+	}
+	return true
+}
+
+// channelWriter writes the data of a channel out to its connection in the
+// background, so that a slow connection only holds up the whole link once
+// its buffer is full
+type channelWriter struct {
+	link      *Link
+	channelID string
+	conn      io.Writer
+	decoder   *channelDecoder // Between the queue and the connection, for compressed channels
+	stats     *channelStats
+	lock      sync.Mutex
+	cond      *sync.Cond // Signaled when data gets queued
+	room      *sync.Cond // Signaled when queued data gets written out
+	queue     [][]byte
+	batch     [][]byte // What gets written out while the queue fills up again
+	buffered  int
+	closed    bool
+	err       error // Why the channel got closed
+}
+
+func newChannelWriter(link *Link, channelID string, conn io.Writer, compression string) *channelWriter {
+	w := &channelWriter{}
+	w.link = link
+	w.channelID = channelID
+	w.conn = conn
+	w.stats = &channelStats{compression: compression}
+	if compression != COMPRESSION_NONE {
+		w.decoder = newChannelDecoder(conn, w.stats)
+	}
+	w.cond = sync.NewCond(&w.lock)
+	w.room = sync.NewCond(&w.lock)
+	go w.writeForever()
+	return w
+}
+
+// Queues the data to be written out, and gives it back to the pool once
+// written. Waits while the channel or its link have too much data waiting
+// already, which holds the link up until the slow connection catches up.
+// Fails with ErrChannelBufferFull or ErrLinkBufferFull if it does not catch
+// up in time, or once the channel is closed, leaving the data to the caller.
+func (w *channelWriter) Write(data []byte) error {
+	limits := w.link.limits()
+	wait := limits.maxBufferWait()
+	w.lock.Lock()
+	room := waitForRoom(&w.lock, w.room, wait, func() bool {
+		return !w.closed && limits.MaxChannelBuffer > 0 && w.buffered > 0 && w.buffered+len(data) > limits.MaxChannelBuffer
+	})
+	if w.closed {
+		w.lock.Unlock()
+		return io.ErrClosedPipe
+	} else if !room {
+		buffered := w.buffered
+		w.lock.Unlock()
+		return fmt.Errorf("%w: %d bytes waiting for channel %s for %v", ErrChannelBufferFull, buffered, w.channelID, wait)
+	}
+	w.buffered += len(data)
+	w.lock.Unlock()
+
+	err := w.link.reserveBuffer(len(data), limits.MaxLinkBuffer, wait)
+	if err != nil {
+		w.lock.Lock()
+		w.buffered -= len(data)
+		w.room.Broadcast()
+		w.lock.Unlock()
+		return err
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		w.buffered -= len(data)
+		w.link.releaseBuffer(len(data))
+		return io.ErrClosedPipe
+	}
+	w.queue = append(w.queue, data)
+	w.cond.Signal()
+	return nil
+}
+
+// Stops taking data. Without an error, the data already queued still gets
+// written out. With one, it gets dropped and the connection gets closed when
+// it can be. The first error is the one the channel reports.
+func (w *channelWriter) closeWithError(err error) {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return
+	}
+	w.closed = true
+	w.err = err
+	w.cond.Signal()
+	w.room.Broadcast()
+	w.lock.Unlock()
+
+	if closer, ok := w.conn.(io.Closer); ok && err != nil {
+		closer.Close()
+	}
+}
+
+func (w *channelWriter) getErr() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.err
+}
+
+func (w *channelWriter) writeForever() {
+	for {
+		w.lock.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed && (w.err != nil || len(w.queue) == 0) {
+			for _, data := range w.queue {
+				w.link.releaseBuffer(len(data))
+				putBuffer(data)
+			}
+			w.queue = nil
+			w.lock.Unlock()
+			if w.decoder != nil {
+				w.decoder.finish()
+			}
+			return
+		}
+		batch := w.queue
+		w.queue = w.batch[:0]
+		w.lock.Unlock()
+
+		// Everything queued goes out in a single vectored write
+		size := 0
+		for _, data := range batch {
+			size += len(data)
+		}
+		var out io.Writer = w.conn
+		if w.decoder != nil {
+			out = w.decoder
+		} else {
+			w.stats.add(size, size)
+		}
+		_, err := writeBuffers(out, append(net.Buffers(nil), batch...))
+		for i, data := range batch {
+			putBuffer(data)
+			batch[i] = nil
+		}
+		w.batch = batch
+
+		w.lock.Lock()
+		w.buffered -= size
+		w.room.Broadcast()
+		w.lock.Unlock()
+		w.link.releaseBuffer(size)
+		if err != nil {
+			w.link.Logger().Warn("Failed to write to channel", LOG_CHANNEL_ID, w.channelID, LOG_ERROR, err)
+			w.lock.Lock()
+			w.closed = true
+			if w.err == nil {
+				w.err = err
+			}
+			w.room.Broadcast()
+			w.lock.Unlock()
+		}
+	}
+}
+
+// Waits until the channels of the link have room for that many more bytes,
+// then counts them as buffered. Data bigger than the whole buffer still gets
+// in once the buffer is empty. Fails if there is no room after the wait.
+func (link *Link) reserveBuffer(n, max int, wait time.Duration) error {
+	link.bufferLock.Lock()
+	defer link.bufferLock.Unlock()
+	room := waitForRoom(&link.bufferLock, link.bufferRoom, wait, func() bool {
+		return max > 0 && link.buffered > 0 && link.buffered+n > max
+	})
+	if !room {
+		return fmt.Errorf("%w: %d bytes waiting for the channels of %s for %v", ErrLinkBufferFull, link.buffered, link.ReceiverID, wait)
+	}
+	link.buffered += n
+	return nil
+}
+
+func (link *Link) releaseBuffer(n int) {
+	link.bufferLock.Lock()
+	defer link.bufferLock.Unlock()
+	link.buffered -= n
+	link.bufferRoom.Broadcast()
+}
@@ -0,0 +1,252 @@
+package operator
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Takes every frame sent and never answers
+type sinkConnection struct {
+	lock sync.Mutex
+	sent []Frame
+}
+
+func (c *sinkConnection) GetFrame() (Frame, error)    { select {} }
+func (c *sinkConnection) Read(p []byte) (int, error)  { select {} }
+func (c *sinkConnection) Write(p []byte) (int, error) { return len(p), nil }
+
+func (c *sinkConnection) SendFrame(f Frame) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sent = append(c.sent, f)
+	return 0, nil
+}
+
+func newLimitedLink(limits Limits) (*Link, *sinkConnection) {
+	o := NewOperator("server", "server")
+	o.Limits = limits
+	conn := &sinkConnection{}
+	l := NewLink(conn, "device")
+	l.setOperator(o)
+	return l, conn
+}
+
+func TestPendingTunnelLimit(t *testing.T) {
+	l, conn := newLimitedLink(Limits{MaxPendingTunnels: 2})
+	l.Tunnel("service", CHANNEL_STREAM)
+	l.Tunnel("service", CHANNEL_STREAM)
+
+	f := <-l.Tunnel("service", CHANNEL_STREAM)
+	assert.True(t, f.IsError())
+	assert.Contains(t, string(f.Content()), ErrTooManyTunnels.Error())
+	assert.Len(t, conn.sent, 2)
+
+	// The tunnel that got its response is not pending anymore
+	req := conn.sent[0].(*TunnelRequest)
+	Fatalize(t, l.handleFrame(&TunnelErrorFrame{req.channelID, "Service not found"}))
+	select {
+	case f := <-l.Tunnel("service", CHANNEL_STREAM):
+		t.Fatalf("Tunnel was refused: %s", f.Content())
+	default:
+	}
+	assert.Len(t, conn.sent, 3)
+}
+
+func TestChannelBufferBackpressure(t *testing.T) {
+	l, _ := newLimitedLink(Limits{MaxChannelBuffer: 8, MaxLinkBuffer: 16})
+	slow, reader := net.Pipe()
+	l.CreatePipe("slow", slow)
+
+	// The link waits for the slow channel instead of closing it
+	written := atomic.Int32{}
+	errs := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			err := l.PipeOut("slow", EscapeContent([]byte(fmt.Sprintf("%04d", i))))
+			if err != nil {
+				errs <- err
+				return
+			}
+			written.Add(1)
+		}
+		errs <- nil
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Less(t, written.Load(), int32(5))
+
+	buf := make([]byte, 400)
+	for read := 0; read < len(buf); {
+		n, err := reader.Read(buf[read:min(read+3, len(buf))])
+		Fatalize(t, err)
+		read += n
+	}
+	Fatalize(t, <-errs)
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, fmt.Sprintf("%04d", i), string(buf[4*i:4*i+4]))
+	}
+
+	// Everything written out is released from the buffer of the link
+	buffered := -1
+	for i := 0; i < 500 && buffered != 0; i++ {
+		time.Sleep(time.Millisecond)
+		l.bufferLock.Lock()
+		buffered = l.buffered
+		l.bufferLock.Unlock()
+	}
+	assert.Equal(t, 0, buffered)
+}
+
+func TestChannelBufferLimit(t *testing.T) {
+	l, _ := newLimitedLink(Limits{MaxChannelBuffer: 8, MaxBufferWait: 20 * time.Millisecond})
+
+	// Nothing reads the slow channel, so its data stays buffered until the wait is over
+	slow, _ := net.Pipe()
+	l.CreatePipe("slow", slow)
+	Fatalize(t, l.PipeOut("slow", EscapeContent([]byte("1234"))))
+	Fatalize(t, l.PipeOut("slow", EscapeContent([]byte("5678"))))
+	err := l.PipeOut("slow", EscapeContent([]byte("9")))
+	assert.ErrorIs(t, err, ErrChannelBufferFull)
+	_, err = slow.Write([]byte("x"))
+	assert.ErrorIs(t, err, io.ErrClosedPipe)
+
+	// The other channels of the link are unaffected
+	fast, reader := net.Pipe()
+	l.CreatePipe("fast", fast)
+	Fatalize(t, l.PipeOut("fast", EscapeContent([]byte("hello"))))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestLinkBufferFullClosesLink(t *testing.T) {
+	o := NewOperator("server", "server")
+	o.Limits = Limits{MaxLinkBuffer: 8, MaxBufferWait: 20 * time.Millisecond}
+	local, remote := net.Pipe()
+	l := NewLink(newBufferedConnection(local, MAX_FRAME_SIZE), "device")
+	l.setOperator(o)
+	done := make(chan struct{})
+	go func() {
+		l.Maintain()
+		close(done)
+	}()
+
+	// Nothing reads either channel, so the second one finds the link buffer full
+	first, _ := net.Pipe()
+	second, _ := net.Pipe()
+	l.CreatePipe("first", first)
+	l.CreatePipe("second", second)
+	go func() {
+		remote.Write([]byte(string(HEADER_DATA) + "device,first," + EscapeContent([]byte("12345678")) + "\n"))
+		remote.Write([]byte(string(HEADER_DATA) + "device,second," + EscapeContent([]byte("9")) + "\n"))
+	}()
+	f, err := getFrame(bufio.NewReader(remote), MAX_FRAME_SIZE)
+	Fatalize(t, err)
+	assert.Equal(t, byte(HEADER_ERROR), f.Header())
+	assert.Contains(t, string(f.Content()), ErrLinkBufferFull.Error())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Link was not closed")
+	}
+	assert.Contains(t, l.getDownReason(), ErrLinkBufferFull.Error())
+}
+
+func TestChannelBufferClosed(t *testing.T) {
+	l, _ := newLimitedLink(Limits{MaxChannelBuffer: 8})
+	slow, _ := net.Pipe()
+	l.CreatePipe("slow", slow)
+	Fatalize(t, l.PipeOut("slow", EscapeContent([]byte("12345678"))))
+
+	// A write waiting for room fails once the channel closes
+	errs := make(chan error, 1)
+	go func() { errs <- l.PipeOut("slow", EscapeContent([]byte("9"))) }()
+	time.Sleep(20 * time.Millisecond)
+	l.tunnelLock.Lock()
+	w := l.pipes["slow"]
+	l.tunnelLock.Unlock()
+	w.closeWithError(io.ErrUnexpectedEOF)
+	select {
+	case err := <-errs:
+		assert.ErrorIs(t, err, io.ErrClosedPipe)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write still waiting on a closed channel")
+	}
+}
+
+func TestSlowDialerGetsEverything(t *testing.T) {
+	lis := NewPipeListener("slow-server")
+	defer lis.Close()
+	server := NewOperator("slow-server", "slow-server")
+	server.Limits = Limits{MaxChannelBuffer: 4096, MaxLinkBuffer: 8192}
+	go server.ServeListener(lis)
+
+	device := NewOperator("slow-device", "slow-device")
+	device.LinkTransport = lis
+	device.Link(server.Address)
+	waitTestLink(t, server, device.ReceiverID)
+
+	const size = 4 * PIPE_BUFFER_SIZE
+	serveTestService(t, device, "slow-source", func(conn net.Conn) {
+		// Waits for the dialer, whose channel is open by then
+		_, err := conn.Read(make([]byte, 1))
+		if err == nil {
+			conn.Write(bytes.Repeat([]byte("x"), size))
+		}
+	})
+	dialer := NewDialer(StaticOperatorResolver(server.Address))
+	dialer.Transport = lis
+	conn, err := dialer.Dial(device.ReceiverID, "slow-source")
+	Fatalize(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("!"))
+	Fatalize(t, err)
+
+	// Reads slowly at first, so that the buffers of the pipe and the server fill up
+	received := 0
+	buf := make([]byte, 32*1024)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; received < size; i++ {
+		if i < 20 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		n, err := conn.Read(buf)
+		Fatalize(t, err)
+		received += n
+	}
+	assert.Equal(t, size, received)
+}
+
+func TestFrameTooLongClosesLink(t *testing.T) {
+	local, remote := net.Pipe()
+	l := NewLink(newBufferedConnection(local, 64), "device")
+	done := make(chan struct{})
+	go func() {
+		l.Maintain()
+		close(done)
+	}()
+
+	go remote.Write([]byte(string(HEADER_DATA) + strings.Repeat("a", 100) + "\n"))
+	f, err := getFrame(bufio.NewReader(remote), MAX_FRAME_SIZE)
+	Fatalize(t, err)
+	assert.Equal(t, byte(HEADER_ERROR), f.Header())
+	assert.Contains(t, string(f.Content()), ErrFrameTooLong.Error())
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Link was not closed")
+	}
+	assert.Contains(t, l.getDownReason(), ErrFrameTooLong.Error())
+}
@@ -1,57 +1,261 @@
 package operator
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 type Link struct {
-	LastHeartbeat  time.Time
+	ConnectedSince time.Time
 	ReceiverID     string
 	tunnelsWaiting map[string]chan Frame
-	pipes          map[string]io.Writer
+	replies        map[string]chan Frame // Calls and pings waiting for their response
+	pipes          map[string]*channelWriter
 	tunnelLock     sync.Mutex
 	stream         FrameReadWriter
+	operator       *Operator
+	logger         Logger
+	downReason     string
+	metadata       map[string]string
+	lastHeartbeat  atomic.Int64 // Unix nanoseconds
+	buffered       int          // Bytes waiting to be written out to the channels
+	bufferLock     sync.Mutex
+	bufferRoom     *sync.Cond // Signaled when buffered bytes get written out
+	pendingTunnels int
+	messages       chan *Message // Waiting for their handlers, only used by Maintain
+	compressions   string        // Handled by the other end, from its capabilities
 }
 
 func NewLink(conn FrameReadWriter, receiverID string) *Link {
 	link := Link{}
-	link.LastHeartbeat = time.Now()
+	link.ConnectedSince = time.Now()
+	link.lastHeartbeat.Store(link.ConnectedSince.UnixNano())
 	link.ReceiverID = receiverID
 	link.tunnelsWaiting = map[string]chan Frame{}
-	link.pipes = map[string]io.Writer{}
+	link.replies = map[string]chan Frame{}
+	link.pipes = map[string]*channelWriter{}
+	link.metadata = map[string]string{}
 	link.tunnelLock = sync.Mutex{}
+	link.bufferRoom = sync.NewCond(&link.bufferLock)
 	link.stream = conn
+	link.logger = DefaultLogger.With(LOG_RECEIVER_ID, receiverID, LOG_REMOTE_ADDR, link.RemoteAddr())
 	return &link
 }
 
+// Returns when the last heartbeat went through the link, or when it connected.
+// This used to be a field, which raced with the link updating it.
+func (link *Link) LastHeartbeat() time.Time {
+	return time.Unix(0, link.lastHeartbeat.Load())
+}
+
+// Sets the operator that handles the messages going through this link
+func (link *Link) setOperator(o *Operator) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	link.operator = o
+	link.logger = o.Logger.With(LOG_RECEIVER_ID, link.ReceiverID, LOG_REMOTE_ADDR, link.RemoteAddr())
+}
+
+// Binds the link to that operator, with the metadata of its device if known
+func (link *Link) bind(o *Operator, metadata map[string]string) {
+	if metadata != nil {
+		link.setMetadata(metadata)
+	}
+	link.setOperator(o)
+}
+
+// Returns the logger of the link, which logs its receiverID and remote address
+func (link *Link) Logger() Logger {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	return link.logger
+}
+
+// Replaces the logger of the link. Binding the link to an operator replaces
+// it with the logger of that operator.
+func (link *Link) SetLogger(logger Logger) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	link.logger = logger
+}
+
+// Closes the connection of the link, which makes the link go away
+func (link *Link) Close() error {
+	closer, ok := unwrapConnection(link.stream).(io.Closer)
+	if !ok {
+		return fmt.Errorf("Link %s cannot be closed", link.ReceiverID)
+	}
+	return closer.Close()
+}
+
+// Returns the address of the other end of the link, if known
+func (link *Link) RemoteAddr() string {
+	return remoteAddr(link.stream)
+}
+
+// Returns the metrics of the operator of that link
+func (link *Link) metrics() Metrics {
+	o, err := link.getOperator()
+	if err != nil {
+		return DefaultMetrics
+	}
+	return o.Metrics
+}
+
+// Returns the limits of the operator of that link
+func (link *Link) limits() Limits {
+	o, err := link.getOperator()
+	if err != nil {
+		return DefaultLimits
+	}
+	return o.Limits
+}
+
+// Closes the link because of that error, which becomes the reason it went
+// down. The other end gets told why first.
+func (link *Link) closeWithError(err error) {
+	link.Logger().Error("Closing link", LOG_ERROR, err)
+	link.setDownReason(err.Error())
+	link.stream.SendFrame(&ErrorFrame{err.Error()})
+	link.Close()
+}
+
+// Returns the event bus of the operator of that link
+func (link *Link) events() *EventBus {
+	o, err := link.getOperator()
+	if err != nil {
+		return nil
+	}
+	return o.Events()
+}
+
+// Records why the link went down, for the LinkDown event. The first reason wins.
+func (link *Link) setDownReason(reason string) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	if link.downReason == "" {
+		link.downReason = reason
+	}
+}
+
+func (link *Link) getDownReason() string {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	return link.downReason
+}
+
+// Returns the tracer of the operator of that link
+func (link *Link) tracer() Tracer {
+	o, err := link.getOperator()
+	if err != nil {
+		return DefaultTracer
+	}
+	return o.Tracer
+}
+
+// Returns the compression the operator of that link wants for the channels
+// of that service
+func (link *Link) getServiceCompression(serviceKey string) string {
+	o, err := link.getOperator()
+	if err != nil {
+		return COMPRESSION_NONE
+	}
+	return o.getServiceCompression(serviceKey)
+}
+
+// Looks the service up in the ServiceResolver of the operator of that link
+func (link *Link) getService(serviceKey string) (string, bool, error) {
+	o, err := link.getOperator()
+	if err != nil {
+		return "", false, err
+	}
+	return o.ServiceResolver.GetService(serviceKey)
+}
+
+// Makes sure the operator of that link allows dialing that service host
+func (link *Link) checkService(serviceHost string) error {
+	o, err := link.getOperator()
+	if err != nil {
+		return err
+	}
+	return o.checkServiceNetwork(SplitServiceAddress(serviceHost))
+}
+
+// Returns the number of channels open through that link
+func (link *Link) ChannelCount() int {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	return len(link.pipes)
+}
+
+// Returns the channels open through that link, sorted by channelID
+func (link *Link) Channels() []*ChannelInfo {
+	link.tunnelLock.Lock()
+	infos := []*ChannelInfo{}
+	for channelID, w := range link.pipes {
+		infos = append(infos, newChannelInfo(channelID, w.stats))
+	}
+	link.tunnelLock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ChannelID < infos[j].ChannelID })
+	return infos
+}
+
+func (link *Link) getOperator() (*Operator, error) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	if link.operator == nil {
+		return nil, fmt.Errorf("Link %s is not bound to an operator", link.ReceiverID)
+	}
+	return link.operator, nil
+}
+
 // Sends down a tunnel request and creates a channel that will receive the response frame
 // the caller should wait on the frame that will come as a response
 // which will either be a DialResponse or an ErrorFrame
-func (link *Link) Tunnel(serviceKey string) chan Frame {
+func (link *Link) Tunnel(serviceKey string, channelType string) chan Frame {
+	return link.TunnelContext(context.Background(), serviceKey, channelType)
+}
+
+// Same as Tunnel, carrying the span context of ctx to the device
+func (link *Link) TunnelContext(ctx context.Context, serviceKey string, channelType string) chan Frame {
 	// Create new ID
 	ID := NewID()
 	channel := make(chan Frame, 1)
 
 	// Create the channel to listen to the tunnel response
+	max := link.limits().MaxPendingTunnels
 	link.tunnelLock.Lock()
+	if max > 0 && link.pendingTunnels >= max {
+		link.tunnelLock.Unlock()
+		err := fmt.Errorf("%w: %d tunnels waiting on %s", ErrTooManyTunnels, max, link.ReceiverID)
+		link.Logger().Warn("Refused to tunnel", LOG_SERVICE_KEY, serviceKey, LOG_ERROR, err)
+		channel <- &ErrorFrame{err.Error()}
+		return channel
+	}
 	link.tunnelsWaiting[ID] = channel
+	link.pendingTunnels++
 	link.tunnelLock.Unlock()
 
-	glog.V(2).Infof("Tunneling to %s for service %s (%s)", link.ReceiverID, serviceKey, ID)
+	link.Logger().Debug("Tunneling", LOG_SERVICE_KEY, serviceKey, LOG_CHANNEL_ID, ID)
 
 	// Send the tunnel request
-	req := &TunnelRequest{ID, serviceKey}
+	req := &TunnelRequest{ID, serviceKey, channelType, link.tracer().Inject(ctx), ""}
+	if channelType != CHANNEL_DATAGRAM {
+		// Datagrams would lose their boundaries through the decompressor
+		req.compressions = link.compressionOffer()
+	}
 	_, err := link.stream.SendFrame(req)
 	if err != nil {
 		// Wrap error
 		msg := fmt.Sprintf("Unable to send dial through link: %v", err)
-		glog.Errorf("Tunneling error: %v", err)
+		link.Logger().Error("Tunneling error", LOG_CHANNEL_ID, ID, LOG_ERROR, err)
+		link.takeTunnel(ID)
 		channel <- &ErrorFrame{msg}
 	}
 
@@ -63,19 +267,33 @@ func (link *Link) Tunnel(serviceKey string) chan Frame {
 func (link *Link) Maintain() {
 	for {
 		f, err := link.stream.GetFrame()
-		if err != nil && err != io.EOF {
-			glog.Warningf("Failed to get frame: %v", err)
+		var frameErr *FrameError
+		if errors.Is(err, ErrFrameTooLong) {
+			link.closeWithError(err)
+			continue
+		} else if errors.As(err, &frameErr) || errors.Is(err, ErrEmptyFrame) {
+			// Only that frame is lost, the next ones can still be read
+			link.Logger().Warn("Failed to get frame", LOG_ERROR, err)
 			continue
-		} else if err == io.EOF {
-			glog.Errorf("Link permanently closed: EOF")
-			DefaultConnectionManager.RemoveLink(link.ReceiverID)
+		} else if err != nil {
+			link.Logger().Error("Link permanently closed", LOG_ERROR, err)
+			link.setDownReason(fmt.Sprintf("Connection closed: %v", err))
+			if o, err := link.getOperator(); err == nil {
+				removeLink(o.ConnectionManager, link)
+				o.forgetSubscriptions(link)
+			}
+			if link.messages != nil {
+				close(link.messages)
+			}
 			return
 		}
 
 		// Handle this frame
 		err = link.handleFrame(f)
-		if err != nil {
-			glog.Warningf("Failed to handle frame: %v", err)
+		if errors.Is(err, ErrLinkBufferFull) {
+			link.closeWithError(err)
+		} else if err != nil {
+			link.Logger().Warn("Failed to handle frame", LOG_ERROR, err)
 			continue
 		}
 	}
@@ -84,77 +302,107 @@ func (link *Link) Maintain() {
 // Handles the data frame
 // pipes that out to a listening connection
 func (link *Link) handleDataFrame(data *DataFrame) error {
-	glog.V(3).Infof("Link got data frame: %s", data.String())
-	err := link.PipeOut(data.channelID, data.content)
+	link.Logger().Debug("Link got data frame", LOG_CHANNEL_ID, data.channelID)
+	err := link.pipeOut(data.channelID, data.data)
 	if err != nil {
 		return err
 	}
 
-	glog.V(3).Infof("Successfully handled data frame (%s)", data.channelID)
 	return nil
 }
 
 func (link *Link) handleTunnelRequest(req *TunnelRequest) error {
-	glog.V(3).Infof("Link got tunnel request: %s", req.String())
-	serviceHost, found, err := DefaultServiceResolver.GetService(req.serviceKey)
+	link.Logger().Debug("Link got tunnel request", LOG_CHANNEL_ID, req.channelID, LOG_SERVICE_KEY, req.serviceKey)
+
+	// The service connect span joins the trace of the dialer
+	tracer := link.tracer()
+	ctx := tracer.Extract(context.Background(), req.traceContext)
+	_, span := tracer.Start(ctx, SPAN_SERVICE_CONNECT, LOG_CHANNEL_ID, req.channelID, LOG_SERVICE_KEY, req.serviceKey)
+
+	serviceHost, found, err := link.getService(req.serviceKey)
 	if err != nil {
+		span.End(err)
+		link.metrics().TunnelError(TUNNEL_ERROR_SERVICE_RESOLVER)
 		_, err := link.stream.SendFrame(&TunnelErrorFrame{req.channelID, err.Error()})
 		return err
 	}
 
 	if !found {
+		span.End(fmt.Errorf("Service not found: %s", req.serviceKey))
+		link.metrics().TunnelError(TUNNEL_ERROR_SERVICE_NOT_FOUND)
 		_, err := link.stream.SendFrame(&TunnelErrorFrame{req.channelID, "Service not found"})
 		return err
 	}
 
+	// The allowed socket paths may have changed since the service was registered
+	err = link.checkService(serviceHost)
+	if err != nil {
+		span.End(err)
+		link.Logger().Warn("Refused to dial service", LOG_SERVICE_KEY, req.serviceKey, LOG_CHANNEL_ID, req.channelID, LOG_ERROR, err)
+		link.metrics().TunnelError(TUNNEL_ERROR_SERVICE_CONNECT)
+		_, err := link.stream.SendFrame(&TunnelErrorFrame{req.channelID, "Service connection error: " + err.Error()})
+		return err
+	}
+
 	// Dial that service
-	conn, err := net.Dial("tcp", serviceHost)
+	conn, err := dialService(req.channelType, serviceHost, req.channelID)
+	span.End(err)
 	if err != nil {
-		glog.Errorf("Failed to dial service %s (%s): %v", req.serviceKey, req.channelID, err)
+		link.Logger().Error("Failed to dial service", LOG_SERVICE_KEY, req.serviceKey, LOG_CHANNEL_ID, req.channelID, LOG_ERROR, err)
+		link.metrics().TunnelError(TUNNEL_ERROR_SERVICE_CONNECT)
 		_, err := link.stream.SendFrame(&TunnelErrorFrame{req.channelID, "Service connection error: " + err.Error()})
 		return err
 	}
 
+	// Compress the channel if the service wants it and the other end can
+	compression := link.getServiceCompression(req.serviceKey)
+	if !offersCompression(req.compressions, compression) {
+		compression = COMPRESSION_NONE
+	}
+
 	// Pipe all data frames coming from the channelID into that connection
-	link.CreatePipe(req.channelID, conn)
+	link.createPipe(req.channelID, conn, compression)
 	link.PipeIn(req.channelID, conn)
 
 	// Create success response
 	res := &TunnelResponse{}
 	res.channelID = req.channelID
+	res.compression = compression
 
 	// Done
-	glog.V(2).Infof("Successfully handled tunnel request (%s)", req.channelID)
+	link.Logger().Debug("Successfully handled tunnel request", LOG_CHANNEL_ID, req.channelID)
 	_, err = link.stream.SendFrame(res)
 	return err
 }
 
 func (link *Link) handleTunnelResponse(res *TunnelResponse) error {
-	glog.V(2).Infof("Link got tunnel response: %s", res.String())
+	link.Logger().Debug("Link got tunnel response", LOG_CHANNEL_ID, res.channelID)
 
 	// Find the channel that is waiting for a dial response
-	channel, found := link.tunnelsWaiting[res.channelID]
+	channel, found := link.takeTunnel(res.channelID)
 	if !found {
-		glog.Warningf("Tunnel response was found no associated waiting channel: %s", res.channelID)
+		link.Logger().Warn("Tunnel response was found no associated waiting channel", LOG_CHANNEL_ID, res.channelID)
 		return nil
 	}
 
 	// Send the dial response through
-	frame := &DialResponse{res.channelID}
+	var frame Frame = &DialResponse{res.channelID, res.compression}
+	if err := checkCompression(res.compression); err != nil {
+		frame = &ErrorFrame{err.Error()}
+	}
 	channel <- frame
 
 	// Done
-	glog.V(2).Infof("Successfully handled tunnel response (%s)", res.channelID)
 	return nil
 }
 
 func (link *Link) handleTunnelError(res *TunnelErrorFrame) error {
-	glog.V(2).Infof("Link got tunnel error: %s", res.String())
+	link.Logger().Debug("Link got tunnel error", LOG_CHANNEL_ID, res.channelID, LOG_ERROR, res.message)
 
 	// Find the channel that is waiting for a tunnel response
-	channel, found := link.tunnelsWaiting[res.channelID]
+	channel, found := link.takeTunnel(res.channelID)
 	if !found {
-		glog.Warningf("Tunnel response was found no associated waiting channel: %s", res.channelID)
+		link.Logger().Warn("Tunnel response was found no associated waiting channel", LOG_CHANNEL_ID, res.channelID)
 		return nil
 	}
 
@@ -167,43 +415,139 @@ func (link *Link) handleTunnelError(res *TunnelErrorFrame) error {
 	return nil
 }
 
+// Returns the channel waiting for the response of that tunnel, which is
+// not pending anymore
+func (link *Link) takeTunnel(channelID string) (chan Frame, bool) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	channel, found := link.tunnelsWaiting[channelID]
+	if found {
+		delete(link.tunnelsWaiting, channelID)
+		link.pendingTunnels--
+	}
+	return channel, found
+}
+
+// Returns the channel getting the response of that call or ping, and the
+// function that stops waiting for it
+func (link *Link) waitReply(ID string) (chan Frame, func()) {
+	channel := make(chan Frame, 1)
+	link.tunnelLock.Lock()
+	link.replies[ID] = channel
+	link.tunnelLock.Unlock()
+	return channel, func() {
+		link.tunnelLock.Lock()
+		delete(link.replies, ID)
+		link.tunnelLock.Unlock()
+	}
+}
+
+// Hands the response to the call or ping waiting for it. Only the first
+// response gets there, late and duplicate ones are dropped.
+func (link *Link) deliverReply(ID string, f Frame) bool {
+	link.tunnelLock.Lock()
+	channel, found := link.replies[ID]
+	delete(link.replies, ID)
+	link.tunnelLock.Unlock()
+	if !found {
+		return false
+	}
+
+	select {
+	case channel <- f:
+	default:
+	}
+	return true
+}
+
 // All data frames with this channelID going through the link
 // will be forwarded to this writer
 func (link *Link) CreatePipe(channelID string, conn io.Writer) {
-	glog.V(2).Infof("Link creating pipe (%s)", channelID)
+	link.createPipe(channelID, conn, COMPRESSION_NONE)
+}
+
+// Same as CreatePipe, for a channel using that compression both ways. Its
+// PipeIn compresses what it sends the same way.
+func (link *Link) createPipe(channelID string, conn io.Writer, compression string) {
+	link.Logger().Debug("Link creating pipe", LOG_CHANNEL_ID, channelID, "compression", compression)
+	w := newChannelWriter(link, channelID, conn, compression)
 	link.tunnelLock.Lock()
-	defer link.tunnelLock.Unlock()
-	link.pipes[channelID] = conn
+	replaced := link.pipes[channelID]
+	link.pipes[channelID] = w
+	link.tunnelLock.Unlock()
+	if replaced != nil {
+		replaced.closeWithError(nil)
+	}
+	link.events().Emit(&Event{Type: EVENT_CHANNEL_OPENED, ReceiverID: link.ReceiverID, ChannelID: channelID})
 }
 
 // Copies data from the reader through the link via DataFrames
 // with the channelID provided
 func (link *Link) PipeIn(channelID string, conn io.Reader) {
+	link.tunnelLock.Lock()
+	stats := &channelStats{}
+	if w, found := link.pipes[channelID]; found {
+		stats = w.stats
+	}
+	link.tunnelLock.Unlock()
+
 	go func() {
-		stream := NewLinkWriter(link.stream, link.ReceiverID, channelID)
-		n, err := io.Copy(stream, conn)
-		if err != nil && err == io.EOF {
-			glog.Warningf("Pipe closed (%s). Wrote %d bytes", channelID, n)
-			link.tunnelLock.Lock()
-			delete(link.pipes, channelID)
-			link.tunnelLock.Unlock()
-			return
-		} else if err != nil {
-			glog.Warningf("Pipe error (%s): %v", channelID, err)
-			return
+		stream := newChannelEncoder(NewLinkWriter(link.stream, link.ReceiverID, channelID), stats)
+		n, err := io.CopyBuffer(stream, conn, make([]byte, MAX_DATAGRAM_SIZE))
+		link.tunnelLock.Lock()
+		w := link.pipes[channelID]
+		delete(link.pipes, channelID)
+		link.tunnelLock.Unlock()
+
+		// The channel may have been closed for hitting a limit
+		if w != nil {
+			w.closeWithError(nil)
+			if werr := w.getErr(); werr != nil {
+				err = werr
+			}
+		}
+
+		closed := &Event{Type: EVENT_CHANNEL_CLOSED, ReceiverID: link.ReceiverID, ChannelID: channelID}
+		if err != nil {
+			link.Logger().Warn("Pipe error", LOG_CHANNEL_ID, channelID, LOG_ERROR, err)
+			closed.Reason = err.Error()
+		} else {
+			link.Logger().Debug("Pipe closed", LOG_CHANNEL_ID, channelID, "bytes", n)
 		}
+		link.events().Emit(closed)
 	}()
 }
 
 // Sends the escaped content (coming from a DataFrame) through a
 // connection that corresponds to a channelID
 func (link *Link) PipeOut(channelID string, content string) error {
-	conn, found := link.pipes[channelID]
+	data, err := UnescapeContent(content)
+	if err != nil {
+		return err
+	}
+	return link.pipeOut(channelID, data)
+}
+
+// Same as PipeOut with the data of the frame, which the channel takes over
+// and gives back to the pool once written out
+func (link *Link) pipeOut(channelID string, data []byte) error {
+	link.tunnelLock.Lock()
+	w, found := link.pipes[channelID]
+	link.tunnelLock.Unlock()
 	if !found {
-		glog.Errorf("Failed PipeOut: pipe not found: %s", channelID)
+		putBuffer(data)
+		link.Logger().Error("Failed PipeOut: pipe not found", LOG_CHANNEL_ID, channelID)
 		return fmt.Errorf("Pipe not found: %s", channelID)
 	}
-	_, err := conn.Write(UnescapeContent(content))
+
+	err := w.Write(data)
+	if err != nil {
+		putBuffer(data)
+	}
+	if errors.Is(err, ErrChannelBufferFull) {
+		link.Logger().Error("Closing channel", LOG_CHANNEL_ID, channelID, LOG_ERROR, err)
+		w.closeWithError(err)
+	}
 	return err
 }
 
@@ -230,6 +574,12 @@ func (link *Link) handleFrame(f Frame) error {
 		}
 		return link.handleTunnelResponse(res)
 
+	case HEADER_ERROR:
+		// The other end tells why it is about to close the link
+		link.Logger().Warn("Link error", LOG_ERROR, string(f.Content()))
+		link.setDownReason(string(f.Content()))
+		return nil
+
 	case HEADER_TUNNEL_ERROR:
 		res, ok := f.(*TunnelErrorFrame)
 		if !ok {
@@ -238,9 +588,103 @@ func (link *Link) handleFrame(f Frame) error {
 		return link.handleTunnelError(res)
 
 	case HEADER_HEARTBEAT:
-		glog.V(4).Infof("Got heartbeat for %s", link.ReceiverID)
-		link.LastHeartbeat = time.Now()
+		link.lastHeartbeat.Store(time.Now().UnixNano())
 		return nil
+
+	case HEADER_MESSAGE:
+		msg, ok := f.(*MessageFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleMessage(link, msg)
+
+	case HEADER_MESSAGE_ACK:
+		ack, ok := f.(*MessageAckFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleMessageAck(link, ack)
+
+	case HEADER_SUBSCRIBE:
+		sub, ok := f.(*SubscribeFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleSubscribe(link, sub)
+
+	case HEADER_UNSUBSCRIBE:
+		unsub, ok := f.(*UnsubscribeFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleUnsubscribe(link, unsub)
+
+	case HEADER_CALL_REQ:
+		req, ok := f.(*CallRequest)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleCall(link, req)
+
+	case HEADER_CALL_RES:
+		res, ok := f.(*CallResponse)
+		if !ok {
+			return ImpossibleError()
+		}
+		return link.handleCallResponse(res)
+
+	case HEADER_PING:
+		ping, ok := f.(*PingFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		_, err := link.stream.SendFrame(&PongFrame{ping.pingID})
+		return err
+
+	case HEADER_PONG:
+		pong, ok := f.(*PongFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		return link.handlePong(pong)
+
+	case HEADER_CAPABILITIES:
+		capabilities, ok := f.(*CapabilitiesFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		return link.handleCapabilities(capabilities)
+
+	case HEADER_METADATA:
+		metadata, ok := f.(*MetadataFrame)
+		if !ok {
+			return ImpossibleError()
+		}
+		o, err := link.getOperator()
+		if err != nil {
+			return err
+		}
+		return o.handleMetadata(link, metadata)
 	}
 
 	return fmt.Errorf("Unrecognized header: %d", f.Header())
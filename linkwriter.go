@@ -11,7 +11,7 @@ func NewLinkWriter(dest FrameWriter, receiverID, channelID string) *LinkWriter {
 }
 
 func (lw *LinkWriter) Write(p []byte) (int, error) {
-	frame := &DataFrame{lw.receiverID, lw.channelID, EscapeContent(p)}
+	frame := &DataFrame{lw.receiverID, lw.channelID, p}
 	_, err := lw.dest.SendFrame(frame)
 	return len(p), err
 }
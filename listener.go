@@ -0,0 +1,131 @@
+package operator
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Service hosts starting with this prefix refer to a ServiceListener
+// living in the same process as the operator
+const LISTENER_HOST_PREFIX = "listener/"
+
+// Number of tunneled connections that can wait to be accepted
+const LISTENER_BACKLOG = 128
+
+// The address of a ServiceListener
+type ServiceAddr string
+
+func (a ServiceAddr) Network() string { return "operator" }
+func (a ServiceAddr) String() string  { return string(a) }
+
+// ServiceListener is a net.Listener whose connections are the channels
+// tunneled to its service key, without going through a tcp port.
+type ServiceListener struct {
+	serviceKey string
+	host       string
+	conns      chan net.Conn
+	done       chan struct{}
+	once       sync.Once
+}
+
+var (
+	listeners     = map[string]*ServiceListener{}
+	listenersLock = sync.Mutex{}
+)
+
+// Creates a listener for that service key and registers it to the operator
+// at operatorAddr. The operator must be running in this process.
+func Listen(operatorAddr, serviceKey string) (net.Listener, error) {
+	lis := &ServiceListener{}
+	lis.serviceKey = serviceKey
+	lis.host = LISTENER_HOST_PREFIX + NewID()
+	lis.conns = make(chan net.Conn, LISTENER_BACKLOG)
+	lis.done = make(chan struct{})
+
+	listenersLock.Lock()
+	listeners[lis.host] = lis
+	listenersLock.Unlock()
+
+	err := RegisterService(operatorAddr, serviceKey, lis.host)
+	if err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+func (lis *ServiceListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-lis.conns:
+		return conn, nil
+	case <-lis.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (lis *ServiceListener) Close() error {
+	lis.once.Do(func() {
+		listenersLock.Lock()
+		delete(listeners, lis.host)
+		listenersLock.Unlock()
+		close(lis.done)
+	})
+	return nil
+}
+
+func (lis *ServiceListener) Addr() net.Addr {
+	return ServiceAddr(lis.serviceKey)
+}
+
+// Hands one end of a new in-memory connection to the listener
+// and returns the other end
+func (lis *ServiceListener) dial(channelID string) (net.Conn, error) {
+	local, remote := NewPipe(ServiceAddr(channelID), lis.Addr())
+	select {
+	case lis.conns <- remote:
+		return local, nil
+	case <-lis.done:
+		return nil, fmt.Errorf("Service listener closed")
+	default:
+		return nil, fmt.Errorf("Service listener backlog full")
+	}
+}
+
+// Dials the service registered under that host, over its network (udp or unixgram
+// for datagram channels), or through a ServiceListener of this process
+func dialService(channelType string, serviceHost string, channelID string) (net.Conn, error) {
+	network, address := SplitServiceAddress(serviceHost)
+
+	if channelType == CHANNEL_DATAGRAM {
+		switch network {
+		case NETWORK_TCP:
+			network = "udp"
+		case NETWORK_UNIX:
+			network = "unixgram"
+		default:
+			return nil, fmt.Errorf("Datagram channels not supported on %s services", network)
+		}
+		conn, err := net.Dial(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return newIdleConn(conn, DatagramIdleTimeout), nil
+	} else if channelType != CHANNEL_STREAM {
+		return nil, fmt.Errorf("Unknown channel type: %s", channelType)
+	}
+
+	if !strings.HasPrefix(serviceHost, LISTENER_HOST_PREFIX) {
+		return net.Dial(network, address)
+	}
+
+	listenersLock.Lock()
+	lis, found := listeners[serviceHost]
+	listenersLock.Unlock()
+	if !found {
+		DefaultLogger.Warn("Service listener not found in this process", "host", serviceHost, LOG_CHANNEL_ID, channelID)
+		return nil, fmt.Errorf("Service listener not found: %s", serviceHost)
+	}
+	return lis.dial(channelID)
+}
@@ -0,0 +1,49 @@
+package operator
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceListener(t *testing.T) {
+	_, device, dialer := newTestNetwork(t, "listener")
+
+	// Listen registers through the operator of the device
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer tcp.Close()
+	go device.ServeListener(tcp)
+
+	lis, err := Listen(tcp.Addr().String(), "inproc")
+	Fatalize(t, err)
+	assert.Equal(t, "inproc", lis.Addr().String())
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go echoHandler(conn)
+		}
+	}()
+
+	conn, err := dialer.Dial("listener-device", "inproc")
+	Fatalize(t, err)
+	_, err = conn.Write([]byte("in process"))
+	Fatalize(t, err)
+	buf := make([]byte, 10)
+	_, err = io.ReadFull(conn, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "in process", string(buf))
+	conn.Close()
+
+	// Once closed, the service cannot be dialed anymore
+	lis.Close()
+	_, err = lis.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed)
+	_, err = dialer.Dial("listener-device", "inproc")
+	assert.Error(t, err)
+}
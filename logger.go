@@ -0,0 +1,68 @@
+package operator
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Logger receives the logs of operators, dialers and links. Fields are
+// alternating keys and values, as with slog. NewSlogLogger adapts slog and
+// the glogger package adapts glog.
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+
+	// Returns a logger that adds those fields to everything it logs
+	With(fields ...interface{}) Logger
+}
+
+// The keys of the fields that operators log
+const (
+	LOG_RECEIVER_ID = "receiverID"
+	LOG_CHANNEL_ID  = "channelID"
+	LOG_SERVICE_KEY = "serviceKey"
+	LOG_REMOTE_ADDR = "remoteAddr"
+	LOG_ERROR       = "error"
+)
+
+// The logger of the operators, dialers and links that were not given one.
+// Logs to slog.Default() unless replaced.
+var DefaultLogger Logger = NewSlogLogger(nil)
+
+type slogLogger struct {
+	logger *slog.Logger
+	fields []interface{}
+}
+
+// Logs to that slog logger, or to whatever slog.Default() is at the time
+// of logging when it is nil
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return &slogLogger{logger, nil}
+}
+
+func (l *slogLogger) Debug(msg string, fields ...interface{}) { l.log(slog.LevelDebug, msg, fields) }
+func (l *slogLogger) Info(msg string, fields ...interface{})  { l.log(slog.LevelInfo, msg, fields) }
+func (l *slogLogger) Warn(msg string, fields ...interface{})  { l.log(slog.LevelWarn, msg, fields) }
+func (l *slogLogger) Error(msg string, fields ...interface{}) { l.log(slog.LevelError, msg, fields) }
+
+func (l *slogLogger) With(fields ...interface{}) Logger {
+	joined := make([]interface{}, 0, len(l.fields)+len(fields))
+	joined = append(joined, l.fields...)
+	return &slogLogger{l.logger, append(joined, fields...)}
+}
+
+func (l *slogLogger) log(level slog.Level, msg string, fields []interface{}) {
+	logger := l.logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if !logger.Enabled(context.Background(), level) {
+		return
+	}
+	if len(l.fields) > 0 {
+		fields = append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	}
+	logger.Log(context.Background(), level, msg, fields...)
+}
@@ -0,0 +1,97 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Can be logged to from several goroutines
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+// Decodes the JSON lines logged by a slog JSON handler
+func decodeLogs(t *testing.T, buf *lockedBuffer) []map[string]interface{} {
+	logs := []map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		entry := map[string]interface{}{}
+		Fatalize(t, json.Unmarshal([]byte(line), &entry))
+		logs = append(logs, entry)
+	}
+	return logs
+}
+
+func TestSlogLogger(t *testing.T) {
+	buf := &lockedBuffer{}
+	logger := NewSlogLogger(slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo})))
+
+	link := logger.With(LOG_RECEIVER_ID, "phone")
+	channel := link.With(LOG_CHANNEL_ID, "abc")
+	link.Debug("Hidden")
+	channel.Info("Opened", "bytes", 10)
+	link.Warn("Slow")
+	logger.Error("Failed", LOG_ERROR, "boom")
+
+	logs := decodeLogs(t, buf)
+	if !assert.Len(t, logs, 3) {
+		return
+	}
+	assert.Equal(t, "INFO", logs[0]["level"])
+	assert.Equal(t, "Opened", logs[0]["msg"])
+	assert.Equal(t, "phone", logs[0][LOG_RECEIVER_ID])
+	assert.Equal(t, "abc", logs[0][LOG_CHANNEL_ID])
+	assert.Equal(t, float64(10), logs[0]["bytes"])
+
+	// Fields of a child logger do not leak into its parent
+	assert.Equal(t, "WARN", logs[1]["level"])
+	assert.Equal(t, "phone", logs[1][LOG_RECEIVER_ID])
+	assert.NotContains(t, logs[1], LOG_CHANNEL_ID)
+	assert.Equal(t, "ERROR", logs[2]["level"])
+	assert.NotContains(t, logs[2], LOG_RECEIVER_ID)
+	assert.Equal(t, "boom", logs[2][LOG_ERROR])
+}
+
+func TestSlogLoggerDefault(t *testing.T) {
+	previous := slog.Default()
+	defer slog.SetDefault(previous)
+
+	// A nil logger follows slog.Default() as it changes
+	logger := NewSlogLogger(nil).With(LOG_SERVICE_KEY, "ssh")
+	buf := &lockedBuffer{}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	logger.Info("Registered")
+
+	slog.SetDefault(previous)
+
+	// Other tests may still be logging through the default too
+	found := false
+	for _, entry := range decodeLogs(t, buf) {
+		if entry["msg"] == "Registered" {
+			found = true
+			assert.Equal(t, "ssh", entry[LOG_SERVICE_KEY])
+		}
+	}
+	assert.True(t, found)
+}
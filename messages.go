@@ -0,0 +1,465 @@
+package operator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long a message is kept when it was published without a ttl
+var DefaultMessageTTL = 24 * time.Hour
+
+// How often operators look for messages to (re)deliver
+var MessageDeliveryInterval = time.Second
+
+// Messages received on a link that wait for their handlers. Past that, they
+// get dropped without an ack, and delivered again later.
+const MESSAGE_QUEUE_SIZE = 1024
+
+// Message is a payload pushed to a device on a topic. Messages are delivered
+// at least once: a device can see the same message again if its ack got lost.
+type Message struct {
+	ID       string
+	Topic    string
+	Payload  []byte
+	Expires  time.Time
+	Attempts int
+
+	nextAttempt time.Time
+}
+
+// Called for every message received on a topic. The message is acked when the
+// handler returns nil and will be delivered again later otherwise.
+type MessageHandlerFunc func(msg *Message) error
+
+// MessageStore keeps the messages published to receivers until they
+// acknowledge them
+type MessageStore interface {
+	// Queues a message for that receiver. Fails when its queue is full.
+	PushMessage(receiverID string, msg *Message) error
+
+	// Returns copies of the messages of that receiver that are due for
+	// delivery, and counts that delivery attempt. Expired messages are dropped.
+	DueMessages(receiverID string) ([]*Message, error)
+
+	// Removes a message that the receiver acknowledged
+	AckMessage(receiverID string, messageID string) error
+
+	// Returns the receivers that have messages waiting
+	Receivers() ([]string, error)
+}
+
+// The settings of the stores made by NewMemoryMessageStore, which
+// also apply to the fields left at zero
+const (
+	MESSAGE_STORE_LIMIT    = 1000
+	MESSAGE_RETRY_INTERVAL = 30 * time.Second
+	MESSAGE_MAX_ATTEMPTS   = 10
+)
+
+// MemoryMessageStore is a MessageStore that keeps messages in memory.
+// Its zero value is ready to use.
+type MemoryMessageStore struct {
+	// Maximum number of messages waiting per receiver
+	Limit int
+
+	// Time to wait for an ack before delivering a message again
+	RetryInterval time.Duration
+
+	// Number of deliveries after which a message is dropped
+	MaxAttempts int
+
+	queues map[string][]*Message
+	lock   sync.Mutex
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	s := &MemoryMessageStore{}
+	s.Limit = MESSAGE_STORE_LIMIT
+	s.RetryInterval = MESSAGE_RETRY_INTERVAL
+	s.MaxAttempts = MESSAGE_MAX_ATTEMPTS
+	s.queues = map[string][]*Message{}
+	return s
+}
+
+func (s *MemoryMessageStore) limit() int {
+	if s.Limit <= 0 {
+		return MESSAGE_STORE_LIMIT
+	}
+	return s.Limit
+}
+
+func (s *MemoryMessageStore) retryInterval() time.Duration {
+	if s.RetryInterval <= 0 {
+		return MESSAGE_RETRY_INTERVAL
+	}
+	return s.RetryInterval
+}
+
+func (s *MemoryMessageStore) maxAttempts() int {
+	if s.MaxAttempts <= 0 {
+		return MESSAGE_MAX_ATTEMPTS
+	}
+	return s.MaxAttempts
+}
+
+func (s *MemoryMessageStore) PushMessage(receiverID string, msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.queues == nil {
+		s.queues = map[string][]*Message{}
+	}
+
+	// Make room by dropping the messages that expired while the receiver was away
+	now := time.Now()
+	queue := []*Message{}
+	for _, waiting := range s.queues[receiverID] {
+		if now.Before(waiting.Expires) {
+			queue = append(queue, waiting)
+		}
+	}
+	s.queues[receiverID] = queue
+
+	if len(queue) >= s.limit() {
+		return fmt.Errorf("Message queue full for %s", receiverID)
+	}
+	s.queues[receiverID] = append(s.queues[receiverID], msg)
+	return nil
+}
+
+func (s *MemoryMessageStore) DueMessages(receiverID string) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	kept := []*Message{}
+	due := []*Message{}
+	for _, msg := range s.queues[receiverID] {
+		if now.After(msg.Expires) {
+			DefaultLogger.Debug("Message expired", "messageID", msg.ID, LOG_RECEIVER_ID, receiverID)
+			continue
+		} else if msg.Attempts >= s.maxAttempts() {
+			DefaultLogger.Warn("Message dropped", "messageID", msg.ID, LOG_RECEIVER_ID, receiverID, "attempts", msg.Attempts)
+			continue
+		}
+
+		kept = append(kept, msg)
+		if now.Before(msg.nextAttempt) {
+			continue
+		}
+		msg.Attempts++
+		msg.nextAttempt = now.Add(s.retryInterval())
+		copied := *msg
+		due = append(due, &copied)
+	}
+
+	if len(kept) == 0 {
+		delete(s.queues, receiverID)
+	} else {
+		s.queues[receiverID] = kept
+	}
+	return due, nil
+}
+
+func (s *MemoryMessageStore) AckMessage(receiverID string, messageID string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	queue := s.queues[receiverID]
+	for i, msg := range queue {
+		if msg.ID == messageID {
+			s.queues[receiverID] = append(queue[:i], queue[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("Message not found: %s", messageID)
+}
+
+func (s *MemoryMessageStore) Receivers() ([]string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	receivers := []string{}
+	for receiverID, queue := range s.queues {
+		if len(queue) > 0 {
+			receivers = append(receivers, receiverID)
+		}
+	}
+	sort.Strings(receivers)
+	return receivers, nil
+}
+
+// Registers the handler for the messages pushed to this device on that topic.
+// The "*" topic catches messages whose topic has no handler.
+func (o *Operator) HandleMessages(topic string, handler MessageHandlerFunc) {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	if o.messageHandlers == nil {
+		o.messageHandlers = map[string]MessageHandlerFunc{}
+	}
+	o.messageHandlers[topic] = handler
+}
+
+func (o *Operator) getMessageHandler(topic string) (MessageHandlerFunc, bool) {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	if handler, found := o.topics[topic]; found {
+		return handler, true
+	}
+	if handler, found := o.messageHandlers[topic]; found {
+		return handler, true
+	}
+	handler, found := o.messageHandlers["*"]
+	return handler, found
+}
+
+func (o *Operator) handlePublishRequest(conn FrameReadWriter, req *PublishRequest) error {
+	o.Logger.Debug("Publish request", LOG_RECEIVER_ID, req.receiverID, "topic", req.topic)
+
+	ttl := req.ttl
+	if ttl <= 0 {
+		ttl = DefaultMessageTTL
+	}
+	msg := &Message{}
+	msg.ID = NewID()
+	msg.Topic = req.topic
+	msg.Expires = time.Now().Add(ttl)
+	payload, err := UnescapeContent(req.payload)
+	if err != nil {
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+	msg.Payload = payload
+
+	err = o.MessageStore.PushMessage(req.receiverID, msg)
+	if err != nil {
+		o.Logger.Warn("Failed to queue message", LOG_RECEIVER_ID, req.receiverID, LOG_ERROR, err)
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+
+	_, err = conn.SendFrame(&PublishResponse{msg.ID})
+	go o.deliverMessages(req.receiverID)
+	return err
+}
+
+// Serializes the deliveries to one receiver
+type delivery struct {
+	lock  sync.Mutex
+	users int // Deliveries running or waiting
+}
+
+// Takes the delivery lock of that receiver and returns its unlock function.
+// Unless it waits, it gives up when a delivery is already running or waiting.
+func (o *Operator) lockDelivery(receiverID string, wait bool) (func(), bool) {
+	o.deliveryLock.Lock()
+	if o.deliveries == nil {
+		o.deliveries = map[string]*delivery{}
+	}
+	d, found := o.deliveries[receiverID]
+	if !found {
+		d = &delivery{}
+		o.deliveries[receiverID] = d
+	} else if !wait {
+		o.deliveryLock.Unlock()
+		return nil, false
+	}
+	d.users++
+	o.deliveryLock.Unlock()
+
+	d.lock.Lock()
+	return func() {
+		d.lock.Unlock()
+		o.deliveryLock.Lock()
+		defer o.deliveryLock.Unlock()
+		d.users--
+		if d.users == 0 {
+			delete(o.deliveries, receiverID)
+		}
+	}, true
+}
+
+// Delivers the due messages of that receiver if it is linked to this operator.
+// Deliveries to a receiver go one at a time, so that messages go out in the
+// order they got published, while other receivers get theirs meanwhile.
+func (o *Operator) deliverMessages(receiverID string) {
+	unlock, _ := o.lockDelivery(receiverID, true)
+	defer unlock()
+	o.sendDueMessages(receiverID)
+}
+
+// Sends the due messages of that receiver down its link
+func (o *Operator) sendDueMessages(receiverID string) {
+	l, err := o.ConnectionManager.GetLink(receiverID)
+	if err != nil {
+		return
+	}
+
+	msgs, err := o.MessageStore.DueMessages(receiverID)
+	if err != nil {
+		l.Logger().Warn("Failed to get messages", LOG_ERROR, err)
+		return
+	}
+
+	for _, msg := range msgs {
+		l.Logger().Debug("Delivering message", "messageID", msg.ID, "attempt", msg.Attempts)
+		frame := &MessageFrame{msg.ID, msg.Topic, EscapeContent(msg.Payload)}
+		_, err := l.stream.SendFrame(frame)
+		if err != nil {
+			l.Logger().Warn("Failed to deliver message", "messageID", msg.ID, LOG_ERROR, err)
+			return
+		}
+	}
+}
+
+// Delivers the messages waiting in the MessageStore while the operator serves
+// a listener, from the first one served until the last one returns
+func (o *Operator) startDelivery() {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	o.serving++
+	if o.serving == 1 {
+		o.deliveryStop = make(chan struct{})
+		go o.deliverMessagesForever(o.deliveryStop)
+	}
+}
+
+func (o *Operator) stopDelivery() {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	o.serving--
+	if o.serving == 0 {
+		close(o.deliveryStop)
+	}
+}
+
+// Keeps delivering the messages waiting in the MessageStore until stopped
+func (o *Operator) deliverMessagesForever(stop chan struct{}) {
+	ticker := time.NewTicker(MessageDeliveryInterval)
+	defer ticker.Stop()
+	for {
+		receivers, err := o.MessageStore.Receivers()
+		if err != nil {
+			o.Logger.Warn("Failed to list message receivers", LOG_ERROR, err)
+		}
+		// Receivers still busy with a previous delivery get skipped this time
+		for _, receiverID := range receivers {
+			if unlock, ok := o.lockDelivery(receiverID, false); ok {
+				go func(receiverID string) {
+					defer unlock()
+					o.sendDueMessages(receiverID)
+				}(receiverID)
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Queues a message received on the link for its handler, which acks it if it
+// succeeds. Handlers run one message at a time, in the order they came in.
+func (o *Operator) handleMessage(link *Link, f *MessageFrame) error {
+	link.Logger().Debug("Got message", "messageID", f.messageID, "topic", f.topic)
+	if _, found := o.getMessageHandler(f.topic); !found {
+		return fmt.Errorf("No handler for message topic: %s", f.topic)
+	}
+
+	msg := &Message{}
+	msg.ID = f.messageID
+	msg.Topic = f.topic
+	payload, err := UnescapeContent(f.payload)
+	if err != nil {
+		return err
+	}
+	msg.Payload = payload
+
+	if link.messages == nil {
+		link.messages = make(chan *Message, MESSAGE_QUEUE_SIZE)
+		go o.handleMessagesForever(link, link.messages)
+	}
+	select {
+	case link.messages <- msg:
+		return nil
+	default:
+		return fmt.Errorf("Message queue full, dropped message: %s", msg.ID)
+	}
+}
+
+// Runs the handlers of the messages of the link until it stops maintaining it
+func (o *Operator) handleMessagesForever(link *Link, messages chan *Message) {
+	for msg := range messages {
+		handler, found := o.getMessageHandler(msg.Topic)
+		if !found {
+			link.Logger().Warn("Message handler removed", "messageID", msg.ID, "topic", msg.Topic)
+			continue
+		}
+		err := handler(msg)
+		if err != nil {
+			link.Logger().Warn("Message handler failed", "messageID", msg.ID, LOG_ERROR, err)
+			continue
+		}
+		_, err = link.stream.SendFrame(&MessageAckFrame{msg.ID})
+		if err != nil {
+			link.Logger().Warn("Failed to ack message", "messageID", msg.ID, LOG_ERROR, err)
+		}
+	}
+}
+
+func (o *Operator) handleMessageAck(link *Link, f *MessageAckFrame) error {
+	link.Logger().Debug("Message acked", "messageID", f.messageID)
+	err := o.MessageStore.AckMessage(link.ReceiverID, f.messageID)
+	if err != nil {
+		// Broadcasts are acked too, but never stored
+		link.Logger().Debug("Ack of unknown message", "messageID", f.messageID, LOG_ERROR, err)
+	}
+	return nil
+}
+
+// Publishes a message to the receiver on that topic. The operator of the receiver
+// keeps the message until the receiver acks it, or until the ttl expires.
+// Returns the ID of the message.
+func (d *Dialer) Publish(receiverID, topic string, payload []byte, ttl time.Duration) (string, error) {
+	if strings.Contains(topic, ",") {
+		return "", fmt.Errorf("Topic cannot contain commas: %s", topic)
+	}
+
+	host, err := d.OperatorResolver.ResolveOperator(receiverID)
+	if err != nil {
+		d.logger().Error("OperatorResolver error", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return "", err
+	}
+
+	conn, err := d.Transport.Dial(host)
+	if err != nil {
+		d.logger().Error("Failed to dial operator", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return "", err
+	}
+	defer conn.Close()
+	bufConn := NewBufferedConnection(conn)
+
+	req := &PublishRequest{receiverID, topic, ttl, EscapeContent(payload)}
+	_, err = bufConn.SendFrame(req)
+	if err != nil {
+		d.logger().Error("Failed to publish message", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return "", err
+	}
+
+	resp, err := bufConn.GetFrame()
+	if err != nil {
+		d.logger().Error("Failed to publish message", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return "", err
+	} else if resp.IsError() {
+		d.logger().Error("Failed to publish message", LOG_RECEIVER_ID, receiverID, LOG_ERROR, string(resp.Content()))
+		return "", fmt.Errorf("%s", string(resp.Content()))
+	}
+
+	cast, ok := resp.(*PublishResponse)
+	if !ok {
+		return "", ImpossibleError()
+	}
+	return cast.messageID, nil
+}
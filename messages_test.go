@@ -0,0 +1,180 @@
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryMessageStore(t *testing.T) {
+	s := NewMemoryMessageStore()
+	s.Limit = 2
+	s.RetryInterval = 20 * time.Millisecond
+	s.MaxAttempts = 2
+	now := time.Now()
+
+	// Queue limit
+	Fatalize(t, s.PushMessage("phone", &Message{ID: "a", Expires: now.Add(time.Hour)}))
+	Fatalize(t, s.PushMessage("phone", &Message{ID: "b", Expires: now.Add(time.Hour)}))
+	assert.Error(t, s.PushMessage("phone", &Message{ID: "c", Expires: now.Add(time.Hour)}))
+	receivers, err := s.Receivers()
+	Fatalize(t, err)
+	assert.Equal(t, []string{"phone"}, receivers)
+
+	// Delivered messages wait for their ack until the retry interval
+	due, err := s.DueMessages("phone")
+	Fatalize(t, err)
+	assert.Len(t, due, 2)
+	assert.Equal(t, 1, due[0].Attempts)
+	due, err = s.DueMessages("phone")
+	Fatalize(t, err)
+	assert.Empty(t, due)
+
+	// Acked messages are gone, the others get retried up to MaxAttempts
+	Fatalize(t, s.AckMessage("phone", "a"))
+	assert.Error(t, s.AckMessage("phone", "a"))
+	time.Sleep(2 * s.RetryInterval)
+	due, err = s.DueMessages("phone")
+	Fatalize(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "b", due[0].ID)
+		assert.Equal(t, 2, due[0].Attempts)
+	}
+	time.Sleep(2 * s.RetryInterval)
+	due, err = s.DueMessages("phone")
+	Fatalize(t, err)
+	assert.Empty(t, due)
+	receivers, err = s.Receivers()
+	Fatalize(t, err)
+	assert.Empty(t, receivers)
+}
+
+func TestMessageTTL(t *testing.T) {
+	s := NewMemoryMessageStore()
+	s.Limit = 1
+	Fatalize(t, s.PushMessage("phone", &Message{ID: "old", Expires: time.Now().Add(-time.Second)}))
+
+	// Expired messages make room, and are never delivered
+	Fatalize(t, s.PushMessage("phone", &Message{ID: "new", Expires: time.Now().Add(time.Hour)}))
+	due, err := s.DueMessages("phone")
+	Fatalize(t, err)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, "new", due[0].ID)
+	}
+}
+
+func TestZeroMemoryMessageStore(t *testing.T) {
+	s := &MemoryMessageStore{}
+	Fatalize(t, s.PushMessage("phone", &Message{ID: "a", Expires: time.Now().Add(time.Hour)}))
+	due, err := s.DueMessages("phone")
+	Fatalize(t, err)
+	assert.Len(t, due, 1)
+	Fatalize(t, s.AckMessage("phone", "a"))
+}
+
+func TestPushMessages(t *testing.T) {
+	server, device, dialer := newTestNetwork(t, "messages")
+	store := server.MessageStore.(*MemoryMessageStore)
+	store.RetryInterval = 50 * time.Millisecond
+
+	lock := sync.Mutex{}
+	received := []string{}
+	failures := 1
+	device.HandleMessages("config", func(msg *Message) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if string(msg.Payload) == "retried" && failures > 0 {
+			failures--
+			return errors.New("Not now")
+		}
+		// Messages can come again when their ack is late
+		for _, payload := range received {
+			if payload == string(msg.Payload) {
+				return nil
+			}
+		}
+		received = append(received, string(msg.Payload))
+		return nil
+	})
+	get := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, received...)
+	}
+
+	// Handlers see the messages in order, and ack them
+	for i := 0; i < 20; i++ {
+		_, err := dialer.Publish(device.ReceiverID, "config", []byte(fmt.Sprint(i)), time.Minute)
+		Fatalize(t, err)
+	}
+	assert.Eventually(t, func() bool { return len(get()) == 20 }, 5*time.Second, 10*time.Millisecond)
+	for i, payload := range get() {
+		assert.Equal(t, fmt.Sprint(i), payload)
+	}
+	assert.Eventually(t, func() bool {
+		receivers, _ := store.Receivers()
+		return len(receivers) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A failed message gets delivered again, once the operator looks for
+	// messages to deliver
+	_, err := dialer.Publish(device.ReceiverID, "config", []byte("retried"), time.Minute)
+	Fatalize(t, err)
+	assert.Eventually(t, func() bool {
+		server.deliverMessages(device.ReceiverID)
+		return len(get()) == 21
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "retried", get()[20])
+}
+
+func TestMessageDeliveryStops(t *testing.T) {
+	o := NewOperator("delivery", "delivery")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	served := make(chan error)
+	go func() { served <- o.ServeListener(lis) }()
+	assert.Eventually(t, func() bool {
+		o.messageLock.Lock()
+		defer o.messageLock.Unlock()
+		return o.serving == 1
+	}, time.Second, time.Millisecond)
+
+	stop := o.deliveryStop
+	lis.Close()
+	<-served
+	select {
+	case <-stop:
+	case <-time.After(time.Second):
+		t.Fatal("Delivery did not stop")
+	}
+}
+
+// A receiver stuck on a delivery does not hold up the others
+func TestDeliveryPerReceiver(t *testing.T) {
+	server, device, dialer := newTestNetwork(t, "perreceiver")
+	unlock, _ := server.lockDelivery("stuck", true)
+	defer unlock()
+
+	received := make(chan string, 1)
+	device.HandleMessages("config", func(msg *Message) error {
+		received <- string(msg.Payload)
+		return nil
+	})
+	_, err := dialer.Publish(device.ReceiverID, "config", []byte("hello"), time.Minute)
+	Fatalize(t, err)
+	select {
+	case payload := <-received:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Message not delivered")
+	}
+
+	// The periodic deliveries skip the stuck receiver instead of piling up
+	_, ok := server.lockDelivery("stuck", false)
+	assert.False(t, ok)
+}
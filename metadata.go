@@ -0,0 +1,235 @@
+package operator
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Well-known metadata keys of devices
+const (
+	METADATA_FIRMWARE = "firmware"
+	METADATA_MODEL    = "model"
+	METADATA_SITE     = "site"
+)
+
+func encodeMetadata(metadata map[string]string) string {
+	values := url.Values{}
+	for key, value := range metadata {
+		values.Set(key, value)
+	}
+	return values.Encode()
+}
+
+func decodeMetadata(encoded string) (map[string]string, error) {
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("Metadata parse error: %v", err)
+	}
+	metadata := map[string]string{}
+	for key, value := range values {
+		metadata[key] = value[0]
+	}
+	return metadata, nil
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Selector matches links by their metadata. It is a comma-separated list of
+// requirements that must all hold: key=value, key!=value, key (the key is set)
+// and !key (the key is not set). For example "site=paris,model!=v1".
+type Selector []selectorRequirement
+
+type selectorRequirement struct {
+	key    string
+	value  string
+	equals bool // False for != and !key
+	exists bool // Only the presence of the key matters
+}
+
+func ParseSelector(selector string) (Selector, error) {
+	s := Selector{}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		req := selectorRequirement{}
+		if i := strings.Index(part, "!="); i >= 0 {
+			req.key, req.value = part[:i], part[i+2:]
+		} else if i := strings.Index(part, "="); i >= 0 {
+			req.key, req.value, req.equals = part[:i], strings.TrimPrefix(part[i+1:], "="), true
+		} else if strings.HasPrefix(part, "!") {
+			req.key, req.exists = part[1:], true
+		} else {
+			req.key, req.exists, req.equals = part, true, true
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return nil, fmt.Errorf("Selector parse error: '%s'", selector)
+		}
+		s = append(s, req)
+	}
+	return s, nil
+}
+
+// An empty selector matches everything
+func (s Selector) Matches(metadata map[string]string) bool {
+	for _, req := range s {
+		value, found := metadata[req.key]
+		if req.exists && found != req.equals {
+			return false
+		} else if !req.exists && (found && value == req.value) != req.equals {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the metadata the device sent when it linked, or updated since
+func (link *Link) Metadata() map[string]string {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	return copyMetadata(link.metadata)
+}
+
+func (link *Link) setMetadata(metadata map[string]string) {
+	link.tunnelLock.Lock()
+	defer link.tunnelLock.Unlock()
+	link.metadata = metadata
+}
+
+// Sets the metadata of this device: firmware version, hardware model, site,
+// labels... It is sent when linking, and right away to the current links.
+func (o *Operator) SetMetadata(metadata map[string]string) {
+	o.messageLock.Lock()
+	o.metadata = copyMetadata(metadata)
+	uplinks := o.getUplinks()
+	o.messageLock.Unlock()
+
+	frame := &MetadataFrame{encodeMetadata(metadata)}
+	for _, uplink := range uplinks {
+		_, err := uplink.SendFrame(frame)
+		if err != nil {
+			o.Logger.Warn("Failed to send metadata", LOG_ERROR, err)
+		}
+	}
+}
+
+func (o *Operator) getMetadata() map[string]string {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	return copyMetadata(o.metadata)
+}
+
+// Returns the links whose metadata matches the selector, sorted by receiverID
+func (o *Operator) FindLinks(selector Selector) ([]*Link, error) {
+	links, err := o.listLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	found := []*Link{}
+	for _, l := range links {
+		if selector.Matches(l.Metadata()) {
+			found = append(found, l)
+		}
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].ReceiverID < found[j].ReceiverID })
+	return found, nil
+}
+
+func (o *Operator) handleMetadata(link *Link, f *MetadataFrame) error {
+	metadata, err := decodeMetadata(f.metadata)
+	if err != nil {
+		return err
+	}
+	link.Logger().Debug("Metadata updated", "metadata", f.metadata)
+	link.setMetadata(metadata)
+	return nil
+}
+
+func (o *Operator) handleFindRequest(conn FrameReadWriter, req *FindRequest) error {
+	o.Logger.Debug("Find request", "selector", req.selector)
+	selector, err := ParseSelector(req.selector)
+	if err != nil {
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+
+	links, err := o.FindLinks(selector)
+	if err != nil {
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+
+	resp := &FindResponse{[]string{}}
+	for _, l := range links {
+		resp.receiverIDs = append(resp.receiverIDs, l.ReceiverID)
+	}
+	_, err = conn.SendFrame(resp)
+	return err
+}
+
+// Returns the receivers linked to the operator at operatorAddr whose
+// metadata matches the selector
+func (d *Dialer) Find(operatorAddr, selector string) ([]string, error) {
+	_, err := ParseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.Transport.Dial(operatorAddr)
+	if err != nil {
+		d.logger().Error("Failed to dial operator", "operator", operatorAddr, LOG_ERROR, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	bufConn := NewBufferedConnection(conn)
+	_, err = bufConn.SendFrame(&FindRequest{selector})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := bufConn.GetFrame()
+	if err != nil {
+		return nil, err
+	} else if resp.IsError() {
+		return nil, fmt.Errorf("%s", string(resp.Content()))
+	}
+
+	cast, ok := resp.(*FindResponse)
+	if !ok {
+		return nil, ImpossibleError()
+	}
+	return cast.receiverIDs, nil
+}
+
+// Dials the service on one of the receivers linked to the operator at
+// operatorAddr whose metadata matches the selector, picked at random
+func (d *Dialer) DialSelector(operatorAddr, selector, serviceKey string) (net.Conn, error) {
+	receiverIDs, err := d.Find(operatorAddr, selector)
+	if err != nil {
+		return nil, err
+	} else if len(receiverIDs) == 0 {
+		return nil, fmt.Errorf("No receiver matches the selector: %s", selector)
+	}
+
+	receiverID := receiverIDs[rand.Intn(len(receiverIDs))]
+	picked := *d
+	picked.OperatorResolver = StaticOperatorResolver(operatorAddr)
+	return picked.Dial(receiverID, serviceKey)
+}
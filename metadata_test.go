@@ -0,0 +1,96 @@
+package operator
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelector(t *testing.T) {
+	metadata := map[string]string{"site": "paris", "model": "v2", "beta": ""}
+	cases := map[string]bool{
+		"":                     true,
+		"site=paris":           true,
+		"site==paris":          true,
+		"site=london":          false,
+		"site!=london":         true,
+		"site!=paris":          false,
+		"beta":                 true,
+		"!beta":                false,
+		"!firmware":            true,
+		"firmware!=1.0":        true,
+		"site=paris,model=v2":  true,
+		"site=paris,model!=v2": false,
+	}
+	for selector, expected := range cases {
+		s, err := ParseSelector(selector)
+		Fatalize(t, err)
+		assert.Equal(t, expected, s.Matches(metadata), selector)
+	}
+
+	_, err := ParseSelector("=paris")
+	assert.Error(t, err)
+}
+
+func TestLinkMetadata(t *testing.T) {
+	lis := NewPipeListener("metadata-server")
+	defer lis.Close()
+
+	server := NewOperator("metadata-server", "metadata-server")
+	go server.ServeListener(lis)
+
+	device := NewOperator("metadata-device", "metadata-device")
+	device.SetMetadata(map[string]string{METADATA_SITE: "paris", METADATA_FIRMWARE: "1.0"})
+	device.LinkTransport = lis
+	device.Link("metadata-server")
+
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	device.ServiceResolver.SetService("metadata-echo", svc.Addr().String())
+
+	var l *Link
+	for i := 0; i < 100; i++ {
+		if l, err = server.ConnectionManager.GetLink("metadata-device"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	Fatalize(t, err)
+	assert.Equal(t, "paris", l.Metadata()[METADATA_SITE])
+
+	dialer := NewDialer(nil)
+	dialer.Transport = lis
+	found, err := dialer.Find("metadata-server", "site=paris")
+	Fatalize(t, err)
+	assert.Equal(t, []string{"metadata-device"}, found)
+
+	conn, err := dialer.DialSelector("metadata-server", "site=paris,firmware=1.0", "metadata-echo")
+	Fatalize(t, err)
+	conn.Close()
+
+	// Updates go over the link
+	device.SetMetadata(map[string]string{METADATA_SITE: "london"})
+	for i := 0; i < 100 && l.Metadata()[METADATA_SITE] != "london"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, map[string]string{METADATA_SITE: "london"}, l.Metadata())
+
+	found, err = dialer.Find("metadata-server", "site=paris")
+	Fatalize(t, err)
+	assert.Empty(t, found)
+	_, err = dialer.DialSelector("metadata-server", "site=paris", "metadata-echo")
+	assert.Error(t, err)
+}
@@ -0,0 +1,164 @@
+package operator
+
+import (
+	"io"
+	"time"
+)
+
+// Metrics receives the measurements of an operator. The prometheus package
+// implements it, and the default discards everything so that no metrics
+// dependency is forced on users.
+type Metrics interface {
+	// Frames going through connections, by header type
+	FrameSent(header byte)
+	FrameReceived(header byte)
+
+	// Bytes going through connections
+	BytesSent(n int)
+	BytesReceived(n int)
+
+	// Time for a dial request to go through the link and get its channel
+	DialLatency(d time.Duration)
+
+	// A dial or tunnel request failed. Reasons are TUNNEL_ERROR_* constants.
+	TunnelError(reason string)
+
+	// Round-trip time of a ping over a link
+	HeartbeatRTT(receiverID string, d time.Duration)
+}
+
+// The reasons reported to Metrics.TunnelError
+const (
+	TUNNEL_ERROR_LINK_NOT_FOUND    = "link_not_found"
+	TUNNEL_ERROR_TUNNEL_FAILED     = "tunnel_failed"
+	TUNNEL_ERROR_SERVICE_RESOLVER  = "service_resolver"
+	TUNNEL_ERROR_SERVICE_NOT_FOUND = "service_not_found"
+	TUNNEL_ERROR_SERVICE_CONNECT   = "service_connect"
+)
+
+var DefaultMetrics Metrics = &nopMetrics{}
+
+type nopMetrics struct{}
+
+func (m *nopMetrics) FrameSent(header byte)                           {}
+func (m *nopMetrics) FrameReceived(header byte)                       {}
+func (m *nopMetrics) BytesSent(n int)                                 {}
+func (m *nopMetrics) BytesReceived(n int)                             {}
+func (m *nopMetrics) DialLatency(d time.Duration)                     {}
+func (m *nopMetrics) TunnelError(reason string)                       {}
+func (m *nopMetrics) HeartbeatRTT(receiverID string, d time.Duration) {}
+
+// Returns the name of a header type, for labeling metrics
+func HeaderName(header byte) string {
+	switch header {
+	case HEADER_ERROR:
+		return "error"
+	case HEADER_TUNNEL_ERROR:
+		return "tunnel_error"
+	case HEADER_DATA:
+		return "data"
+	case HEADER_LINK_REQ:
+		return "link_req"
+	case HEADER_LINK_RES:
+		return "link_res"
+	case HEADER_REGISTER_REQ:
+		return "register_req"
+	case HEADER_REGISTER_RES:
+		return "register_res"
+	case HEADER_DIAL_REQ:
+		return "dial_req"
+	case HEADER_DIAL_RES:
+		return "dial_res"
+	case HEADER_TUNNEL_REQ:
+		return "tunnel_req"
+	case HEADER_TUNNEL_RES:
+		return "tunnel_res"
+	case HEADER_HEARTBEAT:
+		return "heartbeat"
+	case HEADER_PUBLISH_REQ:
+		return "publish_req"
+	case HEADER_PUBLISH_RES:
+		return "publish_res"
+	case HEADER_MESSAGE:
+		return "message"
+	case HEADER_MESSAGE_ACK:
+		return "message_ack"
+	case HEADER_SUBSCRIBE:
+		return "subscribe"
+	case HEADER_UNSUBSCRIBE:
+		return "unsubscribe"
+	case HEADER_BROADCAST_REQ:
+		return "broadcast_req"
+	case HEADER_BROADCAST_RES:
+		return "broadcast_res"
+	case HEADER_CALL_REQ:
+		return "call_req"
+	case HEADER_CALL_RES:
+		return "call_res"
+	case HEADER_PING:
+		return "ping"
+	case HEADER_PONG:
+		return "pong"
+	case HEADER_METADATA:
+		return "metadata"
+	case HEADER_FIND_REQ:
+		return "find_req"
+	case HEADER_FIND_RES:
+		return "find_res"
+	case HEADER_CAPABILITIES:
+		return "capabilities"
+	}
+	return "unknown"
+}
+
+// Counts the bytes going through a connection
+type meteredReadWriter struct {
+	io.ReadWriter
+	metrics Metrics
+}
+
+func (rw *meteredReadWriter) Read(p []byte) (int, error) {
+	n, err := rw.ReadWriter.Read(p)
+	rw.metrics.BytesReceived(n)
+	return n, err
+}
+
+func (rw *meteredReadWriter) Write(p []byte) (int, error) {
+	n, err := rw.ReadWriter.Write(p)
+	rw.metrics.BytesSent(n)
+	return n, err
+}
+
+// Counts the frames going through a connection
+type meteredConnection struct {
+	FrameReadWriter
+	metrics Metrics
+}
+
+// Same as NewBufferedConnection, reporting bytes and frames to the metrics
+func NewMeteredConnection(rw io.ReadWriter, metrics Metrics) FrameReadWriter {
+	return newMeteredConnection(rw, metrics, MAX_FRAME_SIZE, 0)
+}
+
+// Same as NewMeteredConnection, reading frames up to that size and holding
+// data frames back for up to the flush latency
+func newMeteredConnection(rw io.ReadWriter, metrics Metrics, maxFrameSize int, flushLatency time.Duration) FrameReadWriter {
+	buffered := newBufferedConnection(&meteredReadWriter{rw, metrics}, maxFrameSize)
+	return &meteredConnection{newCoalescingConnection(buffered, flushLatency), metrics}
+}
+
+func (conn *meteredConnection) GetFrame() (Frame, error) {
+	f, err := conn.FrameReadWriter.GetFrame()
+	if f != nil {
+		conn.metrics.FrameReceived(f.Header())
+	}
+	return f, err
+}
+
+func (conn *meteredConnection) SendFrame(frame Frame) (int, error) {
+	n, err := conn.FrameReadWriter.SendFrame(frame)
+	if err == nil {
+		conn.metrics.FrameSent(frame.Header())
+	}
+	return n, err
+}
@@ -1,12 +1,18 @@
 package operator
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 type OperatorInterface interface {
@@ -35,8 +41,16 @@ func NewOperator(receiverID, address string) *Operator {
 	o.ReceiverID = receiverID
 	o.Address = address
 	o.OperatorResolver = DefaultOperatorResolver
-	o.ConnectionManager = DefaultConnectionManager
-	o.ServiceResolver = DefaultServiceResolver
+	o.ConnectionManager = NewConnectionManager()
+	o.ServiceResolver = NewMemoryServiceResolver()
+	o.LinkTransport = DefaultLinkTransport
+	o.MessageStore = NewMemoryMessageStore()
+	o.Metrics = DefaultMetrics
+	o.Logger = DefaultLogger
+	o.Tracer = DefaultTracer
+	o.Limits = DefaultLimits
+	o.FlushLatency = DefaultFlushLatency
+	o.subscriptions = newSubscriptions()
 	return o
 }
 
@@ -46,6 +60,43 @@ type Operator struct {
 	ConnectionManager ConnectionManager
 	OperatorResolver  OperatorResolver
 	ServiceResolver   ServiceResolver
+	LinkTransport     LinkTransport
+	MessageStore      MessageStore
+	Metrics           Metrics
+	Logger            Logger
+	Tracer            Tracer
+	Limits            Limits
+
+	// How long data frames can wait to be written out along with the next
+	// ones. Zero writes every frame out right away.
+	FlushLatency time.Duration
+
+	// Glob patterns (as in filepath.Match) of the unix socket paths that services
+	// are allowed to register. No unix socket can be exposed when empty.
+	AllowedSocketPaths []string
+
+	// Addresses of the other operators of the cluster, that broadcasts get forwarded to
+	Peers []string
+
+	// Checks the requests to the admin API, which refuses them when it returns
+	// an error. ServeAdmin only listens on localhost without it.
+	AdminAuth func(r *http.Request) error
+
+	messageHandlers map[string]MessageHandlerFunc
+	callHandlers    map[string]CallHandlerFunc
+	topics          map[string]MessageHandlerFunc // Subscriptions of this device
+	uplinks         map[string]FrameWriter
+	messageLock     sync.Mutex
+	serving         int                  // Listeners being served, that deliver messages
+	deliveryStop    chan struct{}        // Stops delivering messages
+	deliveries      map[string]*delivery // By receiverID
+	events          *EventBus            // Of a ConnectionManager that has none
+	eventsOnce      sync.Once
+	deliveryLock    sync.Mutex
+	subscriptions   *subscriptions
+	draining        atomic.Bool
+	metadata        map[string]string
+	compressions    map[string]string // By service key
 }
 
 func (o *Operator) SetID(id string) *Operator {
@@ -63,102 +114,208 @@ func (o *Operator) SetAddress(address string) *Operator {
 }
 
 func (o *Operator) Serve(port int) error {
-	glog.V(1).Infof("Serving operator on port %d", port)
+	o.Logger.Info("Serving operator", "port", port)
 	addr := fmt.Sprintf(":%d", port)
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
-		glog.Errorf("Failed to serve operator: %v", err)
+		o.Logger.Error("Failed to serve operator", LOG_ERROR, err)
 		return err
 	}
+	return o.ServeListener(lis)
+}
 
+// Serves the operator on any listener: unix sockets, tls, in-memory pipes...
+// Returns when the listener gets closed.
+func (o *Operator) ServeListener(lis net.Listener) error {
+	o.startDelivery()
+	defer o.stopDelivery()
 	for {
 		conn, err := lis.Accept()
-		if err != nil {
-			// TODO Do something with that?
-			glog.Warningf("Failed to accept connection: %v", err)
+		if errors.Is(err, net.ErrClosed) {
+			o.Logger.Info("Operator listener closed", "addr", lis.Addr().String())
+			return err
+		} else if err != nil {
+			o.Logger.Warn("Failed to accept connection", LOG_ERROR, err)
 			continue
 		}
-		glog.V(3).Infof("Accepted connection")
+		o.Logger.Debug("Accepted connection", LOG_REMOTE_ADDR, conn.RemoteAddr().String())
 
 		go func() {
-			err := o.respond(NewBufferedConnection(conn))
+			err := o.respond(o.newConnection(conn))
 			if err != nil {
-				glog.Warningf("Failed to respond to connection: %v", err)
+				o.Logger.Warn("Failed to respond to connection", LOG_REMOTE_ADDR, conn.RemoteAddr().String(), LOG_ERROR, err)
 				return
 			}
-			glog.V(2).Infof("Successfully handled connection")
+			o.Logger.Debug("Successfully handled connection", LOG_REMOTE_ADDR, conn.RemoteAddr().String())
 		}()
 	}
-	return nil
 }
 
 func (o *Operator) LinkAndServe(port int, host string) error {
+	o.Link(host)
+	return o.Serve(port)
+}
+
+// Same as LinkAndServe, serving on that listener
+func (o *Operator) LinkAndServeListener(lis net.Listener, host string) error {
+	o.Link(host)
+	return o.ServeListener(lis)
+}
+
+// Links to the operator at that host through the LinkTransport, and
+// keeps relinking in the background whenever the link breaks
+func (o *Operator) Link(host string) {
 	receiverId := o.GetID()
 
 	// Try to keep link alive
 	go func() {
 		for {
-			glog.V(3).Infof("Linking to %s as %s", host, receiverId)
-			conn, err := net.Dial("tcp", host)
+			o.Logger.Debug("Linking", "operator", host, LOG_RECEIVER_ID, receiverId)
+			conn, err := o.LinkTransport.Dial(host)
 			if err != nil {
-				glog.Errorf("Failed to link to %s: %v. Retrying...", host, err)
-				time.Sleep(time.Duration(1000+rand.Int31n(3000)) * time.Millisecond)
+				o.Logger.Error("Failed to link. Retrying...", "operator", host, LOG_ERROR, err)
+				time.Sleep(linkRetryDelay())
 				continue
 			}
-			defer conn.Close()
 
-			bufConn := NewBufferedConnection(conn)
+			o.maintainLink(host, o.newConnection(conn))
+			conn.Close()
+		}
+	}()
+}
 
-			// Send the link request
-			req := &LinkRequest{receiverId}
-			_, err = bufConn.SendFrame(req)
-			if err != nil {
-				glog.Warningf("Broken link to %s as %s: %vRetrying...", host, receiverId, err)
-				continue
-			}
+// Returns how long to wait before linking again after a failure
+func linkRetryDelay() time.Duration {
+	return time.Duration(1000+rand.Int31n(3000)) * time.Millisecond
+}
 
-			// Check the response is good
-			resp, err := bufConn.GetFrame()
-			if err != nil {
-				glog.Warningf("Broken link to %s as %s: %vRetrying...", host, receiverId, err)
-				continue
-			} else if resp.IsError() {
-				glog.Warningf("Broken link to %s as %s: %sRetrying...", host, receiverId, string(resp.Content()))
-				continue
-			}
+// Sends the link request and heartbeats through that connection until it breaks
+func (o *Operator) maintainLink(host string, bufConn FrameReadWriter) {
+	receiverId := o.GetID()
+	logger := o.Logger.With("operator", host, LOG_RECEIVER_ID, receiverId)
 
-			// Cast to get receiverID
-			cast, ok := resp.(*LinkResponse)
-			if !ok {
-				glog.Warningf("Broken link to %s as %s: %vRetrying...", host, receiverId, ImpossibleError())
-				continue
-			}
+	// Send the link request
+	req := &LinkRequest{receiverId, encodeMetadata(o.getMetadata())}
+	_, err := bufConn.SendFrame(req)
+	if err != nil {
+		logger.Warn("Broken link. Retrying...", LOG_ERROR, err)
+		return
+	}
 
-			// Set and maintain that link
-			o.ConnectionManager.SetLink(cast.receiverID, bufConn)
-			err = o.OperatorResolver.SetOperator(cast.receiverID, o.Address)
-			if err != nil {
-				glog.Warningf("OperatorResolver error: %v", err)
-			}
+	// Check the response is good
+	resp, err := bufConn.GetFrame()
+	if err != nil {
+		logger.Warn("Broken link. Retrying...", LOG_ERROR, err)
+		return
+	} else if resp.IsError() {
+		// Refused, by a draining operator for instance: do not hammer it
+		logger.Warn("Broken link. Retrying...", LOG_ERROR, string(resp.Content()))
+		time.Sleep(linkRetryDelay())
+		return
+	}
+
+	// Cast to get receiverID
+	cast, ok := resp.(*LinkResponse)
+	if !ok {
+		logger.Warn("Broken link. Retrying...", LOG_ERROR, ImpossibleError())
+		return
+	}
+
+	// Set and maintain that link, and tell the operator what this device handles
+	l, err := o.addLink(bufConn, cast.receiverID, nil)
+	if err != nil {
+		logger.Warn("Broken link. Retrying...", LOG_ERROR, err)
+		return
+	}
+	_, err = bufConn.SendFrame(&CapabilitiesFrame{capabilities()})
+	if err != nil {
+		logger.Warn("Failed to send capabilities", LOG_ERROR, err)
+	}
+	err = o.OperatorResolver.SetOperator(cast.receiverID, o.Address)
+	if err != nil {
+		logger.Warn("OperatorResolver error", LOG_ERROR, err)
+	}
+
+	logger.Debug("Linked", "operatorID", cast.receiverID)
+	o.addUplink(host, bufConn)
+	defer o.removeUplink(host)
 
-			glog.V(2).Infof("Linked to %s as %s", cast.receiverID, receiverId)
+	// Send heartbeats until it closes
+	err = SendHeartbeats(bufConn) // Blocks
+	logger.Warn("Broken link. Retrying...", LOG_ERROR, err)
+	l.setDownReason(fmt.Sprintf("Heartbeat failed: %v", err))
+	removeLink(o.ConnectionManager, l)
+}
 
-			// Send heartbeats until it closes
-			err = SendHeartbeats(bufConn) // Blocks
-			glog.Warningf("Broken link to %s as %s: %vRetrying...", host, receiverId, err)
+// Wraps a connection to read and write frames through it
+func (o *Operator) newConnection(conn io.ReadWriter) FrameReadWriter {
+	return newMeteredConnection(conn, o.Metrics, o.Limits.maxFrameSize(), o.FlushLatency)
+}
 
-			o.ConnectionManager.RemoveLink(cast.receiverID)
+// Makes the link of that connection and binds it to this operator, so that it
+// uses its managers and hands it the frames it does not handle itself, then
+// stores and maintains the link until its connection closes
+func (o *Operator) addLink(conn FrameReadWriter, receiverID string, metadata map[string]string) (*Link, error) {
+	if manager, ok := o.ConnectionManager.(LinkManager); ok {
+		l := NewLink(conn, receiverID)
+		l.bind(o, metadata)
+		err := manager.AddLink(l)
+		if err != nil {
+			return nil, err
 		}
-	}()
+		go l.Maintain()
+		return l, nil
+	}
 
-	// Serve
-	return o.Serve(port)
+	// Other connection managers make the link themselves, which waits
+	// for its operator before reading any frame
+	held := &heldConnection{conn, make(chan struct{})}
+	defer close(held.bound)
+	err := o.ConnectionManager.SetLink(receiverID, held)
+	if err != nil {
+		return nil, err
+	}
+	l, err := o.ConnectionManager.GetLink(receiverID)
+	if err != nil {
+		return nil, err
+	} else if l.stream != held {
+		return nil, fmt.Errorf("Link of %s replaced before it got bound", receiverID)
+	}
+	l.bind(o, metadata)
+	return l, nil
+}
+
+// Returns the bus of the lifecycle events of the links of the operator. Only
+// a LinkManager reports links going up and down.
+func (o *Operator) Events() *EventBus {
+	if manager, ok := o.ConnectionManager.(LinkManager); ok {
+		return manager.Events()
+	}
+	o.eventsOnce.Do(func() { o.events = NewEventBus() })
+	return o.events
+}
+
+// Lists the links of the operator, if its ConnectionManager can
+func (o *Operator) listLinks() ([]*Link, error) {
+	manager, ok := o.ConnectionManager.(LinkManager)
+	if !ok {
+		return nil, fmt.Errorf("The ConnectionManager of %s cannot list links", o.GetID())
+	}
+	return manager.ListLinks()
 }
 
 func (o *Operator) respond(conn FrameReadWriter) error {
-	// Get the outstanding frame from that connection
+	// Get the outstanding frame from that connection. The connection
+	// cannot be read any further when that fails.
 	f, err := conn.GetFrame()
 	if err != nil {
+		var frameErr *FrameError
+		if errors.As(err, &frameErr) || errors.Is(err, ErrEmptyFrame) {
+			conn.SendFrame(&ErrorFrame{err.Error()})
+		}
+		if closer, ok := unwrapConnection(conn).(io.Closer); ok {
+			closer.Close()
+		}
 		return err
 	}
 
@@ -175,49 +332,111 @@ func (o *Operator) respond(conn FrameReadWriter) error {
 }
 
 func (o *Operator) handleLinkRequest(conn FrameReadWriter, req *LinkRequest) error {
-	glog.V(2).Infof("Link request: %s", req.String())
+	o.Logger.Debug("Link request", LOG_RECEIVER_ID, req.receiverID, LOG_REMOTE_ADDR, remoteAddr(conn))
+	if o.draining.Load() {
+		_, err := conn.SendFrame(&ErrorFrame{"Operator draining"})
+		return err
+	}
+
+	metadata, err := decodeMetadata(req.metadata)
+	if err != nil {
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
 
 	resp := &LinkResponse{o.GetID()}
-	_, err := conn.SendFrame(resp)
+	_, err = conn.SendFrame(resp)
 	if err != nil {
 		return err
 	}
-	o.ConnectionManager.SetLink(req.receiverID, conn)
+	l, err := o.addLink(conn, req.receiverID, metadata)
+	if err != nil {
+		return err
+	}
+	go o.deliverMessages(req.receiverID)
+	go o.pingLink(l, PingInterval)
+	go o.watchHeartbeats(l, DefaultHeartbeatManager.GetInterval())
 
 	return o.OperatorResolver.SetOperator(req.receiverID, o.Address)
 }
 
 func (o *Operator) handleRegisterRequest(conn FrameReadWriter, req *RegisterRequest) error {
-	glog.V(2).Infof("Register request %s", req.String())
-	o.ServiceResolver.SetService(req.serviceKey, req.serviceHost)
+	o.Logger.Debug("Register request", LOG_SERVICE_KEY, req.serviceKey, "network", req.serviceNetwork, "host", req.serviceHost)
+	err := o.checkServiceNetwork(req.serviceNetwork, req.serviceHost)
+	if err == nil {
+		err = o.SetServiceCompression(req.serviceKey, req.compression)
+	}
+	if err != nil {
+		o.Logger.Warn("Refused to register service", LOG_SERVICE_KEY, req.serviceKey, LOG_ERROR, err)
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+	o.ServiceResolver.SetService(req.serviceKey, JoinServiceAddress(req.serviceNetwork, req.serviceHost))
+	o.Events().Emit(&Event{Type: EVENT_SERVICE_REGISTERED, ServiceKey: req.serviceKey, RemoteAddr: remoteAddr(conn)})
 
 	resp := &RegisterResponse{}
-	_, err := conn.SendFrame(resp)
+	_, err = conn.SendFrame(resp)
 	return err
 }
 
+// Makes sure a service can be registered on that network, and that unix
+// sockets are only exposed when their path is allowed
+func (o *Operator) checkServiceNetwork(network, host string) error {
+	switch network {
+	case NETWORK_TCP:
+		// A tcp host must not sneak in the network of a socket
+		if strings.Contains(host, "://") {
+			return fmt.Errorf("Tcp service host cannot carry a network: %s", host)
+		}
+		return nil
+	case NETWORK_UNIX, NETWORK_UNIXPACKET:
+		path := filepath.Clean(host)
+		for _, pattern := range o.AllowedSocketPaths {
+			if matched, _ := filepath.Match(pattern, path); matched {
+				return nil
+			}
+		}
+		return fmt.Errorf("Socket path not allowed: %s", host)
+	}
+	return fmt.Errorf("Unsupported service network: %s", network)
+}
+
 func (o *Operator) handleDialRequest(conn FrameReadWriter, req *DialRequest) error {
-	glog.V(2).Infof("Dial request to %s", req.String())
+	o.Logger.Debug("Dial request", LOG_RECEIVER_ID, req.receiverID, LOG_SERVICE_KEY, req.serviceKey, LOG_REMOTE_ADDR, remoteAddr(conn))
+	start := time.Now()
 	l, err := o.ConnectionManager.GetLink(req.receiverID)
 	if err != nil {
-		glog.Warningf("Failed to get link %s: %v", req.receiverID, err)
+		o.Logger.Warn("Failed to get link", LOG_RECEIVER_ID, req.receiverID, LOG_ERROR, err)
+		o.Metrics.TunnelError(TUNNEL_ERROR_LINK_NOT_FOUND)
 		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
 		return err
 	}
 
-	frame := <-l.Tunnel(req.serviceKey)
+	// The tunnel span joins the trace of the dialer
+	ctx := o.Tracer.Extract(context.Background(), req.traceContext)
+	ctx, span := o.Tracer.Start(ctx, SPAN_TUNNEL, LOG_RECEIVER_ID, req.receiverID, LOG_SERVICE_KEY, req.serviceKey)
+	frame := <-l.TunnelContext(ctx, req.serviceKey, req.channelType)
 	res, ok := frame.(*DialResponse)
 	if frame.IsError() || !ok {
-		glog.Warningf("Dial error received from tunnel: %v", string(frame.Content()))
+		span.End(fmt.Errorf("%s", string(frame.Content())))
+		o.Logger.Warn("Dial error received from tunnel", LOG_RECEIVER_ID, req.receiverID, LOG_SERVICE_KEY, req.serviceKey, LOG_ERROR, string(frame.Content()))
+		o.Metrics.TunnelError(TUNNEL_ERROR_TUNNEL_FAILED)
 		_, err := conn.SendFrame(&ErrorFrame{"Service discovery failed: " + string(frame.Content())})
 		return err
 	}
+	span.End(nil)
 
-	l.CreatePipe(res.channelID, conn)
-	l.PipeIn(res.channelID, conn)
+	// Datagram channels keep their message boundaries up to the dialer
+	var pipe io.ReadWriter = conn
+	if req.channelType == CHANNEL_DATAGRAM {
+		pipe = newDatagramStream(conn, req.receiverID, res.channelID)
+	}
+	l.createPipe(res.channelID, pipe, res.compression)
+	l.PipeIn(res.channelID, pipe)
 
-	resp := &DialResponse{res.channelID}
+	resp := &DialResponse{channelID: res.channelID}
 	_, err = conn.SendFrame(resp)
+	o.Metrics.DialLatency(time.Since(start))
 	return err
 }
 
@@ -243,6 +462,34 @@ func (o *Operator) handleFrame(conn FrameReadWriter, f Frame) error {
 			return ImpossibleError()
 		}
 		return o.handleDialRequest(conn, req)
+
+	case HEADER_PUBLISH_REQ:
+		req, ok := f.(*PublishRequest)
+		if !ok {
+			return ImpossibleError()
+		}
+		return o.handlePublishRequest(conn, req)
+
+	case HEADER_BROADCAST_REQ:
+		req, ok := f.(*BroadcastRequest)
+		if !ok {
+			return ImpossibleError()
+		}
+		return o.handleBroadcastRequest(conn, req)
+
+	case HEADER_CALL_REQ:
+		req, ok := f.(*CallRequest)
+		if !ok {
+			return ImpossibleError()
+		}
+		return o.handleCallRequest(conn, req)
+
+	case HEADER_FIND_REQ:
+		req, ok := f.(*FindRequest)
+		if !ok {
+			return ImpossibleError()
+		}
+		return o.handleFindRequest(conn, req)
 	}
 
 	return fmt.Errorf("Unrecognized header: %d", f.Header())
@@ -251,37 +498,51 @@ func (o *Operator) handleFrame(conn FrameReadWriter, f Frame) error {
 // Creates a listener that will accept tcp connections
 // from the Dial call with the same channelKey
 func RegisterService(operatorAddr, serviceKey, serviceAddr string) error {
-	glog.V(3).Infof("Registering operator service...")
+	return RegisterNetworkService(operatorAddr, serviceKey, NETWORK_TCP, serviceAddr)
+}
+
+// Same as RegisterService, for a service listening on another network
+// than tcp, like a unix socket
+func RegisterNetworkService(operatorAddr, serviceKey, network, serviceAddr string) error {
+	return RegisterCompressedService(operatorAddr, serviceKey, network, serviceAddr, COMPRESSION_NONE)
+}
+
+// Same as RegisterNetworkService, with the channels to that service using
+// that compression over the link when the other end supports it
+func RegisterCompressedService(operatorAddr, serviceKey, network, serviceAddr, compression string) error {
+	logger := DefaultLogger.With(LOG_SERVICE_KEY, serviceKey)
+	logger.Debug("Registering operator service...")
 
 	// Dial the operator
 	conn, err := net.Dial("tcp", operatorAddr)
 	if err != nil {
-		glog.Errorf("Failed to dial operator: %v", err)
+		logger.Error("Failed to dial operator", LOG_ERROR, err)
 		return err
 	}
 
 	bufConn := NewBufferedConnection(conn)
 
 	// Send register request
-	req := &RegisterRequest{serviceAddr, serviceKey}
+	req := &RegisterRequest{serviceAddr, serviceKey, network, compression}
 	_, err = bufConn.SendFrame(req)
 	if err != nil {
-		glog.Errorf("Failed to register with operator: %v", err)
+		logger.Error("Failed to register with operator", LOG_ERROR, err)
 		return err
 	}
 
 	// Read the response frame
 	f, err := bufConn.GetFrame()
 	if err != nil {
-		glog.Errorf("Failed to register service: %v", err)
+		logger.Error("Failed to register service", LOG_ERROR, err)
 		return err
 	} else if f.IsError() {
-		glog.Errorf("Failed to register service: %s", string(f.Content()))
-		return err
+		logger.Error("Failed to register service", LOG_ERROR, string(f.Content()))
+		conn.Close()
+		return fmt.Errorf("%s", string(f.Content()))
 	}
 
 	// Done!
-	glog.V(2).Infof("Successfully registered service: %s (%s)", serviceAddr, serviceKey)
+	logger.Debug("Successfully registered service", "address", serviceAddr)
 	conn.Close()
 
 	return nil
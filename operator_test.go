@@ -0,0 +1,242 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Operators in the same process share no links and no services, even when
+// their devices use the same receiverIDs and service keys
+func TestIsolatedOperators(t *testing.T) {
+	const N = 4
+	servers := make([]*Operator, N)
+	dialers := make([]*Dialer, N)
+	for i := 0; i < N; i++ {
+		name := fmt.Sprintf("isolated-server%d", i)
+		lis := NewPipeListener(name)
+		defer lis.Close()
+
+		servers[i] = NewOperator(name, name)
+		go servers[i].ServeListener(lis)
+
+		device := NewOperator("isolated-device", "isolated-device")
+		device.LinkTransport = lis
+		device.Link(name)
+
+		// Each device answers with its index
+		svc, err := net.Listen("tcp", "127.0.0.1:0")
+		Fatalize(t, err)
+		defer svc.Close()
+		go func(i int) {
+			for {
+				conn, err := svc.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					io.ReadFull(conn, make([]byte, 1))
+					fmt.Fprintf(conn, "%d", i)
+				}()
+			}
+		}(i)
+		device.ServiceResolver.SetService("isolated-echo", svc.Addr().String())
+
+		dialers[i] = NewDialer(StaticOperatorResolver(name))
+		dialers[i].Transport = lis
+	}
+
+	for i, server := range servers {
+		var err error
+		for j := 0; j < 100; j++ {
+			if _, err = server.ConnectionManager.GetLink("isolated-device"); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		Fatalize(t, err)
+
+		links, err := server.listLinks()
+		Fatalize(t, err)
+		assert.Len(t, links, 1, "server %d", i)
+		services, err := server.ServiceResolver.ListServices()
+		Fatalize(t, err)
+		assert.Empty(t, services, "server %d", i)
+	}
+
+	for i, dialer := range dialers {
+		conn, err := dialer.Dial("isolated-device", "isolated-echo")
+		Fatalize(t, err)
+		_, err = conn.Write([]byte("?"))
+		Fatalize(t, err)
+		answer := make([]byte, 1)
+		_, err = io.ReadFull(conn, answer)
+		Fatalize(t, err)
+		assert.Equal(t, fmt.Sprintf("%d", i), string(answer))
+		conn.Close()
+	}
+
+	// Disconnecting a device only takes down the link of its own operator
+	l, err := servers[0].ConnectionManager.GetLink("isolated-device")
+	Fatalize(t, err)
+	Fatalize(t, servers[0].disconnect(l, "Kicked"))
+	for i := 0; i < 100; i++ {
+		if current, err := servers[0].ConnectionManager.GetLink("isolated-device"); err != nil || current != l {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	current, err := servers[0].ConnectionManager.GetLink("isolated-device")
+	assert.True(t, err != nil || current != l)
+	for _, server := range servers[1:] {
+		_, err := server.ConnectionManager.GetLink("isolated-device")
+		assert.NoError(t, err)
+	}
+}
+
+// Serves a server on an in-memory listener and links a device to it. Returns
+// once the server has the link, with a dialer of the server.
+func newTestNetwork(t *testing.T, name string) (*Operator, *Operator, *Dialer) {
+	lis := NewPipeListener(name + "-server")
+	t.Cleanup(func() { lis.Close() })
+	server := NewOperator(name+"-server", name+"-server")
+	go server.ServeListener(lis)
+
+	device := NewOperator(name+"-device", name+"-device")
+	device.LinkTransport = lis
+	device.Link(server.Address)
+	waitTestLink(t, server, device.ReceiverID)
+
+	dialer := NewDialer(StaticOperatorResolver(server.Address))
+	dialer.Transport = lis
+	return server, device, dialer
+}
+
+// Waits for the server to have the link of that receiver
+func waitTestLink(t *testing.T, server *Operator, receiverID string) *Link {
+	var l *Link
+	var err error
+	for i := 0; i < 500; i++ {
+		if l, err = server.ConnectionManager.GetLink(receiverID); err == nil {
+			return l
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s did not link: %v", receiverID, err)
+	return nil
+}
+
+// Serves the handler on a loopback port registered under that service key
+func serveTestService(t *testing.T, device *Operator, serviceKey string, handler func(net.Conn)) {
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	t.Cleanup(func() { svc.Close() })
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	device.ServiceResolver.SetService(serviceKey, svc.Addr().String())
+}
+
+func echoHandler(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+func TestAllowedSocketPaths(t *testing.T) {
+	o := NewOperator("sockets", "sockets")
+	assert.Error(t, o.checkServiceNetwork(NETWORK_UNIX, "/var/run/docker.sock"), "nothing allowed by default")
+
+	o.AllowedSocketPaths = []string{"/var/run/docker.sock", "/run/agent/*.sock"}
+	for _, path := range []string{"/var/run/docker.sock", "/run/agent/a.sock", "/run/agent/../agent/b.sock"} {
+		assert.NoError(t, o.checkServiceNetwork(NETWORK_UNIX, path), path)
+		assert.NoError(t, o.checkServiceNetwork(NETWORK_UNIXPACKET, path), path)
+	}
+	for _, path := range []string{"/var/run/other.sock", "/run/agent/sub/a.sock", "/run/agent/../../etc/x.sock", "run/agent/a.sock"} {
+		assert.Error(t, o.checkServiceNetwork(NETWORK_UNIX, path), path)
+	}
+	assert.NoError(t, o.checkServiceNetwork(NETWORK_TCP, "localhost:22"))
+	assert.Error(t, o.checkServiceNetwork("udp", "localhost:53"))
+
+	// Registrations of sockets that are not allowed get refused
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer lis.Close()
+	go o.ServeListener(lis)
+	err = RegisterNetworkService(lis.Addr().String(), "docker", NETWORK_UNIX, "/var/run/docker.sock")
+	Fatalize(t, err)
+	err = RegisterNetworkService(lis.Addr().String(), "shadow", NETWORK_UNIX, "/etc/shadow")
+	assert.Error(t, err)
+	host, found, err := o.ServiceResolver.GetService("docker")
+	Fatalize(t, err)
+	assert.True(t, found)
+	assert.Equal(t, JoinServiceAddress(NETWORK_UNIX, "/var/run/docker.sock"), host)
+	_, found, _ = o.ServiceResolver.GetService("shadow")
+	assert.False(t, found)
+}
+
+// A tcp registration cannot smuggle in a socket the operator does not allow
+func TestSocketPathBypass(t *testing.T) {
+	o := NewOperator("bypass", "bypass")
+	assert.Error(t, o.checkServiceNetwork(NETWORK_TCP, "unix:///var/run/docker.sock"))
+
+	// Older registrations only carry a tcp host
+	legacy := &RegisterRequest{}
+	Fatalize(t, legacy.Parse("unix:///var/run/docker.sock,docker"))
+	assert.Error(t, o.checkServiceNetwork(legacy.serviceNetwork, legacy.serviceHost))
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer lis.Close()
+	go o.ServeListener(lis)
+	err = RegisterNetworkService(lis.Addr().String(), "docker", NETWORK_TCP, "unix:///var/run/docker.sock")
+	assert.Error(t, err)
+	_, found, _ := o.ServiceResolver.GetService("docker")
+	assert.False(t, found)
+}
+
+// Sockets are checked again when they get dialed
+func TestSocketPathCheckedOnDial(t *testing.T) {
+	_, device, dialer := newTestNetwork(t, "sockdial")
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	svc, err := net.Listen(NETWORK_UNIX, path)
+	Fatalize(t, err)
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go echoHandler(conn)
+		}
+	}()
+	device.ServiceResolver.SetService("agent", JoinServiceAddress(NETWORK_UNIX, path))
+
+	_, err = dialer.Dial(device.ReceiverID, "agent")
+	assert.Error(t, err)
+
+	device.AllowedSocketPaths = []string{path}
+	conn, err := dialer.Dial(device.ReceiverID, "agent")
+	Fatalize(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	Fatalize(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
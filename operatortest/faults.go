@@ -0,0 +1,105 @@
+package operatortest
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// The faults of the links of a device, that can change while they run
+type faults struct {
+	lock     sync.Mutex
+	latency  time.Duration
+	dropRate float64
+}
+
+func (f *faults) setLatency(latency time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.latency = latency
+}
+
+func (f *faults) setDropRate(rate float64) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.dropRate = rate
+}
+
+// Returns the latency to add to a write, or false when it gets dropped
+func (f *faults) next() (time.Duration, bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.dropRate > 0 && rand.Float64() < f.dropRate {
+		return 0, false
+	}
+	return f.latency, true
+}
+
+type delayedWrite struct {
+	data []byte
+	at   time.Time
+}
+
+// faultyConn delays or drops its writes. Operators send every frame in a
+// single write, so frames get delayed or dropped as a whole. Delayed writes
+// keep their order.
+type faultyConn struct {
+	net.Conn
+	faults *faults
+	writes chan delayedWrite
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newFaultyConn(conn net.Conn, f *faults) net.Conn {
+	c := &faultyConn{}
+	c.Conn = conn
+	c.faults = f
+	c.writes = make(chan delayedWrite, 1024)
+	c.done = make(chan struct{})
+	go c.writeForever()
+	return c
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	// A closed connection never takes writes, even with room in the queue
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	latency, ok := c.faults.next()
+	if !ok {
+		return len(p), nil
+	}
+
+	w := delayedWrite{append([]byte{}, p...), time.Now().Add(latency)}
+	select {
+	case c.writes <- w:
+		return len(p), nil
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *faultyConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *faultyConn) writeForever() {
+	for {
+		select {
+		case w := <-c.writes:
+			time.Sleep(time.Until(w.at))
+			if _, err := c.Conn.Write(w.data); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package operatortest
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/apourchet/operator"
+)
+
+// Returns a logger that logs to the test, only shown when it fails or runs
+// with -v. It goes quiet once the test ends, since operators keep running.
+func NewLogger(t testing.TB) operator.Logger {
+	l := &testLogger{t: t, state: &loggerState{}}
+	t.Cleanup(func() {
+		l.state.lock.Lock()
+		defer l.state.lock.Unlock()
+		l.state.done = true
+	})
+	return l
+}
+
+type loggerState struct {
+	lock sync.Mutex
+	done bool
+}
+
+type testLogger struct {
+	t      testing.TB
+	state  *loggerState
+	fields []interface{}
+}
+
+func (l *testLogger) Debug(msg string, fields ...interface{}) { l.log("DEBUG", msg, fields) }
+func (l *testLogger) Info(msg string, fields ...interface{})  { l.log("INFO", msg, fields) }
+func (l *testLogger) Warn(msg string, fields ...interface{})  { l.log("WARN", msg, fields) }
+func (l *testLogger) Error(msg string, fields ...interface{}) { l.log("ERROR", msg, fields) }
+
+func (l *testLogger) With(fields ...interface{}) operator.Logger {
+	joined := make([]interface{}, 0, len(l.fields)+len(fields))
+	joined = append(joined, l.fields...)
+	return &testLogger{l.t, l.state, append(joined, fields...)}
+}
+
+func (l *testLogger) log(level, msg string, fields []interface{}) {
+	line := []string{level, msg}
+	fields = append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	for i := 0; i+1 < len(fields); i += 2 {
+		line = append(line, fmt.Sprintf("%v=%v", fields[i], fields[i+1]))
+	}
+
+	l.state.lock.Lock()
+	defer l.state.lock.Unlock()
+	if !l.state.done {
+		l.t.Log(strings.Join(line, " "))
+	}
+}
@@ -0,0 +1,270 @@
+// Package operatortest runs servers, devices, services and dialers in the
+// same process, linked over in-memory connections, for the integration tests
+// of the link -> dial -> tunnel -> service path. The links of a device can be
+// given latency, drop frames, or be disconnected.
+//
+//	server := operatortest.NewServer(t, "server")
+//	device := server.NewDevice("phone")
+//	device.Serve("echo", operatortest.EchoHandler)
+//	conn, err := server.NewDialer().Dial("phone", "echo")
+package operatortest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apourchet/operator"
+)
+
+// How long the helpers wait for links before failing the test
+var WaitTimeout = 10 * time.Second
+
+// Server is an operator that devices link to and dialers dial through,
+// served on an in-memory listener
+type Server struct {
+	*operator.Operator
+	t        testing.TB
+	listener *listener
+	resolver *resolver
+}
+
+// Creates the server and serves it until the end of the test
+func NewServer(t testing.TB, receiverID string) *Server {
+	s := &Server{}
+	s.t = t
+	s.listener = newListener(receiverID)
+	s.resolver = newResolver()
+	s.Operator = operator.NewOperator(receiverID, receiverID)
+	s.Operator.OperatorResolver = s.resolver
+	s.Operator.Logger = NewLogger(t).With("operator", receiverID)
+	go s.Operator.ServeListener(s.listener)
+	t.Cleanup(func() { s.listener.Close() })
+	return s
+}
+
+// Creates a device linked to the server. Returns once the server has its link
+// and knows what the device handles.
+func (s *Server) NewDevice(receiverID string) *Device {
+	d := &Device{}
+	d.t = s.t
+	d.server = s
+	d.faults = &faults{}
+	d.Operator = operator.NewOperator(receiverID, receiverID)
+	d.Operator.OperatorResolver = s.resolver
+	d.Operator.LinkTransport = operator.LinkDialer(d.dialServer)
+	d.Operator.Logger = NewLogger(s.t).With("device", receiverID)
+	s.t.Cleanup(d.close)
+
+	d.Operator.Link(s.Address)
+	l := s.WaitLink(receiverID)
+	deadline := time.Now().Add(WaitTimeout)
+	for len(l.Compressions()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	return d
+}
+
+// Creates a dialer that dials the devices of the server
+func (s *Server) NewDialer() *operator.Dialer {
+	d := operator.NewDialer(s.resolver)
+	d.Transport = operator.LinkDialer(func(operatorAddr string) (net.Conn, error) {
+		local, remote := operator.NewPipe(operator.ServiceAddr("dialer"), s.listener.Addr())
+		if err := s.listener.push(remote); err != nil {
+			return nil, err
+		}
+		return local, nil
+	})
+	d.Logger = NewLogger(s.t).With("dialer", s.ReceiverID)
+	return d
+}
+
+// Waits for the server to have a link to the receiver and returns it.
+// Fails the test when it does not link in time.
+func (s *Server) WaitLink(receiverID string) *operator.Link {
+	return s.waitLink(receiverID, nil)
+}
+
+// Same as WaitLink, waiting for a link that replaced the previous one
+func (s *Server) WaitRelink(previous *operator.Link) *operator.Link {
+	return s.waitLink(previous.ReceiverID, previous)
+}
+
+func (s *Server) waitLink(receiverID string, previous *operator.Link) *operator.Link {
+	s.t.Helper()
+	deadline := time.Now().Add(WaitTimeout)
+	for time.Now().Before(deadline) {
+		l, err := s.ConnectionManager.GetLink(receiverID)
+		if err == nil && l != previous {
+			return l
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.t.Fatalf("Receiver %s did not link to %s within %v", receiverID, s.ReceiverID, WaitTimeout)
+	return nil
+}
+
+// Device is an operator linked to a Server, whose link connections
+// the test controls
+type Device struct {
+	*operator.Operator
+	t         testing.TB
+	server    *Server
+	faults    *faults
+	lock      sync.Mutex
+	conns     []net.Conn
+	listeners []net.Listener
+}
+
+// Serves the service on a loopback port of the device, calling the handler
+// with every connection it accepts. The handler does not have to close it.
+func (d *Device) Serve(serviceKey string, handler func(conn net.Conn)) {
+	d.t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		d.t.Fatalf("Failed to serve %s: %v", serviceKey, err)
+	}
+	d.lock.Lock()
+	d.listeners = append(d.listeners, lis)
+	d.lock.Unlock()
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	d.ServiceResolver.SetService(serviceKey, lis.Addr().String())
+}
+
+// Adds that much latency to every frame going through the link, both ways
+func (d *Device) SetLatency(latency time.Duration) {
+	d.faults.setLatency(latency)
+}
+
+// Drops every frame going through the link with that probability, both ways.
+// Frames are never corrupted, only lost as a whole.
+func (d *Device) SetDropRate(rate float64) {
+	d.faults.setDropRate(rate)
+}
+
+// Breaks the connection of the link, as a network failure would. The device
+// links again on its own, see Server.WaitRelink.
+func (d *Device) Disconnect() {
+	d.lock.Lock()
+	conns := d.conns
+	d.conns = nil
+	d.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Opens a link connection to the server, with the faults of the device
+func (d *Device) dialServer(operatorAddr string) (net.Conn, error) {
+	if operatorAddr != d.server.Address {
+		return nil, fmt.Errorf("Unknown operator: %s", operatorAddr)
+	}
+	local, remote := operator.NewPipe(operator.ServiceAddr(d.ReceiverID), d.server.listener.Addr())
+	local, remote = newFaultyConn(local, d.faults), newFaultyConn(remote, d.faults)
+
+	d.lock.Lock()
+	d.conns = append(d.conns, local, remote)
+	d.lock.Unlock()
+	if err := d.server.listener.push(remote); err != nil {
+		return nil, err
+	}
+	return local, nil
+}
+
+func (d *Device) close() {
+	d.lock.Lock()
+	listeners := d.listeners
+	d.listeners = nil
+	d.lock.Unlock()
+	for _, lis := range listeners {
+		lis.Close()
+	}
+	d.Disconnect()
+}
+
+// Writes back everything it reads
+func EchoHandler(conn net.Conn) {
+	io.Copy(conn, conn)
+}
+
+// Accepts the connections pushed to it
+type listener struct {
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newListener(name string) *listener {
+	return &listener{name, make(chan net.Conn), make(chan struct{}), sync.Once{}}
+}
+
+func (lis *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-lis.conns:
+		return conn, nil
+	case <-lis.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (lis *listener) Close() error {
+	lis.once.Do(func() { close(lis.done) })
+	return nil
+}
+
+func (lis *listener) Addr() net.Addr {
+	return operator.ServiceAddr(lis.name)
+}
+
+func (lis *listener) push(conn net.Conn) error {
+	select {
+	case lis.conns <- conn:
+		return nil
+	case <-lis.done:
+		conn.Close()
+		return net.ErrClosed
+	}
+}
+
+// Resolves the devices of one server, and no others
+type resolver struct {
+	operators map[string]string
+	lock      sync.Mutex
+}
+
+func newResolver() *resolver {
+	return &resolver{operators: map[string]string{}}
+}
+
+func (r *resolver) ResolveOperator(receiverID string) (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	host, found := r.operators[receiverID]
+	if !found {
+		return "", fmt.Errorf("Operator not found")
+	}
+	return host, nil
+}
+
+func (r *resolver) SetOperator(receiverID string, host string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.operators[receiverID] = host
+	return nil
+}
@@ -0,0 +1,158 @@
+package operatortest
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/stretchr/testify/assert"
+)
+
+func echo(t *testing.T, conn net.Conn, msg string) time.Duration {
+	start := time.Now()
+	_, err := conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, msg, string(buf))
+	return time.Since(start)
+}
+
+func TestDial(t *testing.T) {
+	server := NewServer(t, "server")
+	for _, receiverID := range []string{"phone1", "phone2"} {
+		server.NewDevice(receiverID).Serve("echo", EchoHandler)
+	}
+
+	dialer := server.NewDialer()
+	for _, receiverID := range []string{"phone1", "phone2"} {
+		conn, err := dialer.Dial(receiverID, "echo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "hello "+receiverID)
+		conn.Close()
+	}
+
+	_, err := dialer.Dial("phone3", "echo")
+	assert.Error(t, err)
+}
+
+func TestLatency(t *testing.T) {
+	server := NewServer(t, "server")
+	device := server.NewDevice("phone")
+	device.Serve("echo", EchoHandler)
+
+	conn, err := server.NewDialer().Dial("phone", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	device.SetLatency(50 * time.Millisecond)
+	assert.True(t, echo(t, conn, "slow") >= 100*time.Millisecond)
+	device.SetLatency(0)
+	assert.True(t, echo(t, conn, "fast") < 100*time.Millisecond)
+}
+
+func TestDrops(t *testing.T) {
+	server := NewServer(t, "server")
+	device := server.NewDevice("phone")
+	device.Serve("echo", EchoHandler)
+
+	conn, err := server.NewDialer().Dial("phone", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	device.SetDropRate(1)
+	_, err = conn.Write([]byte("lost"))
+	assert.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 4))
+	assert.Error(t, err)
+
+	conn.SetReadDeadline(time.Time{})
+	device.SetDropRate(0)
+	echo(t, conn, "kept")
+}
+
+func TestDisconnect(t *testing.T) {
+	server := NewServer(t, "server")
+	device := server.NewDevice("phone")
+	device.Serve("echo", EchoHandler)
+	l := server.WaitLink("phone")
+
+	device.Disconnect()
+	server.WaitRelink(l)
+
+	conn, err := server.NewDialer().Dial("phone", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "back")
+	conn.Close()
+}
+
+func TestCompression(t *testing.T) {
+	server := NewServer(t, "server")
+	device := server.NewDevice("phone")
+	device.Serve("echo", EchoHandler)
+	device.Serve("plain", EchoHandler)
+	if err := device.SetServiceCompression("echo", operator.COMPRESSION_DEFLATE); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, device.SetServiceCompression("echo", "lz4"))
+
+	dialer := server.NewDialer()
+	compressed, err := dialer.Dial("phone", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	plain, err := dialer.Dial("phone", "plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+
+	// The compressor keeps its window from one message to the next
+	for i := 0; i < 10; i++ {
+		echo(t, compressed, strings.Repeat("compressible ", 100))
+		echo(t, plain, strings.Repeat("plain ", 100))
+	}
+
+	// Both ways, once the last echo got counted
+	l := server.WaitLink("phone")
+	echoed := int64(2 * 10 * len(strings.Repeat("compressible ", 100)))
+	assert.Eventually(t, func() bool {
+		for _, channel := range l.Channels() {
+			if channel.Compression != "" && channel.Bytes == echoed {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond)
+
+	channels := l.Channels()
+	if !assert.Len(t, channels, 2) {
+		return
+	}
+	for _, channel := range channels {
+		if channel.Compression == "" {
+			assert.Equal(t, 1.0, channel.Ratio)
+		} else {
+			assert.Equal(t, operator.COMPRESSION_DEFLATE, channel.Compression)
+			assert.True(t, channel.Ratio > 10, "ratio %v", channel.Ratio)
+		}
+	}
+}
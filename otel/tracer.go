@@ -0,0 +1,99 @@
+// Package otel traces the dials of an operator with OpenTelemetry.
+package otel
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apourchet/operator"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The instrumentation name of the spans
+const TRACER_NAME = "github.com/apourchet/operator"
+
+// Tracer implements operator.Tracer with OpenTelemetry. The trace context
+// travels in frames as W3C traceparent and tracestate.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TraceContext
+}
+
+// Creates the spans with that provider, usually otel.GetTracerProvider()
+func NewTracer(provider trace.TracerProvider) *Tracer {
+	return &Tracer{tracer: provider.Tracer(TRACER_NAME)}
+}
+
+// Returns a tracer that keeps its spans in memory, for tests
+func NewInMemoryTracer() (*Tracer, *tracetest.InMemoryExporter) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	return NewTracer(provider), exporter
+}
+
+func (t *Tracer) Start(ctx context.Context, name string, fields ...interface{}) (context.Context, operator.Span) {
+	ctx, span := t.tracer.Start(ctx, name, trace.WithAttributes(attributes(fields)...))
+	return ctx, &otelSpan{span}
+}
+
+func (t *Tracer) Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	t.propagator.Inject(ctx, carrier)
+	traceParent := carrier.Get("traceparent")
+	if traceParent == "" {
+		return ""
+	}
+	if traceState := carrier.Get("tracestate"); traceState != "" {
+		return traceParent + ";" + traceState
+	}
+	return traceParent
+}
+
+func (t *Tracer) Extract(ctx context.Context, traceContext string) context.Context {
+	if traceContext == "" {
+		return ctx
+	}
+	split := strings.SplitN(traceContext, ";", 2)
+	carrier := propagation.MapCarrier{"traceparent": split[0]}
+	if len(split) == 2 {
+		carrier.Set("tracestate", split[1])
+	}
+	return t.propagator.Extract(ctx, carrier)
+}
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s *otelSpan) End(err error) {
+	if err != nil {
+		s.span.RecordError(err)
+		s.span.SetStatus(codes.Error, err.Error())
+	}
+	s.span.End()
+}
+
+// Turns alternating keys and values into span attributes
+func attributes(fields []interface{}) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		switch value := fields[i+1].(type) {
+		case string:
+			attrs = append(attrs, attribute.String(key, value))
+		case int:
+			attrs = append(attrs, attribute.Int(key, value))
+		case bool:
+			attrs = append(attrs, attribute.Bool(key, value))
+		default:
+			attrs = append(attrs, attribute.String(key, fmt.Sprint(value)))
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,88 @@
+package otel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestDialTrace(t *testing.T) {
+	tracer, exporter := NewInMemoryTracer()
+
+	lis := operator.NewPipeListener("trace-server")
+	defer lis.Close()
+
+	server := operator.NewOperator("trace-server", "trace-server")
+	server.Tracer = tracer
+	go server.ServeListener(lis)
+
+	device := operator.NewOperator("trace-device", "trace-device")
+	device.Tracer = tracer
+	device.LinkTransport = lis
+	device.Link("trace-server")
+
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	device.ServiceResolver.SetService("echo", svc.Addr().String())
+
+	for i := 0; i < 100; i++ {
+		if _, err = server.ConnectionManager.GetLink("trace-device"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dialer := operator.NewDialer(nil)
+	dialer.Transport = lis
+	dialer.Tracer = tracer
+	conn, err := dialer.Dial("trace-device", "echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	dial := spans[operator.SPAN_DIAL]
+	for _, name := range []string{
+		operator.SPAN_RESOLVE,
+		operator.SPAN_CONNECT,
+		operator.SPAN_DIAL_REQUEST,
+		operator.SPAN_TUNNEL,
+		operator.SPAN_SERVICE_CONNECT,
+	} {
+		span, found := spans[name]
+		if assert.True(t, found, name) {
+			assert.Equal(t, dial.SpanContext.TraceID(), span.SpanContext.TraceID(), name)
+		}
+	}
+
+	// Each side joins the span of the side that sent the frame
+	assert.Equal(t, dial.SpanContext.SpanID(), spans[operator.SPAN_DIAL_REQUEST].Parent.SpanID())
+	assert.Equal(t, spans[operator.SPAN_DIAL_REQUEST].SpanContext.SpanID(), spans[operator.SPAN_TUNNEL].Parent.SpanID())
+	assert.True(t, spans[operator.SPAN_TUNNEL].Parent.IsRemote())
+	assert.Equal(t, spans[operator.SPAN_TUNNEL].SpanContext.SpanID(), spans[operator.SPAN_SERVICE_CONNECT].Parent.SpanID())
+}
@@ -0,0 +1,189 @@
+package operator
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// How many bytes one direction of an in-memory pipe holds before its writes
+// wait for the other end to read
+const PIPE_BUFFER_SIZE = 1024 * 1024
+
+// pipeBuffer is one direction of an in-memory pipe. Writes only block once
+// PIPE_BUFFER_SIZE bytes wait to be read, reads block until data is
+// available. Both stop when the buffer is closed or their deadline expires.
+type pipeBuffer struct {
+	lock          sync.Mutex
+	cond          *sync.Cond
+	data          bytes.Buffer // Reuses its memory once read
+	closed        bool
+	readDeadline  pipeDeadline
+	writeDeadline pipeDeadline
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *pipeBuffer) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.data.Len() == 0 {
+		if b.closed {
+			return 0, io.EOF
+		}
+		if b.readDeadline.expired() {
+			return 0, os.ErrDeadlineExceeded
+		}
+		b.cond.Wait()
+	}
+	n, err := b.data.Read(p)
+	b.cond.Broadcast()
+	return n, err
+}
+
+func (b *pipeBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := 0
+	for len(p) > 0 {
+		if b.closed {
+			return n, io.ErrClosedPipe
+		}
+		if b.writeDeadline.expired() {
+			return n, os.ErrDeadlineExceeded
+		}
+		room := PIPE_BUFFER_SIZE - b.data.Len()
+		if room <= 0 {
+			b.cond.Wait()
+			continue
+		}
+		chunk := min(room, len(p))
+		b.data.Write(p[:chunk])
+		p = p[chunk:]
+		n += chunk
+		b.cond.Broadcast()
+	}
+	return n, nil
+}
+
+func (b *pipeBuffer) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+func (b *pipeBuffer) setReadDeadline(t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.readDeadline.set(t, b.cond)
+}
+
+func (b *pipeBuffer) setWriteDeadline(t time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.writeDeadline.set(t, b.cond)
+}
+
+// A deadline of a pipe buffer, that wakes up whoever waits on the buffer
+// when it expires. Used with the lock of the buffer held.
+type pipeDeadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *pipeDeadline) set(t time.Time, cond *sync.Cond) {
+	d.t = t
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if wait := time.Until(t); !t.IsZero() && wait > 0 {
+		d.timer = time.AfterFunc(wait, func() {
+			cond.L.Lock()
+			defer cond.L.Unlock()
+			cond.Broadcast()
+		})
+	}
+	cond.Broadcast()
+}
+
+func (d *pipeDeadline) expired() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+// pipeConn is one end of an in-memory, buffered, full-duplex connection.
+// Unlike net.Pipe, a write does not wait for the other end to read it,
+// up to PIPE_BUFFER_SIZE bytes.
+type pipeConn struct {
+	reader *pipeBuffer
+	writer *pipeBuffer
+	local  net.Addr
+	remote net.Addr
+	lock   sync.Mutex
+	closed bool
+}
+
+// Creates both ends of an in-memory connection. Like net.Pipe, but writes
+// get buffered instead of waiting for the other end to read them, until
+// the buffer is full.
+func NewPipe(local, remote net.Addr) (net.Conn, net.Conn) {
+	a, b := newPipeBuffer(), newPipeBuffer()
+	c1 := &pipeConn{reader: a, writer: b, local: local, remote: remote}
+	c2 := &pipeConn{reader: b, writer: a, local: remote, remote: local}
+	return c1, c2
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	return c.reader.Read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	return c.writer.Write(p)
+}
+
+func (c *pipeConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.lock.Unlock()
+	c.reader.Close()
+	c.writer.Close()
+	return nil
+}
+
+func (c *pipeConn) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.reader.setReadDeadline(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writer.setWriteDeadline(t)
+	return nil
+}
@@ -0,0 +1,68 @@
+package operator
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := NewPipe(ServiceAddr("a"), ServiceAddr("b"))
+	assert.Equal(t, "b", a.RemoteAddr().String())
+	assert.Equal(t, "a", b.RemoteAddr().String())
+
+	// Writes do not wait for the other end to read
+	_, err := a.Write([]byte("hello"))
+	Fatalize(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(b, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	// Read deadlines
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = b.Read(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	b.SetReadDeadline(time.Time{})
+
+	// The other end reads what was written before closing, then EOF
+	a.Write([]byte("bye"))
+	a.Close()
+	_, err = io.ReadFull(b, buf[:3])
+	Fatalize(t, err)
+	_, err = b.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = a.Write([]byte("closed"))
+	assert.Error(t, err)
+}
+
+func TestPipeBufferFull(t *testing.T) {
+	a, b := NewPipe(ServiceAddr("a"), ServiceAddr("b"))
+	defer a.Close()
+	_, err := a.Write(make([]byte, PIPE_BUFFER_SIZE))
+	Fatalize(t, err)
+
+	// Past the buffer, writes wait for the reader, or their deadline
+	a.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+	n, err := a.Write([]byte("more"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, 0, n)
+	a.SetWriteDeadline(time.Time{})
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := a.Write([]byte("more"))
+		written <- err
+	}()
+	select {
+	case <-written:
+		t.Fatal("Write did not wait for the reader")
+	case <-time.After(10 * time.Millisecond):
+	}
+	_, err = io.ReadFull(b, make([]byte, 1024))
+	Fatalize(t, err)
+	Fatalize(t, <-written)
+}
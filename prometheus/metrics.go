@@ -0,0 +1,205 @@
+// Package prometheus exports the metrics of an operator to prometheus.
+package prometheus
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apourchet/operator"
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics implements operator.Metrics with prometheus collectors
+type Metrics struct {
+	Registry *prom.Registry
+
+	// Also reports the channels and last round-trip time of every link under
+	// its receiver_id. That is one series per device, so only for small fleets.
+	PerReceiver bool
+
+	framesSent     *prom.CounterVec
+	framesReceived *prom.CounterVec
+	bytes          *prom.CounterVec
+	dialLatency    prom.Histogram
+	tunnelErrors   *prom.CounterVec
+	heartbeatRTT   prom.Histogram
+
+	rtts    map[string]time.Duration // Last round-trip time of each receiver
+	rttLock sync.Mutex
+}
+
+// Creates the metrics of an operator. The link gauges are read from
+// the connection manager every time the metrics get scraped, if it is
+// an operator.LinkManager that can list them.
+func NewMetrics(connections operator.ConnectionManager) *Metrics {
+	m := &Metrics{}
+	m.Registry = prom.NewRegistry()
+	m.rtts = map[string]time.Duration{}
+
+	m.framesSent = prom.NewCounterVec(prom.CounterOpts{
+		Name: "operator_frames_sent_total",
+		Help: "Frames sent, by header type.",
+	}, []string{"header"})
+	m.framesReceived = prom.NewCounterVec(prom.CounterOpts{
+		Name: "operator_frames_received_total",
+		Help: "Frames received, by header type.",
+	}, []string{"header"})
+	m.bytes = prom.NewCounterVec(prom.CounterOpts{
+		Name: "operator_bytes_total",
+		Help: "Bytes going through connections, by direction.",
+	}, []string{"direction"})
+	m.dialLatency = prom.NewHistogram(prom.HistogramOpts{
+		Name:    "operator_dial_latency_seconds",
+		Help:    "Time for a dial request to get its channel through the link.",
+		Buckets: prom.ExponentialBuckets(0.005, 2, 12),
+	})
+	m.tunnelErrors = prom.NewCounterVec(prom.CounterOpts{
+		Name: "operator_tunnel_errors_total",
+		Help: "Failed dial and tunnel requests, by reason.",
+	}, []string{"reason"})
+	m.heartbeatRTT = prom.NewHistogram(prom.HistogramOpts{
+		Name:    "operator_heartbeat_rtt_seconds",
+		Help:    "Round-trip time of pings over links.",
+		Buckets: prom.ExponentialBuckets(0.005, 2, 12),
+	})
+
+	m.Registry.MustRegister(m.framesSent, m.framesReceived, m.bytes,
+		m.dialLatency, m.tunnelErrors, m.heartbeatRTT, newLinkCollector(connections, m))
+	return m
+}
+
+func (m *Metrics) FrameSent(header byte) {
+	m.framesSent.WithLabelValues(operator.HeaderName(header)).Inc()
+}
+
+func (m *Metrics) FrameReceived(header byte) {
+	m.framesReceived.WithLabelValues(operator.HeaderName(header)).Inc()
+}
+
+func (m *Metrics) BytesSent(n int) {
+	m.bytes.WithLabelValues("sent").Add(float64(n))
+}
+
+func (m *Metrics) BytesReceived(n int) {
+	m.bytes.WithLabelValues("received").Add(float64(n))
+}
+
+func (m *Metrics) DialLatency(d time.Duration) {
+	m.dialLatency.Observe(d.Seconds())
+}
+
+func (m *Metrics) TunnelError(reason string) {
+	m.tunnelErrors.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) HeartbeatRTT(receiverID string, d time.Duration) {
+	m.heartbeatRTT.Observe(d.Seconds())
+	if !m.PerReceiver {
+		return
+	}
+	m.rttLock.Lock()
+	defer m.rttLock.Unlock()
+	m.rtts[receiverID] = d
+}
+
+// Returns the last round-trip times of the linked receivers, and forgets
+// those of the others
+func (m *Metrics) linkRTTs(linked map[string]bool) map[string]time.Duration {
+	m.rttLock.Lock()
+	defer m.rttLock.Unlock()
+	rtts := map[string]time.Duration{}
+	for receiverID, rtt := range m.rtts {
+		if !linked[receiverID] {
+			delete(m.rtts, receiverID)
+			continue
+		}
+		rtts[receiverID] = rtt
+	}
+	return rtts
+}
+
+// Returns the handler of the /metrics endpoint
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// Serves the /metrics endpoint on that port
+func (m *Metrics) Serve(port int) error {
+	operator.DefaultLogger.Info("Serving metrics", "port", port)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	if err != nil {
+		operator.DefaultLogger.Error("Failed to serve metrics", operator.LOG_ERROR, err)
+	}
+	return err
+}
+
+// The buckets of the channels per link histogram
+var channelBuckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// Reads the active links and their channels from a ConnectionManager
+type linkCollector struct {
+	connections  operator.ConnectionManager
+	metrics      *Metrics
+	links        *prom.Desc
+	channels     *prom.Desc
+	linkChannels *prom.Desc
+	rtt          *prom.Desc
+}
+
+func newLinkCollector(connections operator.ConnectionManager, metrics *Metrics) *linkCollector {
+	c := &linkCollector{}
+	c.connections = connections
+	c.metrics = metrics
+	c.links = prom.NewDesc("operator_links_active", "Links currently active.", nil, nil)
+	c.channels = prom.NewDesc("operator_channels_per_link", "Channels open through the links.", nil, nil)
+	c.linkChannels = prom.NewDesc("operator_link_channels", "Channels open through each link.", []string{"receiver_id"}, nil)
+	c.rtt = prom.NewDesc("operator_link_rtt_seconds", "Last round-trip time of a ping over each link.", []string{"receiver_id"}, nil)
+	return c
+}
+
+func (c *linkCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.links
+	ch <- c.channels
+	ch <- c.linkChannels
+	ch <- c.rtt
+}
+
+func (c *linkCollector) Collect(ch chan<- prom.Metric) {
+	manager, ok := c.connections.(operator.LinkManager)
+	if !ok {
+		return
+	}
+	links, err := manager.ListLinks()
+	if err != nil {
+		operator.DefaultLogger.Warn("Failed to list links", operator.LOG_ERROR, err)
+		return
+	}
+	ch <- prom.MustNewConstMetric(c.links, prom.GaugeValue, float64(len(links)))
+
+	buckets := map[float64]uint64{}
+	sum := 0
+	linked := map[string]bool{}
+	for _, l := range links {
+		count := l.ChannelCount()
+		sum += count
+		for _, bound := range channelBuckets {
+			if float64(count) <= bound {
+				buckets[bound]++
+			}
+		}
+		linked[l.ReceiverID] = true
+		if c.metrics.PerReceiver {
+			ch <- prom.MustNewConstMetric(c.linkChannels, prom.GaugeValue, float64(count), l.ReceiverID)
+		}
+	}
+	ch <- prom.MustNewConstHistogram(c.channels, uint64(len(links)), float64(sum), buckets)
+
+	for receiverID, rtt := range c.metrics.linkRTTs(linked) {
+		ch <- prom.MustNewConstMetric(c.rtt, prom.GaugeValue, rtt.Seconds(), receiverID)
+	}
+}
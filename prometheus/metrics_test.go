@@ -0,0 +1,62 @@
+package prometheus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apourchet/operator"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the label sets of every series of the registry, by metric name
+func gatherLabels(t *testing.T, m *Metrics) map[string][]map[string]string {
+	families, err := m.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := map[string][]map[string]string{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			series[family.GetName()] = append(series[family.GetName()], labels)
+		}
+	}
+	return series
+}
+
+func TestLinkMetrics(t *testing.T) {
+	lis := operator.NewPipeListener("metrics-server")
+	defer lis.Close()
+	server := operator.NewOperator("metrics-server", "metrics-server")
+	metrics := NewMetrics(server.ConnectionManager)
+	server.Metrics = metrics
+	go server.ServeListener(lis)
+
+	device := operator.NewOperator("metrics-device", "metrics-device")
+	device.LinkTransport = lis
+	device.Link("metrics-server")
+	assert.Eventually(t, func() bool {
+		_, err := server.ConnectionManager.GetLink("metrics-device")
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Links are aggregated by default
+	metrics.HeartbeatRTT("metrics-device", time.Millisecond)
+	series := gatherLabels(t, metrics)
+	assert.Len(t, series["operator_channels_per_link"], 1)
+	assert.Len(t, series["operator_heartbeat_rtt_seconds"], 1)
+	for name, labelSets := range series {
+		for _, labels := range labelSets {
+			assert.NotContains(t, labels, "receiver_id", name)
+		}
+	}
+
+	metrics.PerReceiver = true
+	metrics.HeartbeatRTT("metrics-device", time.Millisecond)
+	series = gatherLabels(t, metrics)
+	assert.Equal(t, []map[string]string{{"receiver_id": "metrics-device"}}, series["operator_link_channels"])
+	assert.Equal(t, []map[string]string{{"receiver_id": "metrics-device"}}, series["operator_link_rtt_seconds"])
+}
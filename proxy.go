@@ -0,0 +1,167 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Headers that only make sense for a single hop and must not
+// be forwarded by the proxy
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxy is an http proxy that routes every request through
+// the operator Dialer. Hosts must be of the form <receiverID>.<serviceKey>[:port]
+// so that HTTPS_PROXY and HTTP_PROXY can point to it.
+type HTTPProxy struct {
+	Dialer    *Dialer
+	transport *http.Transport
+}
+
+func NewHTTPProxy(dialer *Dialer) *HTTPProxy {
+	if dialer == nil {
+		dialer = NewDialer(nil)
+	}
+	p := &HTTPProxy{}
+	p.Dialer = dialer
+	p.transport = &http.Transport{DialContext: dialer.DialContext()}
+	return p
+}
+
+// Serves the http proxy on that port
+func (p *HTTPProxy) Serve(port int) error {
+	p.Dialer.logger().Info("Serving http proxy", "port", port)
+	addr := fmt.Sprintf(":%d", port)
+	err := http.ListenAndServe(addr, p)
+	if err != nil {
+		p.Dialer.logger().Error("Failed to serve http proxy", LOG_ERROR, err)
+	}
+	return err
+}
+
+func (p *HTTPProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+		return
+	}
+	p.handleForward(w, r)
+}
+
+// Handles CONNECT <receiverID>.<serviceKey>:<port> by hijacking the
+// client connection and piping it to the dialed channel
+func (p *HTTPProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	logger := p.Dialer.logger().With("host", r.Host, LOG_REMOTE_ADDR, r.RemoteAddr)
+	logger.Debug("Proxy CONNECT")
+	receiverID, serviceKey, err := ParseAddress(r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	remote, err := p.Dialer.Dial(receiverID, serviceKey)
+	if err != nil {
+		logger.Warn("Proxy failed to dial", LOG_ERROR, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		logger.Warn("Proxy failed to hijack connection", LOG_ERROR, err)
+		remote.Close()
+		return
+	}
+
+	_, err = client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		logger.Warn("Proxy failed to respond to CONNECT", LOG_ERROR, err)
+		client.Close()
+		remote.Close()
+		return
+	}
+
+	// Flush whatever the client already sent after the CONNECT line
+	if n := buf.Reader.Buffered(); n > 0 {
+		pending, _ := buf.Reader.Peek(n)
+		if _, err := remote.Write(pending); err != nil {
+			client.Close()
+			remote.Close()
+			return
+		}
+	}
+
+	splice(client, remote)
+	logger.Debug("Proxy CONNECT closed")
+}
+
+// Handles plain absolute-URI requests by forwarding them through the
+// operator-aware transport
+func (p *HTTPProxy) handleForward(w http.ResponseWriter, r *http.Request) {
+	p.Dialer.logger().Debug("Proxy request", "method", r.Method, "url", r.URL.String(), LOG_REMOTE_ADDR, r.RemoteAddr)
+	if !r.URL.IsAbs() {
+		http.Error(w, "Proxy requests must use an absolute URI", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	removeHopHeaders(out.Header)
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		p.Dialer.logger().Warn("Proxy failed to forward", "host", r.URL.Host, LOG_ERROR, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, h := range hopHeaders {
+		header.Del(h)
+	}
+}
+
+// Copies data both ways until one side is done, then closes both
+func splice(a, b net.Conn) {
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		a.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		b.Close()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,116 @@
+package operator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestProxy(t *testing.T) *httptest.Server {
+	_, device, dialer := newTestNetwork(t, "proxy")
+	serveTestService(t, device, "echo", echoHandler)
+	serveTestService(t, device, "web", func(conn net.Conn) {
+		http.Serve(&oneConnListener{conn: conn}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+		}))
+	})
+	proxy := httptest.NewServer(NewHTTPProxy(dialer))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	proxy := newTestProxy(t)
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	Fatalize(t, err)
+	defer conn.Close()
+
+	// Bytes sent right after the CONNECT line get through too
+	fmt.Fprintf(conn, "CONNECT proxy-device.echo:80 HTTP/1.1\r\nHost: proxy-device.echo:80\r\n\r\nhello")
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	Fatalize(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(reader, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	proxy := newTestProxy(t)
+	proxyURL, err := url.Parse(proxy.URL)
+	Fatalize(t, err)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := client.Get("http://proxy-device.web/status")
+	Fatalize(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	Fatalize(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "GET /status", string(body))
+
+	// Unknown services fail at the gateway
+	resp, err = client.Get("http://proxy-device.missing/")
+	Fatalize(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestHTTPProxyBadHost(t *testing.T) {
+	proxy := newTestProxy(t)
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	Fatalize(t, err)
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "CONNECT nodot:80 HTTP/1.1\r\nHost: nodot:80\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	Fatalize(t, err)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// Plain requests need an absolute URI
+	resp, err = http.Get(proxy.URL + "/relative")
+	Fatalize(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+// Accepts a single connection, then blocks until it gets closed
+type oneConnListener struct {
+	conn net.Conn
+	done chan struct{}
+}
+
+func (l *oneConnListener) Accept() (net.Conn, error) {
+	if l.conn == nil {
+		<-l.done
+		return nil, net.ErrClosed
+	}
+	conn := &closeNotifyingConn{Conn: l.conn, done: make(chan struct{})}
+	l.conn, l.done = nil, conn.done
+	return conn, nil
+}
+
+func (l *oneConnListener) Close() error   { return nil }
+func (l *oneConnListener) Addr() net.Addr { return ServiceAddr("one") }
+
+type closeNotifyingConn struct {
+	net.Conn
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *closeNotifyingConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,293 @@
+package operator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Maximum number of links a broadcast writes to at the same time
+const BROADCAST_CONCURRENCY = 64
+
+// Delivery stats of a broadcast, summed over the operators of the cluster
+type BroadcastStats struct {
+	MessageID string
+	Operators int // Operators that fanned the message out
+	Delivered int // Subscribed links the message was written to
+	Failed    int // Subscribed links that could not be written to
+}
+
+// The receivers subscribed to each topic on an operator
+type subscriptions struct {
+	topics map[string]map[string]bool
+	lock   sync.Mutex
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{topics: map[string]map[string]bool{}}
+}
+
+func (s *subscriptions) add(topic, receiverID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.topics[topic] == nil {
+		s.topics[topic] = map[string]bool{}
+	}
+	s.topics[topic][receiverID] = true
+}
+
+func (s *subscriptions) remove(topic, receiverID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.topics[topic], receiverID)
+	if len(s.topics[topic]) == 0 {
+		delete(s.topics, topic)
+	}
+}
+
+func (s *subscriptions) removeReceiver(receiverID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for topic, receivers := range s.topics {
+		delete(receivers, receiverID)
+		if len(receivers) == 0 {
+			delete(s.topics, topic)
+		}
+	}
+}
+
+func (s *subscriptions) subscribers(topic string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	receivers := []string{}
+	for receiverID := range s.topics[topic] {
+		receivers = append(receivers, receiverID)
+	}
+	sort.Strings(receivers)
+	return receivers
+}
+
+// Subscribes this device to a topic on every operator it links to. Broadcasts on
+// that topic are handed to the handler like any other message, and while subscribed
+// it also takes the messages of that topic over the one of HandleMessages.
+func (o *Operator) Subscribe(topic string, handler MessageHandlerFunc) {
+	o.messageLock.Lock()
+	if o.topics == nil {
+		o.topics = map[string]MessageHandlerFunc{}
+	}
+	o.topics[topic] = handler
+	uplinks := o.getUplinks()
+	o.messageLock.Unlock()
+
+	for _, uplink := range uplinks {
+		_, err := uplink.SendFrame(&SubscribeFrame{topic})
+		if err != nil {
+			o.Logger.Warn("Failed to subscribe", "topic", topic, LOG_ERROR, err)
+		}
+	}
+}
+
+// Stops receiving the broadcasts of that topic. The handler registered with
+// HandleMessages for that topic, if any, keeps getting its messages.
+func (o *Operator) Unsubscribe(topic string) {
+	o.messageLock.Lock()
+	delete(o.topics, topic)
+	uplinks := o.getUplinks()
+	o.messageLock.Unlock()
+
+	for _, uplink := range uplinks {
+		_, err := uplink.SendFrame(&UnsubscribeFrame{topic})
+		if err != nil {
+			o.Logger.Warn("Failed to unsubscribe", "topic", topic, LOG_ERROR, err)
+		}
+	}
+}
+
+// Must be called with the messageLock held
+func (o *Operator) getUplinks() []FrameWriter {
+	uplinks := []FrameWriter{}
+	for _, uplink := range o.uplinks {
+		uplinks = append(uplinks, uplink)
+	}
+	return uplinks
+}
+
+// Keeps track of a link this device made to an operator, and sends
+// it the current subscriptions
+func (o *Operator) addUplink(host string, conn FrameWriter) {
+	o.messageLock.Lock()
+	if o.uplinks == nil {
+		o.uplinks = map[string]FrameWriter{}
+	}
+	o.uplinks[host] = conn
+	topics := []string{}
+	for topic := range o.topics {
+		topics = append(topics, topic)
+	}
+	o.messageLock.Unlock()
+
+	for _, topic := range topics {
+		_, err := conn.SendFrame(&SubscribeFrame{topic})
+		if err != nil {
+			o.Logger.Warn("Failed to subscribe", "topic", topic, LOG_ERROR, err)
+			return
+		}
+	}
+}
+
+func (o *Operator) removeUplink(host string) {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	delete(o.uplinks, host)
+}
+
+func (o *Operator) handleSubscribe(link *Link, f *SubscribeFrame) error {
+	link.Logger().Debug("Subscribed", "topic", f.topic)
+	o.subscriptions.add(f.topic, link.ReceiverID)
+	return nil
+}
+
+func (o *Operator) handleUnsubscribe(link *Link, f *UnsubscribeFrame) error {
+	link.Logger().Debug("Unsubscribed", "topic", f.topic)
+	o.subscriptions.remove(f.topic, link.ReceiverID)
+	return nil
+}
+
+// Forgets the subscriptions of a receiver once its link is down, unless
+// another link of that receiver replaced it
+func (o *Operator) forgetSubscriptions(l *Link) {
+	if _, err := o.ConnectionManager.GetLink(l.ReceiverID); err == nil {
+		return
+	}
+	o.subscriptions.removeReceiver(l.ReceiverID)
+}
+
+func (o *Operator) handleBroadcastRequest(conn FrameReadWriter, req *BroadcastRequest) error {
+	o.Logger.Debug("Broadcast request", "messageID", req.messageID, "topic", req.topic)
+	stats := o.broadcast(req)
+	_, err := conn.SendFrame(&BroadcastResponse{stats.Operators, stats.Delivered, stats.Failed})
+	return err
+}
+
+// Fans the message out to the links subscribed on this operator, and to
+// the peers of this operator if the request should be forwarded
+func (o *Operator) broadcast(req *BroadcastRequest) *BroadcastStats {
+	stats := &BroadcastStats{MessageID: req.messageID, Operators: 1}
+	lock := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	frame := &MessageFrame{req.messageID, req.topic, req.payload}
+	sem := make(chan bool, BROADCAST_CONCURRENCY)
+	for _, receiverID := range o.subscriptions.subscribers(req.topic) {
+		wg.Add(1)
+		sem <- true
+		go func(receiverID string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := o.sendToLink(receiverID, frame)
+			if err != nil {
+				o.Logger.Debug("Failed to broadcast", "messageID", req.messageID, LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				stats.Failed++
+			} else {
+				stats.Delivered++
+			}
+		}(receiverID)
+	}
+
+	if req.forward {
+		forwarded := &BroadcastRequest{req.messageID, req.topic, false, req.payload}
+		for _, peer := range o.Peers {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				peerStats, err := o.forwardBroadcast(peer, forwarded)
+				if err != nil {
+					o.Logger.Warn("Failed to forward broadcast", "messageID", req.messageID, "peer", peer, LOG_ERROR, err)
+					return
+				}
+
+				lock.Lock()
+				defer lock.Unlock()
+				stats.Operators += peerStats.Operators
+				stats.Delivered += peerStats.Delivered
+				stats.Failed += peerStats.Failed
+			}(peer)
+		}
+	}
+
+	wg.Wait()
+	o.Logger.Debug("Broadcast done", "messageID", req.messageID, "topic", req.topic,
+		"operators", stats.Operators, "delivered", stats.Delivered, "failed", stats.Failed)
+	return stats
+}
+
+// Writes a frame to a linked receiver, and forgets its subscriptions
+// if it is not linked anymore
+func (o *Operator) sendToLink(receiverID string, frame Frame) error {
+	l, err := o.ConnectionManager.GetLink(receiverID)
+	if err != nil {
+		o.subscriptions.removeReceiver(receiverID)
+		return err
+	}
+	_, err = l.stream.SendFrame(frame)
+	return err
+}
+
+func (o *Operator) forwardBroadcast(peer string, req *BroadcastRequest) (*BroadcastStats, error) {
+	conn, err := o.LinkTransport.Dial(peer)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return sendBroadcast(NewBufferedConnection(conn), req)
+}
+
+func sendBroadcast(conn FrameReadWriter, req *BroadcastRequest) (*BroadcastStats, error) {
+	_, err := conn.SendFrame(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := conn.GetFrame()
+	if err != nil {
+		return nil, err
+	} else if resp.IsError() {
+		return nil, fmt.Errorf("%s", string(resp.Content()))
+	}
+
+	cast, ok := resp.(*BroadcastResponse)
+	if !ok {
+		return nil, ImpossibleError()
+	}
+	return &BroadcastStats{req.messageID, cast.operators, cast.delivered, cast.failed}, nil
+}
+
+// Publishes a message once to every device subscribed to that topic. The operator
+// at operatorAddr fans it out to its own links and to its peers. Broadcasts are
+// not stored: devices that are not linked at that time never get the message.
+func (d *Dialer) Broadcast(operatorAddr, topic string, payload []byte) (*BroadcastStats, error) {
+	if strings.Contains(topic, ",") {
+		return nil, fmt.Errorf("Topic cannot contain commas: %s", topic)
+	}
+
+	conn, err := d.Transport.Dial(operatorAddr)
+	if err != nil {
+		d.logger().Error("Failed to dial operator", "operator", operatorAddr, LOG_ERROR, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	req := &BroadcastRequest{NewID(), topic, true, EscapeContent(payload)}
+	stats, err := sendBroadcast(NewBufferedConnection(conn), req)
+	if err != nil {
+		d.logger().Error("Failed to broadcast", "topic", topic, LOG_ERROR, err)
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Waits for the server to have that many subscribers on the topic
+func waitSubscribers(t *testing.T, server *Operator, topic string, count int) {
+	for i := 0; i < 500; i++ {
+		if len(server.subscriptions.subscribers(topic)) == count {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s does not have %d subscribers: %v", topic, count, server.subscriptions.subscribers(topic))
+}
+
+func TestBroadcast(t *testing.T) {
+	server, device, dialer := newTestNetwork(t, "broadcast")
+	received := make(chan *Message, 1)
+	device.Subscribe("news", func(msg *Message) error {
+		received <- msg
+		return nil
+	})
+	waitSubscribers(t, server, "news", 1)
+
+	stats, err := dialer.Broadcast(server.Address, "news", []byte("hello, world"))
+	Fatalize(t, err)
+	assert.Equal(t, 1, stats.Operators)
+	assert.Equal(t, 1, stats.Delivered)
+	assert.Equal(t, 0, stats.Failed)
+	select {
+	case msg := <-received:
+		assert.Equal(t, "news", msg.Topic)
+		assert.Equal(t, "hello, world", string(msg.Payload))
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast not received")
+	}
+
+	// Other topics do not reach the device
+	stats, err = dialer.Broadcast(server.Address, "sports", []byte("score"))
+	Fatalize(t, err)
+	assert.Equal(t, 0, stats.Delivered)
+
+	device.Unsubscribe("news")
+	waitSubscribers(t, server, "news", 0)
+	stats, err = dialer.Broadcast(server.Address, "news", []byte("again"))
+	Fatalize(t, err)
+	assert.Equal(t, 0, stats.Delivered)
+
+	_, err = dialer.Broadcast(server.Address, "bad,topic", []byte("payload"))
+	assert.Error(t, err)
+}
+
+func TestSubscriptionsPrunedOnLinkDown(t *testing.T) {
+	server := NewOperator("prune-server", "prune-server")
+	server.subscriptions.add("news", "gone")
+	server.subscriptions.add("news", "linked")
+	server.ConnectionManager.(LinkManager).AddLink(NewLink(closedConnection{}, "linked"))
+
+	// The link closes right away, which drops it and its subscriptions
+	server.addLink(closedConnection{}, "gone", nil)
+	waitSubscribers(t, server, "news", 1)
+	assert.Equal(t, []string{"linked"}, server.subscriptions.subscribers("news"))
+}
+
+func TestSubscriptionsKeptOnRelink(t *testing.T) {
+	server := NewOperator("relink-server", "relink-server")
+	server.subscriptions.add("news", "phone")
+
+	// The old link of the phone goes down after a new one replaced it
+	old := NewLink(closedConnection{}, "phone")
+	old.setOperator(server)
+	server.ConnectionManager.(LinkManager).AddLink(NewLink(closedConnection{}, "phone"))
+	old.Maintain()
+	assert.Equal(t, []string{"phone"}, server.subscriptions.subscribers("news"))
+}
+
+// Unsubscribing leaves the store-and-forward handler of the topic alone
+func TestUnsubscribeKeepsMessageHandler(t *testing.T) {
+	o := NewOperator("unsubscribe", "unsubscribe")
+	called := ""
+	o.HandleMessages("news", func(msg *Message) error { called = "messages"; return nil })
+	o.Subscribe("news", func(msg *Message) error { called = "subscription"; return nil })
+
+	handler, found := o.getMessageHandler("news")
+	if assert.True(t, found) {
+		handler(&Message{})
+		assert.Equal(t, "subscription", called)
+	}
+
+	o.Unsubscribe("news")
+	handler, found = o.getMessageHandler("news")
+	if assert.True(t, found) {
+		handler(&Message{})
+		assert.Equal(t, "messages", called)
+	}
+}
@@ -1,7 +1,10 @@
 package operator
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"strings"
 	"sync"
 )
 
@@ -42,23 +45,87 @@ func (o *operatorManager) SetOperator(receiverID string, address string) error {
 	return nil
 }
 
+// Resolves every receiver to the same operator
+type StaticOperatorResolver string
+
+func (r StaticOperatorResolver) ResolveOperator(receiverID string) (string, error) {
+	return string(r), nil
+}
+
+func (r StaticOperatorResolver) SetOperator(receiverID string, host string) error {
+	return fmt.Errorf("Cannot set the operator of %s on a static resolver", receiverID)
+}
+
+// Reads a resolver config file: a JSON object of receiverID to operator address
+func LoadOperatorResolver(path string) (OperatorResolver, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	operators := map[string]string{}
+	err = json.Unmarshal(content, &operators)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse resolver config %s: %v", path, err)
+	}
+
+	resolver := &operatorManager{operators: map[string]string{}}
+	for receiverID, addr := range operators {
+		err = resolver.SetOperator(receiverID, addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// The networks a service can be registered on
+const (
+	NETWORK_TCP        = "tcp"
+	NETWORK_UNIX       = "unix"
+	NETWORK_UNIXPACKET = "unixpacket"
+)
+
+// Joins the network and address of a service into the host that gets stored
+// in the ServiceResolver. Tcp addresses are stored as is.
+func JoinServiceAddress(network, address string) string {
+	if network == "" || network == NETWORK_TCP {
+		return address
+	}
+	return network + "://" + address
+}
+
+// Splits a host stored in the ServiceResolver into its network and address
+func SplitServiceAddress(host string) (string, string) {
+	for _, network := range []string{NETWORK_UNIX, NETWORK_UNIXPACKET} {
+		if strings.HasPrefix(host, network+"://") {
+			return network, strings.TrimPrefix(host, network+"://")
+		}
+	}
+	return NETWORK_TCP, host
+}
+
 type ServiceResolver interface {
 	SetService(serviceName string, host string) error
 	GetService(serviceName string) (string, bool, error)
+	RemoveService(serviceName string) error
+	ListServices() (map[string]string, error)
 }
 
-var DefaultServiceResolver ServiceResolver = nil
-
-func init() {
-	sm := &MemoryServiceResolver{map[string]string{}, sync.Mutex{}}
-	DefaultServiceResolver = sm
-}
+// Deprecated: NewOperator gives every operator its own service resolver, and
+// operators do not use this one anymore. Assign it to Operator.ServiceResolver
+// to share it between operators like they used to.
+var DefaultServiceResolver ServiceResolver = NewMemoryServiceResolver()
 
 type MemoryServiceResolver struct {
 	Services map[string]string // map from service key to service address
 	lock     sync.Mutex
 }
 
+func NewMemoryServiceResolver() *MemoryServiceResolver {
+	return &MemoryServiceResolver{map[string]string{}, sync.Mutex{}}
+}
+
 func (r *MemoryServiceResolver) SetService(serviceName string, host string) error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -72,3 +139,20 @@ func (r *MemoryServiceResolver) GetService(serviceName string) (string, bool, er
 	serviceHost, found := r.Services[serviceName]
 	return serviceHost, found, nil
 }
+
+func (r *MemoryServiceResolver) RemoveService(serviceName string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.Services, serviceName)
+	return nil
+}
+
+func (r *MemoryServiceResolver) ListServices() (map[string]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	services := map[string]string{}
+	for serviceName, serviceHost := range r.Services {
+		services[serviceName] = serviceHost
+	}
+	return services, nil
+}
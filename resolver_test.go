@@ -0,0 +1,35 @@
+package operator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadOperatorResolver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolver.json")
+	Fatalize(t, os.WriteFile(path, []byte(`{"phone": "server1:10000"}`), 0600))
+	resolver, err := LoadOperatorResolver(path)
+	Fatalize(t, err)
+	host, err := resolver.ResolveOperator("phone")
+	Fatalize(t, err)
+	assert.Equal(t, "server1:10000", host)
+	_, err = resolver.ResolveOperator("tablet")
+	assert.Error(t, err)
+
+	Fatalize(t, os.WriteFile(path, []byte(`["phone"]`), 0600))
+	_, err = LoadOperatorResolver(path)
+	assert.Error(t, err)
+	_, err = LoadOperatorResolver(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestStaticOperatorResolver(t *testing.T) {
+	resolver := StaticOperatorResolver("server1:10000")
+	host, err := resolver.ResolveOperator("anyone")
+	Fatalize(t, err)
+	assert.Equal(t, "server1:10000", host)
+	assert.Error(t, resolver.SetOperator("anyone", "server2:10000"))
+}
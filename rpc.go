@@ -0,0 +1,191 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Method answered by every device with the JSON list of its services
+const CALL_LIST_SERVICES = "operator.services"
+
+// How long a call can wait for its response when the caller set no deadline
+var DefaultCallTimeout = 30 * time.Second
+
+// Handles a call made to this device. The returned payload goes back to the
+// caller, and so does the error message if the handler fails.
+type CallHandlerFunc func(payload []byte) ([]byte, error)
+
+// Registers the handler for the calls to that method on this device
+func (o *Operator) HandleCall(method string, handler CallHandlerFunc) {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	if o.callHandlers == nil {
+		o.callHandlers = map[string]CallHandlerFunc{}
+	}
+	o.callHandlers[method] = handler
+}
+
+func (o *Operator) getCallHandler(method string) (CallHandlerFunc, bool) {
+	o.messageLock.Lock()
+	defer o.messageLock.Unlock()
+	handler, found := o.callHandlers[method]
+	if !found && method == CALL_LIST_SERVICES {
+		return o.listServicesCall, true
+	}
+	return handler, found
+}
+
+func (o *Operator) listServicesCall(payload []byte) ([]byte, error) {
+	services, err := o.ServiceResolver.ListServices()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(NewServiceInfos(services))
+}
+
+// Forwards a call from a dialer through the link of its receiver
+func (o *Operator) handleCallRequest(conn FrameReadWriter, req *CallRequest) error {
+	o.Logger.Debug("Call request", LOG_RECEIVER_ID, req.receiverID, "method", req.method)
+	l, err := o.ConnectionManager.GetLink(req.receiverID)
+	if err != nil {
+		o.Logger.Warn("Failed to get link", LOG_RECEIVER_ID, req.receiverID, LOG_ERROR, err)
+		_, err := conn.SendFrame(&ErrorFrame{err.Error()})
+		return err
+	}
+
+	_, err = conn.SendFrame(l.Call(req))
+	return err
+}
+
+// Runs the handler of a call received on the link and sends its result back
+func (o *Operator) handleCall(link *Link, req *CallRequest) error {
+	link.Logger().Debug("Got call", "method", req.method, "callID", req.callID)
+	handler, found := o.getCallHandler(req.method)
+	if !found {
+		msg := EscapeContent([]byte("Method not found: " + req.method))
+		_, err := link.stream.SendFrame(&CallResponse{req.callID, msg, ""})
+		return err
+	}
+
+	go func() {
+		resp := &CallResponse{}
+		resp.callID = req.callID
+		payload, err := UnescapeContent(req.payload)
+		if err == nil {
+			payload, err = handler(payload)
+		}
+		if err != nil {
+			resp.message = EscapeContent([]byte(err.Error()))
+		} else {
+			resp.payload = EscapeContent(payload)
+		}
+
+		_, err = link.stream.SendFrame(resp)
+		if err != nil {
+			link.Logger().Warn("Failed to respond to call", "callID", req.callID, LOG_ERROR, err)
+		}
+	}()
+	return nil
+}
+
+// Sends the call down the link and waits for its response, which is either
+// a CallResponse or an ErrorFrame
+func (link *Link) Call(req *CallRequest) Frame {
+	ID := NewID()
+	channel, stop := link.waitReply(ID)
+	defer stop()
+
+	timeout := req.timeout
+	if timeout <= 0 {
+		timeout = DefaultCallTimeout
+	}
+
+	link.Logger().Debug("Calling", "method", req.method, "callID", ID)
+	_, err := link.stream.SendFrame(&CallRequest{req.receiverID, ID, req.method, timeout, req.payload})
+	if err != nil {
+		link.Logger().Error("Call error", "callID", ID, LOG_ERROR, err)
+		return &ErrorFrame{fmt.Sprintf("Unable to send call through link: %v", err)}
+	}
+
+	select {
+	case frame := <-channel:
+		return frame
+	case <-time.After(timeout):
+		return &ErrorFrame{fmt.Sprintf("Call timed out after %v", timeout)}
+	}
+}
+
+func (link *Link) handleCallResponse(res *CallResponse) error {
+	link.Logger().Debug("Link got call response", "callID", res.callID)
+	if !link.deliverReply(res.callID, res) {
+		link.Logger().Warn("Call response was found no associated waiting call", "callID", res.callID)
+	}
+	return nil
+}
+
+// Calls a method on the receiver over its link, without any service running
+// on the device. Returns the payload that the handler of the method returned.
+func (d *Dialer) Call(ctx context.Context, receiverID, method string, payload []byte) ([]byte, error) {
+	if strings.Contains(method, ",") {
+		return nil, fmt.Errorf("Method cannot contain commas: %s", method)
+	}
+
+	host, err := d.OperatorResolver.ResolveOperator(receiverID)
+	if err != nil {
+		d.logger().Error("OperatorResolver error", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return nil, err
+	}
+
+	conn, err := d.Transport.Dial(host)
+	if err != nil {
+		d.logger().Error("Failed to dial operator", LOG_RECEIVER_ID, receiverID, LOG_ERROR, err)
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Unblock the call when the context is done
+	timeout := DefaultCallTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	bufConn := NewBufferedConnection(conn)
+	req := &CallRequest{receiverID, "", method, timeout, EscapeContent(payload)}
+	_, err = bufConn.SendFrame(req)
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	}
+
+	resp, err := bufConn.GetFrame()
+	if err != nil {
+		return nil, ctxError(ctx, err)
+	} else if resp.IsError() {
+		return nil, fmt.Errorf("%s", string(resp.Content()))
+	}
+
+	cast, ok := resp.(*CallResponse)
+	if !ok {
+		return nil, ImpossibleError()
+	} else if cast.message != "" {
+		message, err := UnescapeContent(cast.message)
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Call error: %s", string(message))
+	}
+	return UnescapeContent(cast.payload)
+}
+
+// Prefers the error of the context when it is the reason of the failure
+func ctxError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
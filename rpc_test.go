@@ -0,0 +1,82 @@
+package operator
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCall(t *testing.T) {
+	server, device, dialer := newTestNetwork(t, "call")
+	device.HandleCall("upper", func(payload []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(payload))), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	payload, err := dialer.Call(ctx, device.ReceiverID, "upper", []byte("hello, world"))
+	Fatalize(t, err)
+	assert.Equal(t, "HELLO, WORLD", string(payload))
+
+	_, err = dialer.Call(ctx, device.ReceiverID, "missing", nil)
+	assert.ErrorContains(t, err, "Method not found")
+
+	_, err = dialer.Call(ctx, device.ReceiverID, CALL_LIST_SERVICES, nil)
+	Fatalize(t, err)
+
+	l := waitTestLink(t, server, device.ReceiverID)
+	l.tunnelLock.Lock()
+	defer l.tunnelLock.Unlock()
+	assert.Empty(t, l.replies)
+	assert.Equal(t, 0, l.pendingTunnels)
+}
+
+func TestCallTimeout(t *testing.T) {
+	server, device, _ := newTestNetwork(t, "call-timeout")
+	release := make(chan bool)
+	device.HandleCall("slow", func(payload []byte) ([]byte, error) {
+		<-release
+		return payload, nil
+	})
+	device.HandleCall("fast", func(payload []byte) ([]byte, error) {
+		return payload, nil
+	})
+
+	l := waitTestLink(t, server, device.ReceiverID)
+	resp := l.Call(&CallRequest{device.ReceiverID, "", "slow", 50 * time.Millisecond, EscapeContent([]byte("late"))})
+	assert.True(t, resp.IsError())
+	assert.Contains(t, string(resp.Content()), "timed out")
+
+	// The late response is dropped and the link keeps going
+	close(release)
+	resp = l.Call(&CallRequest{device.ReceiverID, "", "fast", 5 * time.Second, EscapeContent([]byte("on time"))})
+	if cast, ok := resp.(*CallResponse); assert.True(t, ok, "%v", resp) {
+		assert.Equal(t, EscapeContent([]byte("on time")), cast.payload)
+	}
+}
+
+func TestCallDuplicateResponse(t *testing.T) {
+	l := NewLink(closedConnection{}, "phone")
+	channel, stop := l.waitReply("call")
+	defer stop()
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		Fatalize(t, l.handleCallResponse(&CallResponse{"call", "", "first"}))
+		Fatalize(t, l.handleCallResponse(&CallResponse{"call", "", "second"}))
+		Fatalize(t, l.handleCallResponse(&CallResponse{"unknown", "", "third"}))
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call responses blocked the link")
+	}
+
+	resp := <-channel
+	assert.Equal(t, "first", resp.(*CallResponse).payload)
+	assert.Empty(t, l.replies)
+}
@@ -0,0 +1,49 @@
+package operator
+
+import "context"
+
+// Tracer starts the spans of the phases of a dial, and carries their context
+// in DialRequest and TunnelRequest frames so that the spans of the operator and
+// of the device join the trace of the dialer. The otel package implements it
+// with OpenTelemetry, and the default does nothing.
+type Tracer interface {
+	// Starts a span, child of the span in ctx. Fields are alternating
+	// keys and values, as with Logger.
+	Start(ctx context.Context, name string, fields ...interface{}) (context.Context, Span)
+
+	// Encodes the span context in ctx to carry it in a frame
+	Inject(ctx context.Context) string
+
+	// Returns ctx with the span context decoded from a frame
+	Extract(ctx context.Context, traceContext string) context.Context
+}
+
+type Span interface {
+	// Ends the span, marking it failed when err is not nil
+	End(err error)
+}
+
+// The spans of a dial
+const (
+	SPAN_DIAL            = "operator.dial"            // Whole dial, on the dialer
+	SPAN_RESOLVE         = "operator.resolve"         // OperatorResolver lookup, on the dialer
+	SPAN_CONNECT         = "operator.connect"         // Connection to the operator, on the dialer
+	SPAN_DIAL_REQUEST    = "operator.dial_request"    // DialRequest until its response, on the dialer
+	SPAN_TUNNEL          = "operator.tunnel"          // Tunnel round-trip over the link, on the operator
+	SPAN_SERVICE_CONNECT = "operator.service_connect" // Connection to the service, on the device
+)
+
+var DefaultTracer Tracer = &nopTracer{}
+
+type nopTracer struct{}
+type nopSpan struct{}
+
+func (t *nopTracer) Start(ctx context.Context, name string, fields ...interface{}) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+func (t *nopTracer) Inject(ctx context.Context) string { return "" }
+func (t *nopTracer) Extract(ctx context.Context, traceContext string) context.Context {
+	return ctx
+}
+
+func (s nopSpan) End(err error) {}
@@ -0,0 +1,76 @@
+package operator
+
+import (
+	"net"
+	"sync"
+)
+
+// LinkTransport creates the connections that links run on. The frames
+// going through that connection are the same whatever the transport.
+type LinkTransport interface {
+	// Opens a connection to the operator at that address
+	Dial(operatorAddr string) (net.Conn, error)
+}
+
+var DefaultLinkTransport LinkTransport = &TCPTransport{}
+
+// TCPTransport links over a raw tcp connection
+type TCPTransport struct{}
+
+func (t *TCPTransport) Dial(operatorAddr string) (net.Conn, error) {
+	return net.Dial("tcp", operatorAddr)
+}
+
+// LinkDialer lets any dial function be used as a LinkTransport
+type LinkDialer func(operatorAddr string) (net.Conn, error)
+
+func (f LinkDialer) Dial(operatorAddr string) (net.Conn, error) {
+	return f(operatorAddr)
+}
+
+// PipeListener is an in-memory net.Listener. It is also a LinkTransport
+// whose connections get accepted by that listener, which lets operators
+// and dialers talk to each other without any socket.
+type PipeListener struct {
+	name  string
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func NewPipeListener(name string) *PipeListener {
+	lis := &PipeListener{}
+	lis.name = name
+	lis.conns = make(chan net.Conn)
+	lis.done = make(chan struct{})
+	return lis
+}
+
+func (lis *PipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-lis.conns:
+		return conn, nil
+	case <-lis.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (lis *PipeListener) Close() error {
+	lis.once.Do(func() { close(lis.done) })
+	return nil
+}
+
+func (lis *PipeListener) Addr() net.Addr {
+	return ServiceAddr(lis.name)
+}
+
+// Connects to that listener, whatever the address
+func (lis *PipeListener) Dial(operatorAddr string) (net.Conn, error) {
+	local, remote := NewPipe(ServiceAddr(operatorAddr), lis.Addr())
+	select {
+	case lis.conns <- remote:
+		return local, nil
+	case <-lis.done:
+		return nil, net.ErrClosed
+	}
+}
@@ -0,0 +1,105 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPipeTransport(t *testing.T) {
+	lis := NewPipeListener("pipe-server")
+	defer lis.Close()
+
+	server := NewOperator("pipe-server", "pipe-server")
+	go server.ServeListener(lis)
+
+	device := NewOperator("pipe-device", "pipe-device")
+	device.LinkTransport = lis
+	device.Link("pipe-server")
+
+	// Echo service on the device
+	svc, err := net.Listen("tcp", "127.0.0.1:0")
+	Fatalize(t, err)
+	defer svc.Close()
+	go func() {
+		for {
+			conn, err := svc.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+	device.ServiceResolver.SetService("echo", svc.Addr().String())
+
+	// Wait for the link
+	for i := 0; i < 100; i++ {
+		if _, err = server.ConnectionManager.GetLink("pipe-device"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	Fatalize(t, err)
+
+	dialer := NewDialer(nil)
+	dialer.Transport = lis
+	conn, err := dialer.Dial("pipe-device", "echo")
+	Fatalize(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	Fatalize(t, err)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	Fatalize(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// Links and dials over websockets served by httptest, with and without tls
+func TestWebSocketTransport(t *testing.T) {
+	for _, secure := range []bool{true, false} {
+		name := fmt.Sprintf("ws-tls-%v", secure)
+		server := NewOperator(name+"-server", "")
+		mux := http.NewServeMux()
+		mux.Handle(WEBSOCKET_PATH, server.WebSocketHandler())
+		transport := NewWebSocketTransport()
+		var srv *httptest.Server
+		if secure {
+			// A bare host goes over wss
+			srv = httptest.NewTLSServer(mux)
+			transport.Dialer = &websocket.Dialer{TLSClientConfig: srv.Client().Transport.(*http.Transport).TLSClientConfig}
+			server.Address = srv.Listener.Addr().String()
+		} else {
+			srv = httptest.NewServer(mux)
+			transport.Dialer = &websocket.Dialer{}
+			server.Address = "ws://" + srv.Listener.Addr().String() + WEBSOCKET_PATH
+		}
+		defer srv.Close()
+
+		device := NewOperator(name+"-device", name+"-device")
+		device.LinkTransport = transport
+		device.Link(server.Address)
+		serveTestService(t, device, "echo", echoHandler)
+		waitTestLink(t, server, device.ReceiverID)
+
+		dialer := NewDialer(StaticOperatorResolver(server.Address))
+		dialer.Transport = transport
+		conn, err := dialer.Dial(device.ReceiverID, "echo")
+		Fatalize(t, err)
+		_, err = conn.Write([]byte("over websockets"))
+		Fatalize(t, err)
+		buf := make([]byte, 15)
+		_, err = io.ReadFull(conn, buf)
+		Fatalize(t, err)
+		assert.Equal(t, "over websockets", string(buf))
+		conn.Close()
+	}
+}
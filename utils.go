@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"math/rand"
 	"time"
-
-	"github.com/golang/glog"
 )
 
 func NewID() string {
@@ -24,12 +22,15 @@ func EscapeContent(content []byte) string {
 	return enc
 }
 
-func UnescapeContent(content string) []byte {
-	dec, _ := base64.StdEncoding.DecodeString(content)
-	return dec
+func UnescapeContent(content string) ([]byte, error) {
+	dec, err := base64.StdEncoding.DecodeString(content)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEscape, err)
+	}
+	return dec, nil
 }
 
 func ImpossibleError() error {
-	glog.Warningf("An impossible error happened...")
+	DefaultLogger.Warn("An impossible error happened...")
 	return fmt.Errorf("Impossible error occured")
 }
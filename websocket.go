@@ -0,0 +1,154 @@
+package operator
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The http path on which operators accept websocket links
+const WEBSOCKET_PATH = "/operator/link"
+
+// WebSocketTransport links over a websocket, so that devices can reach
+// operators through HTTP(S) proxies. The default dialer honors the
+// HTTPS_PROXY environment variable for wss:// urls, and HTTP_PROXY for
+// ws:// ones.
+type WebSocketTransport struct {
+	Dialer *websocket.Dialer
+}
+
+func NewWebSocketTransport() *WebSocketTransport {
+	return &WebSocketTransport{websocket.DefaultDialer}
+}
+
+// The operator address is either a full ws:// or wss:// url, or a host
+// in which case the link goes to wss://<host>/operator/link, since
+// proxies usually only let tls through
+func (t *WebSocketTransport) Dial(operatorAddr string) (net.Conn, error) {
+	url := operatorAddr
+	if !strings.HasPrefix(url, "ws://") && !strings.HasPrefix(url, "wss://") {
+		url = "wss://" + operatorAddr + WEBSOCKET_PATH
+	}
+
+	ws, resp, err := t.Dialer.Dial(url, nil)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("Websocket handshake failed (%s): %v", resp.Status, err)
+		}
+		return nil, err
+	}
+	return newWebSocketConn(ws), nil
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// Returns the handler that accepts links and dials over websockets
+func (o *Operator) WebSocketHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			o.Logger.Warn("Failed to upgrade websocket", LOG_REMOTE_ADDR, r.RemoteAddr, LOG_ERROR, err)
+			return
+		}
+		o.Logger.Debug("Accepted websocket connection", LOG_REMOTE_ADDR, r.RemoteAddr)
+
+		err = o.respond(o.newConnection(newWebSocketConn(ws)))
+		if err != nil {
+			o.Logger.Warn("Failed to respond to websocket connection", LOG_REMOTE_ADDR, r.RemoteAddr, LOG_ERROR, err)
+			ws.Close()
+			return
+		}
+		o.Logger.Debug("Successfully handled websocket connection", LOG_REMOTE_ADDR, r.RemoteAddr)
+	})
+}
+
+// Serves the websocket endpoint of the operator on that port, without tls.
+// Devices link to it with a ws:// url.
+func (o *Operator) ServeWebSocket(port int) error {
+	o.Logger.Info("Serving operator websockets", "port", port)
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), o.webSocketMux())
+	if err != nil {
+		o.Logger.Error("Failed to serve operator websockets", LOG_ERROR, err)
+	}
+	return err
+}
+
+// Same as ServeWebSocket, over tls with that certificate. Devices link to it
+// with a wss:// url or just its host.
+func (o *Operator) ServeWebSocketTLS(port int, certFile, keyFile string) error {
+	o.Logger.Info("Serving operator websockets over tls", "port", port)
+	err := http.ListenAndServeTLS(fmt.Sprintf(":%d", port), certFile, keyFile, o.webSocketMux())
+	if err != nil {
+		o.Logger.Error("Failed to serve operator websockets", LOG_ERROR, err)
+	}
+	return err
+}
+
+func (o *Operator) webSocketMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(WEBSOCKET_PATH, o.WebSocketHandler())
+	return mux
+}
+
+// webSocketConn turns a websocket into a bytestream. Every write is sent
+// as one binary message and reads go through messages transparently.
+type webSocketConn struct {
+	*websocket.Conn
+	reader    io.Reader
+	writeLock sync.Mutex
+}
+
+func newWebSocketConn(ws *websocket.Conn) *webSocketConn {
+	return &webSocketConn{Conn: ws}
+}
+
+func (c *webSocketConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			_, reader, err := c.Conn.NextReader()
+			if err != nil {
+				// A websocket is unusable after any read error
+				DefaultLogger.Debug("Websocket closed", LOG_REMOTE_ADDR, c.Conn.RemoteAddr().String(), LOG_ERROR, err)
+				return 0, io.EOF
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(p)
+		if err == io.EOF {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	err := c.Conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	err := c.Conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.Conn.SetWriteDeadline(t)
+}